@@ -0,0 +1,276 @@
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/tinyiot/thing-directory/wot"
+)
+
+const (
+	// Affordance kinds
+	AffordanceProperty = "property"
+	AffordanceAction   = "action"
+	AffordanceEvent    = "event"
+)
+
+// CapabilityQuery selects Things by the capabilities of their interaction affordances
+// All set constraints must be met by the same affordance.
+type CapabilityQuery struct {
+	// Affordance is the kind of affordance: property, action, or event. Empty matches all kinds.
+	Affordance string `json:"affordance,omitempty"`
+	// ReadOnly, WriteOnly, and Observable match the property flags. Unset flags are treated as false.
+	ReadOnly   *bool `json:"readOnly,omitempty"`
+	WriteOnly  *bool `json:"writeOnly,omitempty"`
+	Observable *bool `json:"observable,omitempty"`
+	// Input is the data sent by the consumer, which must be accepted by the action input or the writable property.
+	Input *SchemaQuery `json:"input,omitempty"`
+	// Output is the data expected by the consumer, which must be provided by the action output, the readable property, or the event data.
+	Output *SchemaQuery `json:"output,omitempty"`
+}
+
+// SchemaQuery describes data that is compared with data schemas
+type SchemaQuery struct {
+	// Type is the JSON data type. Integers are compatible with numbers.
+	Type string `json:"type,omitempty"`
+	Unit string `json:"unit,omitempty"`
+	// Minimum and Maximum is the range of the data
+	Minimum *float64 `json:"minimum,omitempty"`
+	Maximum *float64 `json:"maximum,omitempty"`
+	// Properties describe the members of object data
+	Properties map[string]*SchemaQuery `json:"properties,omitempty"`
+}
+
+// CapabilitySearchResult is the result of a capability search
+type CapabilitySearchResult struct {
+	Total int                   `json:"total"`
+	Hits  []CapabilitySearchHit `json:"hits"`
+}
+
+// CapabilitySearchHit is a matching TD with the names of the matching affordances
+type CapabilitySearchHit struct {
+	ID         string           `json:"id"`
+	Properties []string         `json:"properties,omitempty"`
+	Actions    []string         `json:"actions,omitempty"`
+	Events     []string         `json:"events,omitempty"`
+	TD         ThingDescription `json:"td"`
+}
+
+func (q *CapabilityQuery) validate() error {
+	switch q.Affordance {
+	case "", AffordanceProperty, AffordanceAction, AffordanceEvent:
+	default:
+		return &BadRequestError{fmt.Sprintf("unsupported affordance: %s", q.Affordance)}
+	}
+	if q.Affordance != "" && q.Affordance != AffordanceProperty &&
+		(q.ReadOnly != nil || q.WriteOnly != nil || q.Observable != nil) {
+		return &BadRequestError{"readOnly, writeOnly and observable only apply to properties"}
+	}
+	if q.Affordance == AffordanceEvent && q.Input != nil {
+		return &BadRequestError{"input does not apply to events"}
+	}
+	for _, s := range []*SchemaQuery{q.Input, q.Output} {
+		err := s.validate()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SchemaQuery) validate() error {
+	if s == nil {
+		return nil
+	}
+	if s.Type != "" {
+		valid := false
+		for _, t := range wot.DataSchemaDataTypeEnumValues {
+			if s.Type == t {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return &BadRequestError{fmt.Sprintf("unsupported data type: %s", s.Type)}
+		}
+	}
+	if s.Minimum != nil && s.Maximum != nil && *s.Minimum > *s.Maximum {
+		return &BadRequestError{"minimum must not be larger than maximum"}
+	}
+	for _, p := range s.Properties {
+		err := p.validate()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// match returns the names of the matching affordances of the TD
+func (q *CapabilityQuery) match(td ThingDescription) (hit CapabilitySearchHit, matched bool) {
+	if q.Affordance == "" || q.Affordance == AffordanceProperty {
+		for name, raw := range affordances(td, "properties") {
+			var p wot.PropertyAffordance
+			if decodeAffordance(raw, &p) && q.matchProperty(p) {
+				hit.Properties = append(hit.Properties, name)
+			}
+		}
+	}
+	// flags are only set on properties
+	flags := q.ReadOnly != nil || q.WriteOnly != nil || q.Observable != nil
+	if (q.Affordance == "" && !flags) || q.Affordance == AffordanceAction {
+		for name, raw := range affordances(td, "actions") {
+			var a wot.ActionAffordance
+			if decodeAffordance(raw, &a) && q.matchAction(a, raw) {
+				hit.Actions = append(hit.Actions, name)
+			}
+		}
+	}
+	if (q.Affordance == "" && !flags && q.Input == nil) || q.Affordance == AffordanceEvent {
+		for name, raw := range affordances(td, "events") {
+			var e wot.EventAffordance
+			if decodeAffordance(raw, &e) && q.matchEvent(e, raw) {
+				hit.Events = append(hit.Events, name)
+			}
+		}
+	}
+
+	sort.Strings(hit.Properties)
+	sort.Strings(hit.Actions)
+	sort.Strings(hit.Events)
+	return hit, len(hit.Properties)+len(hit.Actions)+len(hit.Events) > 0
+}
+
+func (q *CapabilityQuery) matchProperty(p wot.PropertyAffordance) bool {
+	if q.ReadOnly != nil && *q.ReadOnly != p.ReadOnly {
+		return false
+	}
+	if q.WriteOnly != nil && *q.WriteOnly != p.WriteOnly {
+		return false
+	}
+	if q.Observable != nil && *q.Observable != p.Observable {
+		return false
+	}
+	if q.Input != nil && (p.ReadOnly || !q.Input.acceptedBy(&p.DataSchema)) {
+		return false
+	}
+	if q.Output != nil && (p.WriteOnly || !q.Output.providedBy(&p.DataSchema)) {
+		return false
+	}
+	return true
+}
+
+func (q *CapabilityQuery) matchAction(a wot.ActionAffordance, raw map[string]interface{}) bool {
+	if q.Input != nil {
+		if _, found := raw["input"]; !found || !q.Input.acceptedBy(&a.Input) {
+			return false
+		}
+	}
+	if q.Output != nil {
+		if _, found := raw["output"]; !found || !q.Output.providedBy(&a.Output) {
+			return false
+		}
+	}
+	return true
+}
+
+func (q *CapabilityQuery) matchEvent(e wot.EventAffordance, raw map[string]interface{}) bool {
+	if q.Output != nil {
+		if _, found := raw["data"]; !found || !q.Output.providedBy(&e.Data) {
+			return false
+		}
+	}
+	return true
+}
+
+// acceptedBy returns true if the described data is valid against the schema
+// Schema constraints that are not set accept any value. Ranges are compared only when set in the query.
+func (s *SchemaQuery) acceptedBy(schema *wot.DataSchema) bool {
+	if s.Type != "" && schema.DataType != "" && schema.DataType != s.Type &&
+		!(schema.DataType == "number" && s.Type == "integer") {
+		return false
+	}
+	if s.Unit != "" && schema.Unit != s.Unit {
+		return false
+	}
+	if schema.NumberSchema != nil {
+		if min, ok := schemaNumber(schema.Minimum); ok && s.Minimum != nil && *s.Minimum < min {
+			return false
+		}
+		if max, ok := schemaNumber(schema.Maximum); ok && s.Maximum != nil && *s.Maximum > max {
+			return false
+		}
+	}
+	for name, property := range s.Properties {
+		if schema.ObjectSchema == nil {
+			return false
+		}
+		propertySchema, found := schema.ObjectSchema.Properties[name]
+		if !found || !property.acceptedBy(&propertySchema) {
+			return false
+		}
+	}
+	return true
+}
+
+// providedBy returns true if all data valid against the schema is within the described data
+func (s *SchemaQuery) providedBy(schema *wot.DataSchema) bool {
+	if s.Type != "" && schema.DataType != s.Type &&
+		!(s.Type == "number" && schema.DataType == "integer") {
+		return false
+	}
+	if s.Unit != "" && schema.Unit != s.Unit {
+		return false
+	}
+	if s.Minimum != nil || s.Maximum != nil {
+		if schema.NumberSchema == nil {
+			return false
+		}
+		if min, ok := schemaNumber(schema.Minimum); s.Minimum != nil && (!ok || min < *s.Minimum) {
+			return false
+		}
+		if max, ok := schemaNumber(schema.Maximum); s.Maximum != nil && (!ok || max > *s.Maximum) {
+			return false
+		}
+	}
+	for name, property := range s.Properties {
+		if schema.ObjectSchema == nil {
+			return false
+		}
+		propertySchema, found := schema.ObjectSchema.Properties[name]
+		if !found || !property.providedBy(&propertySchema) {
+			return false
+		}
+	}
+	return true
+}
+
+// affordances returns the affordances of the given kind e.g. "properties"
+func affordances(td ThingDescription, kind string) map[string]map[string]interface{} {
+	all, _ := td[kind].(map[string]interface{})
+	result := make(map[string]map[string]interface{}, len(all))
+	for name, v := range all {
+		if affordance, ok := v.(map[string]interface{}); ok {
+			result[name] = affordance
+		}
+	}
+	return result
+}
+
+// decodeAffordance converts the affordance to its typed structure
+func decodeAffordance(raw map[string]interface{}, v interface{}) bool {
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(b, v) == nil
+}
+
+func schemaNumber(v *interface{}) (float64, bool) {
+	if v == nil {
+		return 0, false
+	}
+	f, ok := (*v).(float64)
+	return f, ok
+}
@@ -3,6 +3,7 @@ package catalog
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/tinyiot/thing-directory/wot"
 )
@@ -27,26 +28,51 @@ func validateThingDescription(td map[string]interface{}) ([]wot.ValidationError,
 type CatalogController interface {
 	add(d ThingDescription) (string, error)
 	get(id string) (ThingDescription, error)
+	getMany(ids []string) (map[string]ThingDescription, error)
 	update(id string, d ThingDescription) error
 	patch(id string, d ThingDescription) error
 	delete(id string) error
-	listPaginate(offset, limit int) ([]ThingDescription, error)
+	listPaginate(p Pagination, filter *Filter, sorting *Sorting) (*Page, error)
 	filterJSONPathBytes(query string) ([]byte, error)
-	iterateBytes(ctx context.Context) <-chan []byte
+	searchText(query, lang string, offset, limit int) (*TextSearchResult, error)
+	searchGeo(q GeoQuery, offset, limit int) (*GeoSearchResult, error)
+	searchCapability(q CapabilityQuery, offset, limit int) (*CapabilitySearchResult, error)
+	facets(fields []string, jsonPathQuery string, filter *Filter) (*FacetResult, error)
+	iterateBytes(ctx context.Context, filter *Filter, projection *Projection) <-chan []byte
 	cleanExpired()
 	Stop()
-	AddSubscriber(listener EventListener)
+	AddSubscriber(listeners ...EventListener)
 }
 
 // Storage interface
+// The changes of TDs are committed together with their events in an outbox, for dispatch to the event listeners.
 type Storage interface {
 	add(id string, td ThingDescription) error
 	update(id string, td ThingDescription) error
 	delete(id string) error
+	// expiring adds a thing_expiring event with the TD to the outbox, unless the TD no longer expires at the given time
+	expiring(id string, expires time.Time) error
 	get(id string) (ThingDescription, error)
+	// getMany returns the found TDs by id
+	getMany(ids []string) (map[string]ThingDescription, error)
 	listPaginate(offset, limit int) ([]ThingDescription, error)
+	listAfter(id string, limit int) ([]ThingDescription, error)
+	// listSorted returns the TDs in the order of an indexed sorting, after the key or from the offset
+	listSorted(sorting *Sorting, after *sortKey, offset, limit int) ([]ThingDescription, error)
+	count() (int, error)
 	listAllBytes() ([]byte, error)
 	iterate() <-chan ThingDescription
 	iterateBytes(ctx context.Context) <-chan []byte
+	// outbox returns the oldest events after the id that are not removed yet
+	outbox(after uint64, limit int) ([]outboxEvent, error)
+	// removeEvents removes the events up to the id from the outbox, after they are dispatched to all listeners
+	removeEvents(upTo uint64) error
 	Close()
 }
+
+// tdIndex is a secondary index of TDs, updated by the controller on every write
+type tdIndex interface {
+	index(id string, td ThingDescription) error
+	remove(id string) error
+	close() error
+}
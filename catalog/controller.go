@@ -1,12 +1,15 @@
 package catalog
 
 import (
+	"container/heap"
 	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"runtime/debug"
+	"sort"
 	"strconv"
+	"sync"
 	"time"
 
 	xpath "github.com/antchfx/jsonquery"
@@ -17,19 +20,76 @@ import (
 )
 
 const (
-	MaxLimit = 100
+	MaxLimit     = 100
+	MaxBatchSize = 1000
 )
 
-var controllerExpiryCleanupInterval = 60 * time.Second // to be modified in unit tests
+// controllerExpiryCleanupInterval is the interval of removing the expired registrations
+const controllerExpiryCleanupInterval = 60 * time.Second
 
 type Controller struct {
 	storage   Storage
-	listeners eventHandler
+	textIndex *textIndex
+	geoIndex  *geoIndex
+	indexes   []tdIndex
+	// writeLock serializes the writes to storage with the updates of the indexes, to keep the indexes on the latest TDs
+	writeLock sync.Mutex
+
+	sync.Mutex
+	// listeners are the dispatchers of the event listeners
+	listeners []*dispatcher
+	// removedUpTo is the id of the latest event removed from the outbox after all listeners got it
+	removedUpTo uint64
+
+	// expiryWarning is the time before the expiry of a registration to send the thing_expiring event
+	expiryWarning time.Duration
+	// cleanupInterval is the interval of checking all registrations for expiry, in addition to the scheduled checks
+	cleanupInterval time.Duration
+	// scheduledChecks are the checks of the written registrations, passed to the cleaner on wake
+	scheduledChecks []expiryCheck
+	cleanerWake     chan struct{}
+	cleanerDone     chan struct{}
+
+	// the dispatchers send the events of the storage outbox to the listeners
+	dispatcherQuit chan struct{}
+	dispatchers    sync.WaitGroup
 }
 
-func NewController(storage Storage) (CatalogController, error) {
+// NewController creates a controller. The geoLocations define where coordinates are found in TDs for geospatial search.
+// If expiryWarning is not zero, the listeners get a thing_expiring event that long before a registration expires.
+func NewController(storage Storage, geoLocations []GeoLocation, expiryWarning time.Duration) (CatalogController, error) {
+	return newController(storage, geoLocations, expiryWarning, controllerExpiryCleanupInterval)
+}
+
+func newController(storage Storage, geoLocations []GeoLocation, expiryWarning, cleanupInterval time.Duration) (CatalogController, error) {
+	textIndex, err := newTextIndex()
+	if err != nil {
+		return nil, err
+	}
+	geoIndex, err := newGeoIndex(geoLocations)
+	if err != nil {
+		return nil, err
+	}
+
 	c := Controller{
-		storage: storage,
+		storage:   storage,
+		textIndex: textIndex,
+		geoIndex:  geoIndex,
+		indexes:   []tdIndex{textIndex, geoIndex},
+
+		expiryWarning:   expiryWarning,
+		cleanupInterval: cleanupInterval,
+		cleanerWake:     make(chan struct{}, 1),
+		cleanerDone:     make(chan struct{}),
+
+		dispatcherQuit: make(chan struct{}),
+	}
+
+	// build the indexes from stored TDs
+	for td := range storage.iterate() {
+		if id, ok := td[wot.KeyThingID].(string); ok {
+			c.index(id, td)
+		}
 	}
 
 	go c.cleanExpired()
@@ -37,8 +97,23 @@ func NewController(storage Storage) (CatalogController, error) {
 	return &c, nil
 }
 
-func (c *Controller) AddSubscriber(listener EventListener) {
-	c.listeners = append(c.listeners, listener)
+// AddSubscriber adds the event listeners. Events that are committed while there are no listeners are kept
+// until listeners are added, so all listeners should be added at once.
+func (c *Controller) AddSubscriber(listeners ...EventListener) {
+	c.Lock()
+	defer c.Unlock()
+	for _, listener := range listeners {
+		d := &dispatcher{
+			listener: listener,
+			wake:     make(chan struct{}, 1),
+			// start with the kept events
+			delivered: c.removedUpTo,
+		}
+		d.wake <- struct{}{}
+		c.listeners = append(c.listeners, d)
+		c.dispatchers.Add(1)
+		go c.dispatch(d)
+	}
 }
 
 func (c *Controller) add(td ThingDescription) (string, error) {
@@ -59,19 +134,25 @@ func (c *Controller) add(td ThingDescription) (string, error) {
 
 	now := time.Now().UTC()
 	tr := ThingRegistration(td)
+	expires := computeExpiry(tr, now)
 	td[wot.KeyThingRegistration] = wot.ThingRegistration{
 		Created:  &now,
 		Modified: &now,
-		Expires:  computeExpiry(tr, now),
+		Expires:  expires,
 		TTL:      ThingTTL(tr),
 	}
 
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
 	err = c.storage.add(id, td)
 	if err != nil {
 		return "", err
 	}
+	c.index(id, td)
+	c.scheduleExpiry(id, expires)
 
-	go c.listeners.created(td)
+	c.wakeDispatchers()
 
 	return id, nil
 }
@@ -90,6 +171,14 @@ func (c *Controller) get(id string) (ThingDescription, error) {
 	return td, nil
 }
 
+// getMany returns the found TDs by id. Ids that are not found are omitted.
+func (c *Controller) getMany(ids []string) (map[string]ThingDescription, error) {
+	if len(ids) > MaxBatchSize {
+		return nil, &BadRequestError{fmt.Sprintf("number of ids must not be larger than %d", MaxBatchSize)}
+	}
+	return c.storage.getMany(ids)
+}
+
 func (c *Controller) update(id string, td ThingDescription) error {
 	oldTD, err := c.storage.get(id)
 	if err != nil {
@@ -107,19 +196,25 @@ func (c *Controller) update(id string, td ThingDescription) error {
 	now := time.Now().UTC()
 	oldTR := ThingRegistration(oldTD)
 	tr := ThingRegistration(td)
+	expires := computeExpiry(tr, now)
 	td[wot.KeyThingRegistration] = wot.ThingRegistration{
 		Created:  oldTR.Created,
 		Modified: &now,
-		Expires:  computeExpiry(tr, now),
+		Expires:  expires,
 		TTL:      ThingTTL(tr),
 	}
 
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
 	err = c.storage.update(id, td)
 	if err != nil {
 		return err
 	}
+	c.index(id, td)
+	c.scheduleExpiry(id, expires)
 
-	go c.listeners.updated(oldTD, td)
+	c.wakeDispatchers()
 
 	return nil
 }
@@ -166,53 +261,135 @@ func (c *Controller) patch(id string, td ThingDescription) error {
 	now := time.Now().UTC()
 	oldTR := ThingRegistration(oldTD)
 	tr := ThingRegistration(td)
+	expires := computeExpiry(tr, now)
 	td[wot.KeyThingRegistration] = wot.ThingRegistration{
 		Created:  oldTR.Created,
 		Modified: &now,
-		Expires:  computeExpiry(tr, now),
+		Expires:  expires,
 		TTL:      ThingTTL(tr),
 	}
 
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
 	err = c.storage.update(id, td)
 	if err != nil {
 		return err
 	}
+	c.index(id, td)
+	c.scheduleExpiry(id, expires)
 
-	go c.listeners.updated(oldTD, td)
+	c.wakeDispatchers()
 
 	return nil
 }
 
 func (c *Controller) delete(id string) error {
-	oldTD, err := c.storage.get(id)
-	if err != nil {
-		return err
-	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
 
-	err = c.storage.delete(id)
+	err := c.storage.delete(id)
 	if err != nil {
 		return err
 	}
+	c.unindex(id)
 
-	go c.listeners.deleted(oldTD)
+	c.wakeDispatchers()
 
 	return nil
 }
 
-func (c *Controller) listPaginate(offset, limit int) ([]ThingDescription, error) {
-	if offset < 0 || limit < 0 {
-		return nil, fmt.Errorf("offset and limit must not be negative")
+func (c *Controller) listPaginate(p Pagination, filter *Filter, sorting *Sorting) (*Page, error) {
+	if p.Offset < 0 || p.Limit < 0 {
+		return nil, &BadRequestError{"offset and limit must not be negative"}
 	}
-	if limit > MaxLimit {
-		return nil, fmt.Errorf("limit must be smaller than %d", MaxLimit)
+	if p.Limit > MaxLimit {
+		return nil, &BadRequestError{fmt.Sprintf("limit must not be larger than %d", MaxLimit)}
+	}
+	if p.Offset != 0 && p.After != "" {
+		return nil, &BadRequestError{"offset and continuation token must not be used together"}
+	}
+	if sorting == nil {
+		sorting = &Sorting{Field: SortByID}
 	}
 
-	tds, err := c.storage.listPaginate(offset, limit)
-	if err != nil {
-		return nil, err
+	var after *sortKey
+	if p.After != "" {
+		k, err := decodeCursor(p.After, sorting)
+		if err != nil {
+			return nil, err
+		}
+		after = &k
+	}
+
+	// one more item is fetched to know if there is a next page
+	var page Page
+	var items []ThingDescription
+	var err error
+
+	if filter.IsEmpty() && sorting.isIndexed() {
+		page.Total, err = c.storage.count()
+		if err != nil {
+			return nil, err
+		}
+		if !sorting.isStorageOrder() {
+			items, err = c.storage.listSorted(sorting, after, p.Offset, p.Limit+1)
+		} else if after != nil {
+			items, err = c.storage.listAfter(after.id, p.Limit+1)
+		} else {
+			items, err = c.storage.listPaginate(p.Offset, p.Limit+1)
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else if sorting.isStorageOrder() {
+		for td := range c.iterate(context.Background(), filter) {
+			page.Total++
+			if after != nil {
+				if id, _ := td[wot.KeyThingID].(string); id <= after.id {
+					continue
+				}
+			} else if page.Total <= p.Offset {
+				continue
+			}
+			if len(items) <= p.Limit {
+				items = append(items, td)
+			}
+		}
+	} else {
+		// all matching TDs are needed to find the page of a filtered or title sorting
+		var all []ThingDescription
+		for td := range c.iterate(context.Background(), filter) {
+			all = append(all, td)
+		}
+		keys := sorting.sort(all)
+		page.Total = len(all)
+
+		start := p.Offset
+		if after != nil {
+			start = sort.Search(len(keys), func(i int) bool {
+				return sorting.less(*after, keys[i])
+			})
+		}
+		if start < len(all) {
+			end := start + p.Limit + 1
+			if end > len(all) {
+				end = len(all)
+			}
+			items = all[start:end]
+		}
 	}
 
-	return tds, nil
+	if len(items) > p.Limit {
+		items = items[:p.Limit]
+		if p.Limit > 0 {
+			page.Next = encodeCursor(sorting, items[len(items)-1])
+		}
+	}
+	page.Items = make([]ThingDescription, 0, len(items))
+	page.Items = append(page.Items, items...)
+
+	return &page, nil
 }
 
 func (c *Controller) filterJSONPathBytes(query string) ([]byte, error) {
@@ -231,8 +408,224 @@ func (c *Controller) filterJSONPathBytes(query string) ([]byte, error) {
 	return b, nil
 }
 
-func (c *Controller) iterateBytes(ctx context.Context) <-chan []byte {
-	return c.storage.iterateBytes(ctx)
+func (c *Controller) iterateBytes(ctx context.Context, filter *Filter, projection *Projection) <-chan []byte {
+	if filter.IsEmpty() && projection == nil {
+		return c.storage.iterateBytes(ctx)
+	}
+
+	bytesCh := make(chan []byte)
+	go func() {
+		defer close(bytesCh)
+
+		for td := range c.iterate(ctx, filter) {
+			b, err := json.Marshal(projection.apply(td))
+			if err != nil {
+				log.Printf("Error serializing TD: %s", err)
+				continue
+			}
+			select {
+			case bytesCh <- b:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return bytesCh
+}
+
+// iterate returns the TDs matching the filter until the context is canceled
+func (c *Controller) iterate(ctx context.Context, filter *Filter) <-chan ThingDescription {
+	tdCh := make(chan ThingDescription)
+
+	go func() {
+		defer close(tdCh)
+
+		storageCh := c.storage.iterateBytes(ctx)
+		// drain the storage iterator to let it release its resources
+		defer func() {
+			for range storageCh {
+			}
+		}()
+
+		for b := range storageCh {
+			var td ThingDescription
+			err := json.Unmarshal(b, &td)
+			if err != nil {
+				log.Printf("Error deserializing TD: %s", err)
+				continue
+			}
+			if !filter.Match(td) {
+				continue
+			}
+			select {
+			case tdCh <- td:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return tdCh
+}
+
+func (c *Controller) facets(fields []string, jsonPathQuery string, filter *Filter) (*FacetResult, error) {
+	err := validateFacetFields(fields)
+	if err != nil {
+		return nil, err
+	}
+	result := newFacetResult(fields)
+
+	if jsonPathQuery == "" {
+		for td := range c.iterate(context.Background(), filter) {
+			result.count(td)
+		}
+		return result, nil
+	}
+
+	// pre-filter with jsonpath
+	b, err := c.filterJSONPathBytes(jsonPathQuery)
+	if err != nil {
+		return nil, err
+	}
+	var items []interface{}
+	err = json.Unmarshal(b, &items)
+	if err != nil {
+		return nil, &BadRequestError{fmt.Sprintf("jsonpath query did not select a list of TDs: %s", err)}
+	}
+	for _, item := range items {
+		if td, ok := item.(map[string]interface{}); ok && filter.Match(td) {
+			result.count(td)
+		}
+	}
+	return result, nil
+}
+
+func (c *Controller) searchText(query, lang string, offset, limit int) (*TextSearchResult, error) {
+	if query == "" {
+		return nil, &BadRequestError{"query must not be empty"}
+	}
+	if offset < 0 || limit < 0 {
+		return nil, &BadRequestError{"offset and limit must not be negative"}
+	}
+	if limit > MaxLimit {
+		return nil, &BadRequestError{fmt.Sprintf("limit must not be larger than %d", MaxLimit)}
+	}
+
+	res, err := c.textIndex.search(query, lang, offset, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error searching text index: %s", err)
+	}
+
+	result := TextSearchResult{
+		Total: res.Total,
+		Hits:  make([]TextSearchHit, 0, len(res.Hits)),
+	}
+	for _, hit := range res.Hits {
+		td, err := c.storage.get(hit.ID)
+		if err != nil {
+			if _, ok := err.(*NotFoundError); ok {
+				// removed after the search
+				continue
+			}
+			return nil, err
+		}
+		result.Hits = append(result.Hits, TextSearchHit{
+			ID:         hit.ID,
+			Score:      hit.Score,
+			Highlights: hit.Fragments,
+			TD:         td,
+		})
+	}
+
+	return &result, nil
+}
+
+func (c *Controller) searchGeo(q GeoQuery, offset, limit int) (*GeoSearchResult, error) {
+	if offset < 0 || limit < 0 {
+		return nil, &BadRequestError{"offset and limit must not be negative"}
+	}
+	if limit > MaxLimit {
+		return nil, &BadRequestError{fmt.Sprintf("limit must not be larger than %d", MaxLimit)}
+	}
+
+	total, hits, err := c.geoIndex.search(q, offset, limit)
+	if err != nil {
+		if _, ok := err.(*BadRequestError); ok {
+			return nil, err
+		}
+		return nil, fmt.Errorf("error searching geo index: %s", err)
+	}
+
+	result := GeoSearchResult{
+		Total: total,
+		Hits:  make([]GeoSearchHit, 0, len(hits)),
+	}
+	for _, hit := range hits {
+		hit.TD, err = c.storage.get(hit.ID)
+		if err != nil {
+			if _, ok := err.(*NotFoundError); ok {
+				// removed after the search
+				continue
+			}
+			return nil, err
+		}
+		result.Hits = append(result.Hits, hit)
+	}
+
+	return &result, nil
+}
+
+func (c *Controller) searchCapability(q CapabilityQuery, offset, limit int) (*CapabilitySearchResult, error) {
+	if offset < 0 || limit < 0 {
+		return nil, &BadRequestError{"offset and limit must not be negative"}
+	}
+	if limit > MaxLimit {
+		return nil, &BadRequestError{fmt.Sprintf("limit must not be larger than %d", MaxLimit)}
+	}
+	err := q.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	result := CapabilitySearchResult{
+		Hits: []CapabilitySearchHit{},
+	}
+	for td := range c.iterate(ctx, nil) {
+		hit, matched := q.match(td)
+		if !matched {
+			continue
+		}
+		if result.Total >= offset && len(result.Hits) < limit {
+			hit.ID, _ = td[wot.KeyThingID].(string)
+			hit.TD = td
+			result.Hits = append(result.Hits, hit)
+		}
+		result.Total++
+	}
+
+	return &result, nil
+}
+
+// index updates the indexes after a TD is written to storage, in the same section under the write lock
+func (c *Controller) index(id string, td ThingDescription) {
+	for _, index := range c.indexes {
+		err := index.index(id, td)
+		if err != nil {
+			log.Printf("Error indexing %s: %s", id, err)
+		}
+	}
+}
+
+// unindex updates the indexes after a TD is removed from storage, in the same section under the write lock
+func (c *Controller) unindex(id string) {
+	for _, index := range c.indexes {
+		err := index.remove(id)
+		if err != nil {
+			log.Printf("Error removing %s from index: %s", id, err)
+		}
+	}
 }
 
 // UTILITY FUNCTIONS
@@ -344,39 +737,209 @@ func getObjectFromXPathNode(n *xpath.Node) interface{} {
 	}
 }
 
+// cleanExpired sends the expiry warnings and removes the expired registrations
+// The registrations are checked when they are due, as scheduled on every write, and all of them at the cleanup interval.
 func (c *Controller) cleanExpired() {
 	defer func() {
 		if r := recover(); r != nil {
 			log.Printf("panic: %v\n%s\n", r, debug.Stack())
 			go c.cleanExpired()
+			return
 		}
+		close(c.cleanerDone)
 	}()
 
-	for t := range time.Tick(controllerExpiryCleanupInterval) {
-		var expiredServices []ThingDescription
+	var checks expiryChecks
+	// expiry times of the registrations that were warned about, to warn once per expiry
+	warned := make(map[string]time.Time)
+	// check all registrations on start, e.g. those that expired while stopped
+	nextScan := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		next := nextScan
+		if len(checks) > 0 && checks[0].due.Before(next) {
+			next = checks[0].due
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(time.Until(next))
+
+		select {
+		case <-timer.C:
+		case <-c.cleanerWake:
+			c.Lock()
+			for _, check := range c.scheduledChecks {
+				heap.Push(&checks, check)
+			}
+			c.scheduledChecks = nil
+			c.Unlock()
+			continue
+		case <-c.dispatcherQuit:
+			return
+		}
 
-		for td := range c.storage.iterate() {
-			if expires := ThingExpires(ThingRegistration(td)); expires != nil {
-				if t.After(*expires) {
-					expiredServices = append(expiredServices, td)
-				}
+		t := time.Now()
+		if !t.Before(nextScan) {
+			checks, warned = c.scanExpired(t, warned)
+			nextScan = t.Add(c.cleanupInterval)
+			continue
+		}
+		for len(checks) > 0 && !checks[0].due.After(t) {
+			check := heap.Pop(&checks).(expiryCheck)
+			if next, ok := c.checkExpiry(t, check, warned); ok {
+				heap.Push(&checks, next)
 			}
 		}
+	}
+}
 
-		for i := range expiredServices {
-			id := expiredServices[i][wot.KeyThingID].(string)
-			log.Printf("cleanExpired() Removing expired registration: %s", id)
-			err := c.storage.delete(id)
-			if err != nil {
-				log.Printf("cleanExpired() Error removing expired registration: %s: %s", id, err)
-				continue
+// scanExpired checks all registrations and returns the checks of those that expire later
+func (c *Controller) scanExpired(t time.Time, warned map[string]time.Time) (expiryChecks, map[string]time.Time) {
+	var (
+		expiredServices []ThingDescription
+		checks          expiryChecks
+	)
+	expiring := make(map[string]time.Time)
+
+	for td := range c.storage.iterate() {
+		if expires := ThingExpires(ThingRegistration(td)); expires != nil {
+			id := td[wot.KeyThingID].(string)
+			if t.After(*expires) {
+				expiredServices = append(expiredServices, td)
+			} else if c.expiryWarning > 0 && expires.Sub(t) <= c.expiryWarning {
+				expiring[id] = *expires
+				checks = append(checks, expiryCheck{due: *expires, id: id, expires: *expires})
+			} else {
+				checks = append(checks, c.newExpiryCheck(id, *expires))
 			}
 		}
 	}
+	heap.Init(&checks)
+
+	for id, expires := range expiring {
+		if warned[id].Equal(expires) {
+			continue
+		}
+		err := c.storage.expiring(id, expires)
+		if err != nil {
+			log.Printf("cleanExpired() Error adding expiring event: %s: %s", id, err)
+			delete(expiring, id)
+			continue
+		}
+		c.wakeDispatchers()
+	}
+
+	for i := range expiredServices {
+		id := expiredServices[i][wot.KeyThingID].(string)
+		log.Printf("cleanExpired() Removing expired registration: %s", id)
+		err := c.delete(id)
+		if err != nil {
+			log.Printf("cleanExpired() Error removing expired registration: %s: %s", id, err)
+		}
+	}
+	return checks, expiring
+}
+
+// checkExpiry sends the warning or removes the registration of a due check
+// It returns the check of the removal after the warning. Checks of registrations that changed since are skipped.
+func (c *Controller) checkExpiry(t time.Time, check expiryCheck, warned map[string]time.Time) (expiryCheck, bool) {
+	td, err := c.storage.get(check.id)
+	if err != nil {
+		if _, ok := err.(*NotFoundError); !ok {
+			log.Printf("cleanExpired() Error getting registration: %s: %s", check.id, err)
+		}
+		return check, false
+	}
+	expires := ThingExpires(ThingRegistration(td))
+	if expires == nil || !expires.Equal(check.expires) {
+		// checked as scheduled by the change
+		return check, false
+	}
+
+	if !expires.After(t) {
+		log.Printf("cleanExpired() Removing expired registration: %s", check.id)
+		err := c.delete(check.id)
+		if err != nil {
+			log.Printf("cleanExpired() Error removing expired registration: %s: %s", check.id, err)
+		}
+		delete(warned, check.id)
+		return check, false
+	}
+
+	if c.expiryWarning > 0 && expires.Sub(t) <= c.expiryWarning && !warned[check.id].Equal(*expires) {
+		err := c.storage.expiring(check.id, *expires)
+		if err != nil {
+			log.Printf("cleanExpired() Error adding expiring event: %s: %s", check.id, err)
+		} else {
+			warned[check.id] = *expires
+			c.wakeDispatchers()
+		}
+	}
+	return expiryCheck{due: *expires, id: check.id, expires: *expires}, true
+}
+
+// scheduleExpiry schedules the check of a stored registration, if it expires
+func (c *Controller) scheduleExpiry(id string, expires *time.Time) {
+	if expires == nil {
+		return
+	}
+	c.Lock()
+	c.scheduledChecks = append(c.scheduledChecks, c.newExpiryCheck(id, *expires))
+	c.Unlock()
+	select {
+	case c.cleanerWake <- struct{}{}:
+	default:
+		// already awake
+	}
+}
+
+// newExpiryCheck returns the check of a registration at the time of the warning, or at the expiry without warnings
+func (c *Controller) newExpiryCheck(id string, expires time.Time) expiryCheck {
+	due := expires
+	if c.expiryWarning > 0 {
+		due = expires.Add(-c.expiryWarning)
+	}
+	return expiryCheck{due: due, id: id, expires: expires}
+}
+
+// expiryCheck is a scheduled check of a registration that expires
+type expiryCheck struct {
+	due     time.Time
+	id      string
+	expires time.Time
+}
+
+// expiryChecks is a min-heap of the checks by due time
+type expiryChecks []expiryCheck
+
+func (h expiryChecks) Len() int            { return len(h) }
+func (h expiryChecks) Less(i, j int) bool  { return h[i].due.Before(h[j].due) }
+func (h expiryChecks) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *expiryChecks) Push(x interface{}) { *h = append(*h, x.(expiryCheck)) }
+func (h *expiryChecks) Pop() interface{} {
+	old := *h
+	check := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return check
 }
 
 // Stop the controller
 func (c *Controller) Stop() {
+	close(c.dispatcherQuit)
+	c.dispatchers.Wait()
+	<-c.cleanerDone
+
+	for _, index := range c.indexes {
+		err := index.close()
+		if err != nil {
+			log.Printf("Error closing index: %s", err)
+		}
+	}
 	//log.Println("Stopped the controller.")
 }
 
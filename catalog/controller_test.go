@@ -1,12 +1,15 @@
 package catalog
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -14,6 +17,10 @@ import (
 )
 
 func setup(t *testing.T) CatalogController {
+	return setupWithExpiry(t, 0, controllerExpiryCleanupInterval)
+}
+
+func setupWithExpiry(t *testing.T, expiryWarning, cleanupInterval time.Duration) CatalogController {
 	var (
 		storage Storage
 		tempDir = fmt.Sprintf("%s/thing-directory/test-%s-ldb",
@@ -33,7 +40,7 @@ func setup(t *testing.T) CatalogController {
 		}
 	}
 
-	controller, err := NewController(storage)
+	controller, err := newController(storage, DefaultGeoLocations, expiryWarning, cleanupInterval)
 	if err != nil {
 		storage.Close()
 		t.Fatalf("error creating controller: %s", err)
@@ -162,6 +169,28 @@ func TestControllerGet(t *testing.T) {
 		}
 	})
 
+	t.Run("retrieve many", func(t *testing.T) {
+		tds, err := controller.getMany([]string{id, "some_id"})
+		if err != nil {
+			t.Fatalf("Error retrieving: %s", err)
+		}
+		if len(tds) != 1 {
+			t.Fatalf("Expected 1 TD, got %d", len(tds))
+		}
+		if tds[id]["title"] != td["title"] {
+			t.Fatalf("Expected TD with title %s, got %v", td["title"], tds[id]["title"])
+		}
+		if _, found := tds["some_id"]; found {
+			t.Fatalf("Non-existed TD was returned")
+		}
+	})
+
+	t.Run("retrieve too many", func(t *testing.T) {
+		_, err := controller.getMany(make([]string, MaxBatchSize+1))
+		if _, ok := err.(*BadRequestError); !ok {
+			t.Fatalf("Expected BadRequestError but got %v", err)
+		}
+	})
 }
 
 func TestControllerUpdate(t *testing.T) {
@@ -209,6 +238,54 @@ func TestControllerUpdate(t *testing.T) {
 	})
 }
 
+func TestControllerConcurrentUpdates(t *testing.T) {
+	controller := setup(t)
+
+	newTD := func(title string) ThingDescription {
+		return ThingDescription{
+			"@context": "https://www.w3.org/2019/wot/td/v1",
+			"id":       "urn:example:test/thing1",
+			"title":    title,
+			"security": []string{"nosec_sc"},
+			"securityDefinitions": map[string]any{
+				"nosec_sc": map[string]string{
+					"scheme": "nosec",
+				},
+			},
+		}
+	}
+	id, err := controller.add(newTD("initial"))
+	if err != nil {
+		t.Fatalf("Unexpected error on add: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := controller.update(id, newTD(fmt.Sprintf("title%d", i)))
+			if err != nil {
+				t.Errorf("Error updating TD: %s", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// the index has the stored TD
+	storedTD, err := controller.get(id)
+	if err != nil {
+		t.Fatal("Error retrieving TD:", err.Error())
+	}
+	result, err := controller.searchText(storedTD["title"].(string), "", 0, 10)
+	if err != nil {
+		t.Fatal("Error searching:", err.Error())
+	}
+	if len(result.Hits) != 1 || result.Hits[0].ID != id {
+		t.Fatalf("Expected the TD with title %s in the index, got: %v", storedTD["title"], result.Hits)
+	}
+}
+
 func TestControllerDelete(t *testing.T) {
 	controller := setup(t)
 
@@ -300,20 +377,22 @@ func TestControllerListPaginate(t *testing.T) {
 	var list []ThingDescription
 
 	// [0-3)
-	TDs, err := controller.listPaginate(0, 3)
+	page, err := controller.listPaginate(Pagination{Offset: 0, Limit: 3}, nil, nil)
 	if err != nil {
 		t.Fatal("Error getting list of TDs:", err.Error())
 	}
+	TDs := page.Items
 	if len(TDs) != 3 {
 		t.Fatalf("Page has %d entries instead of 3", len(TDs))
 	}
 	list = append(list, TDs...)
 
 	// [3-end)
-	TDs, err = controller.listPaginate(3, 10)
+	page, err = controller.listPaginate(Pagination{Offset: 3, Limit: 10}, nil, nil)
 	if err != nil {
 		t.Fatal("Error getting list of TDs:", err.Error())
 	}
+	TDs = page.Items
 	if len(TDs) != 2 {
 		t.Fatalf("Page has %d entries instead of 2", len(TDs))
 	}
@@ -411,11 +490,10 @@ func TestControllerFilter(t *testing.T) {
 
 func TestControllerCleanExpired(t *testing.T) {
 
-	// shorten controller's cleanup interval to test quickly
-	controllerExpiryCleanupInterval = 1 * time.Second
 	const wait = 3 * time.Second
 
-	controller := setup(t)
+	// shorten controller's cleanup interval to test quickly
+	controller := setupWithExpiry(t, 0, time.Second)
 
 	var td = ThingDescription{
 		"@context": "https://www.w3.org/2019/wot/td/v1",
@@ -452,3 +530,1175 @@ func TestControllerCleanExpired(t *testing.T) {
 		t.Fatalf("Expired TD was not removed")
 	}
 }
+
+func TestControllerExpiring(t *testing.T) {
+	controller := setupWithExpiry(t, time.Second, 100*time.Millisecond)
+	listener := &recorder{}
+	controller.AddSubscriber(listener)
+
+	td := func(id string, ttl float64) ThingDescription {
+		return ThingDescription{
+			"@context": "https://www.w3.org/2019/wot/td/v1",
+			"id":       id,
+			"title":    "example thing",
+			"security": []string{"nosec_sc"},
+			"securityDefinitions": map[string]any{
+				"nosec_sc": map[string]string{"scheme": "nosec"},
+			},
+			"registration": map[string]any{"ttl": ttl},
+		}
+	}
+	for _, td := range []ThingDescription{td("urn:example:expiring", 1.5), td("urn:example:renewed", 1.5), td("urn:example:lasting", 60)} {
+		_, err := controller.add(td)
+		if err != nil {
+			t.Fatalf("Error adding a TD: %s", err)
+		}
+	}
+
+	// warned once per expiry, and again after renewal
+	time.Sleep(time.Second)
+	err := controller.update("urn:example:renewed", td("urn:example:renewed", 1.5))
+	if err != nil {
+		t.Fatalf("Error updating a TD: %s", err)
+	}
+
+	listener.wait(t, 9)
+	// no more events
+	time.Sleep(200 * time.Millisecond)
+	expected := []string{
+		"created urn:example:expiring",
+		"created urn:example:renewed",
+		"created urn:example:lasting",
+		"expiring urn:example:expiring",
+		"expiring urn:example:renewed",
+		"updated urn:example:renewed: example thing -> example thing",
+		"deleted urn:example:expiring",
+		"expiring urn:example:renewed",
+		"deleted urn:example:renewed",
+	}
+	listener.Lock()
+	events := listener.events
+	listener.Unlock()
+	sorted := func(events []string) []string {
+		// the order of the events of different TDs within one cleanup is not defined
+		s := append([]string(nil), events...)
+		id := func(event string) string { return strings.TrimSuffix(strings.Fields(event)[1], ":") }
+		sort.SliceStable(s, func(i, j int) bool { return id(s[i]) < id(s[j]) })
+		return s
+	}
+	if !reflect.DeepEqual(sorted(events), sorted(expected)) {
+		t.Fatalf("Expected events:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(events, "\n"))
+	}
+}
+
+func TestControllerExpiringScheduled(t *testing.T) {
+	// the warning and the expiry are due before the next check of all registrations
+	controller := setupWithExpiry(t, 300*time.Millisecond, time.Minute)
+	listener := &recorder{}
+	controller.AddSubscriber(listener)
+
+	start := time.Now()
+	_, err := controller.add(ThingDescription{
+		"@context": "https://www.w3.org/2019/wot/td/v1",
+		"id":       "urn:example:expiring",
+		"title":    "example thing",
+		"security": []string{"nosec_sc"},
+		"securityDefinitions": map[string]any{
+			"nosec_sc": map[string]string{"scheme": "nosec"},
+		},
+		"registration": map[string]any{"ttl": 0.5},
+	})
+	if err != nil {
+		t.Fatalf("Error adding a TD: %s", err)
+	}
+
+	events := listener.wait(t, 3)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Expected the events within the TTL, got them after %s", elapsed)
+	}
+	expected := []string{
+		"created urn:example:expiring",
+		"expiring urn:example:expiring",
+		"deleted urn:example:expiring",
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatalf("Expected events %v, got %v", expected, events)
+	}
+}
+
+func TestControllerExpired(t *testing.T) {
+	controller := setupWithExpiry(t, 300*time.Millisecond, 100*time.Millisecond)
+	listener := &recorder{}
+	controller.AddSubscriber(listener)
+
+	_, err := controller.add(ThingDescription{
+		"@context": "https://www.w3.org/2019/wot/td/v1",
+		"id":       "urn:example:expiring",
+		"title":    "Boiler thermometer",
+		"geo:lat":  52.52,
+		"geo:long": 13.405,
+		"security": []string{"nosec_sc"},
+		"securityDefinitions": map[string]any{
+			"nosec_sc": map[string]string{"scheme": "nosec"},
+		},
+		"registration": map[string]any{"ttl": 0.5},
+	})
+	if err != nil {
+		t.Fatalf("Error adding a TD: %s", err)
+	}
+
+	search := func() (textHits, geoHits int) {
+		text, err := controller.searchText("thermometer", "", 0, 10)
+		if err != nil {
+			t.Fatalf("Error searching text: %s", err)
+		}
+		geo, err := controller.searchGeo(GeoQuery{
+			Center: &GeoPoint{Latitude: 52.52, Longitude: 13.405},
+			Radius: "50m",
+		}, 0, 10)
+		if err != nil {
+			t.Fatalf("Error searching geo: %s", err)
+		}
+		return len(text.Hits), len(geo.Hits)
+	}
+	if textHits, geoHits := search(); textHits != 1 || geoHits != 1 {
+		t.Fatalf("Expected the TD in the text and geo results, got %d and %d hits", textHits, geoHits)
+	}
+
+	events := listener.wait(t, 3)
+	expected := []string{
+		"created urn:example:expiring",
+		"expiring urn:example:expiring",
+		"deleted urn:example:expiring",
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatalf("Expected events %v, got %v", expected, events)
+	}
+	if textHits, geoHits := search(); textHits != 0 || geoHits != 0 {
+		t.Fatalf("Expected the expired TD to be removed from the text and geo results, got %d and %d hits", textHits, geoHits)
+	}
+	_, err = controller.get("urn:example:expiring")
+	if _, ok := err.(*NotFoundError); !ok {
+		t.Fatalf("Expected the expired TD to be removed, got: %v", err)
+	}
+}
+
+func TestControllerSearchText(t *testing.T) {
+	controller := setup(t)
+
+	tds := []ThingDescription{
+		{
+			"@context": "https://www.w3.org/2019/wot/td/v1",
+			"id":       "urn:example:test/boiler",
+			"title":    "Boiler room 3 thermometer",
+			"security": []string{"basic_sc"},
+			"securityDefinitions": map[string]any{
+				"basic_sc": map[string]string{
+					"in":     "header",
+					"scheme": "basic",
+				},
+			},
+		},
+		{
+			"@context": "https://www.w3.org/2019/wot/td/v1",
+			"id":       "urn:example:test/lamp",
+			"title":    "Kitchen lamp",
+			"titles": map[string]any{
+				"de": "Küchenlampen",
+			},
+			"description": "Ceiling light",
+			"properties": map[string]any{
+				"brightness": map[string]any{
+					"description": "Dimming level",
+					"forms":       []any{map[string]any{"href": "http://example.com/brightness"}},
+				},
+			},
+			"security": []string{"basic_sc"},
+			"securityDefinitions": map[string]any{
+				"basic_sc": map[string]string{
+					"in":     "header",
+					"scheme": "basic",
+				},
+			},
+		},
+	}
+	for _, td := range tds {
+		_, err := controller.add(td)
+		if err != nil {
+			t.Fatal("Error adding a TD:", err.Error())
+		}
+	}
+
+	t.Run("title", func(t *testing.T) {
+		result, err := controller.searchText("boiler room 3", "", 0, 10)
+		if err != nil {
+			t.Fatal("Error searching:", err.Error())
+		}
+		if len(result.Hits) != 1 || result.Hits[0].ID != "urn:example:test/boiler" {
+			t.Fatalf("Expected only the boiler but got: %v", result.Hits)
+		}
+		if len(result.Hits[0].Highlights["title"]) == 0 {
+			t.Fatalf("No highlights for title: %v", result.Hits[0].Highlights)
+		}
+	})
+
+	t.Run("affordance name", func(t *testing.T) {
+		result, err := controller.searchText("brightness", "", 0, 10)
+		if err != nil {
+			t.Fatal("Error searching:", err.Error())
+		}
+		if len(result.Hits) != 1 || result.Hits[0].ID != "urn:example:test/lamp" {
+			t.Fatalf("Expected only the lamp but got: %v", result.Hits)
+		}
+	})
+
+	t.Run("language-specific", func(t *testing.T) {
+		// stemmed by the German analyzer
+		result, err := controller.searchText("Küchenlampe", "de", 0, 10)
+		if err != nil {
+			t.Fatal("Error searching:", err.Error())
+		}
+		if len(result.Hits) != 1 || result.Hits[0].ID != "urn:example:test/lamp" {
+			t.Fatalf("Expected only the lamp but got: %v", result.Hits)
+		}
+	})
+
+	t.Run("deleted", func(t *testing.T) {
+		err := controller.delete("urn:example:test/boiler")
+		if err != nil {
+			t.Fatal("Error deleting:", err.Error())
+		}
+		result, err := controller.searchText("boiler", "", 0, 10)
+		if err != nil {
+			t.Fatal("Error searching:", err.Error())
+		}
+		if result.Total != 0 {
+			t.Fatalf("Deleted TD is still found: %v", result.Hits)
+		}
+	})
+}
+
+func TestControllerListFilter(t *testing.T) {
+	controller := setup(t)
+
+	for i := 0; i < 5; i++ {
+		var td = map[string]any{
+			"@context": "https://www.w3.org/2019/wot/td/v1",
+			"id":       "urn:example:test/thing_" + strconv.Itoa(i),
+			"title":    "example thing",
+			"security": []string{"basic_sc"},
+			"securityDefinitions": map[string]any{
+				"basic_sc": map[string]string{
+					"in":     "header",
+					"scheme": "basic",
+				},
+			},
+		}
+		if i%2 == 0 {
+			td["@type"] = []string{"saref:Sensor", "saref:Device"}
+			td["title"] = "Temperature sensor"
+			td["base"] = "coap://example.com"
+			td["properties"] = map[string]any{
+				"temperature": map[string]any{
+					"forms": []any{map[string]any{"href": "/temp"}},
+				},
+			}
+			td["securityDefinitions"] = map[string]any{
+				"bearer_sc": map[string]string{
+					"in":     "header",
+					"scheme": "bearer",
+				},
+			}
+			td["security"] = []string{"bearer_sc"}
+		}
+
+		_, err := controller.add(td)
+		if err != nil {
+			t.Fatal("Error adding a TD:", err.Error())
+		}
+	}
+
+	tests := map[string]Filter{
+		"type":     {Type: "saref:Sensor"},
+		"title":    {Title: "SENSOR"},
+		"property": {Property: "temperature"},
+		"protocol": {Protocol: "coap"},
+		"security": {Security: "bearer"},
+		"combined": {Type: "saref:Sensor", Protocol: "coap", Security: "bearer"},
+	}
+	for name, filter := range tests {
+		filter := filter
+		t.Run(name, func(t *testing.T) {
+			page, err := controller.listPaginate(Pagination{Limit: 10}, &filter, nil)
+			if err != nil {
+				t.Fatal("Error getting list of TDs:", err.Error())
+			}
+			TDs := page.Items
+			if len(TDs) != 3 {
+				t.Fatalf("Filter matched %d instead of 3 TDs: %v", len(TDs), TDs)
+			}
+
+			// paginated
+			page, err = controller.listPaginate(Pagination{Offset: 2, Limit: 10}, &filter, nil)
+			if err != nil {
+				t.Fatal("Error getting list of TDs:", err.Error())
+			}
+			TDs = page.Items
+			if len(TDs) != 1 || TDs[0]["id"] != "urn:example:test/thing_4" {
+				t.Fatalf("Expected thing_4 on the second page but got: %v", TDs)
+			}
+		})
+	}
+
+	t.Run("modifiedSince", func(t *testing.T) {
+		since := time.Now().UTC()
+		td, err := controller.get("urn:example:test/thing_1")
+		if err != nil {
+			t.Fatal("Error retrieving TD:", err.Error())
+		}
+		err = controller.update("urn:example:test/thing_1", td)
+		if err != nil {
+			t.Fatal("Error updating TD:", err.Error())
+		}
+
+		page, err := controller.listPaginate(Pagination{Limit: 10}, &Filter{ModifiedSince: &since}, nil)
+		if err != nil {
+			t.Fatal("Error getting list of TDs:", err.Error())
+		}
+		TDs := page.Items
+		if len(TDs) != 1 || TDs[0]["id"] != "urn:example:test/thing_1" {
+			t.Fatalf("Expected only thing_1 but got: %v", TDs)
+		}
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		var count int
+		for b := range controller.iterateBytes(context.Background(), &Filter{Protocol: "coap"}, nil) {
+			var td ThingDescription
+			err := json.Unmarshal(b, &td)
+			if err != nil {
+				t.Fatal("Error unmarshalling streamed TD:", err.Error())
+			}
+			count++
+		}
+		if count != 3 {
+			t.Fatalf("Streamed %d instead of 3 TDs", count)
+		}
+	})
+
+	t.Run("stream partial TDs", func(t *testing.T) {
+		projection, err := NewProjection([]string{"title"})
+		if err != nil {
+			t.Fatal("Error creating projection:", err.Error())
+		}
+		var count int
+		for b := range controller.iterateBytes(context.Background(), nil, projection) {
+			var td ThingDescription
+			err := json.Unmarshal(b, &td)
+			if err != nil {
+				t.Fatal("Error unmarshalling streamed TD:", err.Error())
+			}
+			if len(td) != 2 || td["id"] == nil || td["title"] == nil {
+				t.Fatalf("Expected only id and title but got: %v", td)
+			}
+			count++
+		}
+		if count != 5 {
+			t.Fatalf("Streamed %d instead of 5 TDs", count)
+		}
+	})
+}
+
+func TestControllerListSort(t *testing.T) {
+	controller := setup(t)
+
+	titles := []string{"delta", "alpha", "charlie", "bravo", "alpha"}
+	for i, title := range titles {
+		var td = map[string]any{
+			"@context": "https://www.w3.org/2019/wot/td/v1",
+			"id":       "urn:example:test/thing_" + strconv.Itoa(i),
+			"title":    title,
+			"security": []string{"basic_sc"},
+			"securityDefinitions": map[string]any{
+				"basic_sc": map[string]string{
+					"in":     "header",
+					"scheme": "basic",
+				},
+			},
+		}
+		if i%2 == 0 {
+			td["registration"] = map[string]any{"ttl": float64(100 - i)}
+		}
+
+		_, err := controller.add(td)
+		if err != nil {
+			t.Fatal("Error adding a TD:", err.Error())
+		}
+		// distinct creation times
+		time.Sleep(time.Millisecond)
+	}
+
+	listIDs := func(t *testing.T, field, order string) []string {
+		sorting, err := NewSorting(field, order)
+		if err != nil {
+			t.Fatal("Error creating sorting:", err.Error())
+		}
+		var ids []string
+		// paginate with 2 entries per page
+		for offset := 0; offset < len(titles); offset += 2 {
+			page, err := controller.listPaginate(Pagination{Offset: offset, Limit: 2}, nil, sorting)
+			if err != nil {
+				t.Fatal("Error getting list of TDs:", err.Error())
+			}
+			for _, td := range page.Items {
+				ids = append(ids, strings.TrimPrefix(td["id"].(string), "urn:example:test/thing_"))
+			}
+		}
+		return ids
+	}
+
+	tests := []struct {
+		field, order string
+		expected     []string
+	}{
+		{SortByID, SortOrderDesc, []string{"4", "3", "2", "1", "0"}},
+		{SortByTitle, SortOrderAsc, []string{"1", "4", "3", "2", "0"}},
+		{SortByTitle, SortOrderDesc, []string{"0", "2", "3", "4", "1"}},
+		{SortByCreated, SortOrderDesc, []string{"4", "3", "2", "1", "0"}},
+		// TDs without expiry come last
+		{SortByExpires, SortOrderAsc, []string{"4", "2", "0", "1", "3"}},
+	}
+	for _, test := range tests {
+		t.Run(test.field+" "+test.order, func(t *testing.T) {
+			ids := listIDs(t, test.field, test.order)
+			if !reflect.DeepEqual(ids, test.expected) {
+				t.Fatalf("Expected order %v but got %v", test.expected, ids)
+			}
+		})
+	}
+
+	t.Run("updated and deleted", func(t *testing.T) {
+		td, err := controller.get("urn:example:test/thing_0")
+		if err != nil {
+			t.Fatal("Error retrieving TD:", err.Error())
+		}
+		err = controller.update("urn:example:test/thing_0", td)
+		if err != nil {
+			t.Fatal("Error updating TD:", err.Error())
+		}
+		err = controller.delete("urn:example:test/thing_4")
+		if err != nil {
+			t.Fatal("Error deleting TD:", err.Error())
+		}
+		titles = titles[:4]
+
+		ids := listIDs(t, SortByModified, SortOrderAsc)
+		if expected := []string{"1", "2", "3", "0"}; !reflect.DeepEqual(ids, expected) {
+			t.Fatalf("Expected order %v but got %v", expected, ids)
+		}
+		// the update renewed the expiry of thing_0
+		ids = listIDs(t, SortByExpires, SortOrderAsc)
+		if expected := []string{"2", "0", "1", "3"}; !reflect.DeepEqual(ids, expected) {
+			t.Fatalf("Expected order %v but got %v", expected, ids)
+		}
+	})
+
+	t.Run("invalid field", func(t *testing.T) {
+		_, err := NewSorting("properties", "")
+		if _, ok := err.(*BadRequestError); !ok {
+			t.Fatalf("Expected BadRequestError but got: %v", err)
+		}
+	})
+}
+
+func TestControllerListCursor(t *testing.T) {
+	controller := setup(t)
+
+	for i := 0; i < 7; i++ {
+		var td = map[string]any{
+			"@context": "https://www.w3.org/2019/wot/td/v1",
+			"id":       "urn:example:test/thing_" + strconv.Itoa(i),
+			"title":    "example thing " + strconv.Itoa(6-i),
+			"security": []string{"basic_sc"},
+			"securityDefinitions": map[string]any{
+				"basic_sc": map[string]string{
+					"in":     "header",
+					"scheme": "basic",
+				},
+			},
+		}
+		if i%2 == 0 {
+			td["@type"] = "saref:Sensor"
+		}
+
+		_, err := controller.add(td)
+		if err != nil {
+			t.Fatal("Error adding a TD:", err.Error())
+		}
+	}
+
+	listAll := func(t *testing.T, filter *Filter, sorting *Sorting) (ids []string, total int) {
+		p := Pagination{Limit: 2}
+		for {
+			page, err := controller.listPaginate(p, filter, sorting)
+			if err != nil {
+				t.Fatal("Error getting list of TDs:", err.Error())
+			}
+			total = page.Total
+			for _, td := range page.Items {
+				ids = append(ids, strings.TrimPrefix(td["id"].(string), "urn:example:test/thing_"))
+			}
+			if page.Next == "" {
+				return ids, total
+			}
+			if len(ids) > 7 {
+				t.Fatalf("Pagination does not end: %v", ids)
+			}
+			p.After = page.Next
+		}
+	}
+
+	tests := []struct {
+		name     string
+		filter   *Filter
+		sorting  *Sorting
+		expected []string
+	}{
+		{"storage order", nil, nil, []string{"0", "1", "2", "3", "4", "5", "6"}},
+		{"filtered", &Filter{Type: "saref:Sensor"}, nil, []string{"0", "2", "4", "6"}},
+		{"sorted", nil, &Sorting{Field: SortByTitle}, []string{"6", "5", "4", "3", "2", "1", "0"}},
+		{"filtered and sorted", &Filter{Type: "saref:Sensor"}, &Sorting{Field: SortByID, Descending: true}, []string{"6", "4", "2", "0"}},
+		{"descending ids", nil, &Sorting{Field: SortByID, Descending: true}, []string{"6", "5", "4", "3", "2", "1", "0"}},
+		{"indexed", nil, &Sorting{Field: SortByCreated, Descending: true}, []string{"6", "5", "4", "3", "2", "1", "0"}},
+		{"indexed without values", nil, &Sorting{Field: SortByExpires}, []string{"0", "1", "2", "3", "4", "5", "6"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ids, total := listAll(t, test.filter, test.sorting)
+			if !reflect.DeepEqual(ids, test.expected) {
+				t.Fatalf("Expected %v but got %v", test.expected, ids)
+			}
+			if total != len(test.expected) {
+				t.Fatalf("Expected total of %d but got %d", len(test.expected), total)
+			}
+		})
+	}
+
+	t.Run("deleted last item", func(t *testing.T) {
+		page, err := controller.listPaginate(Pagination{Limit: 2}, nil, nil)
+		if err != nil {
+			t.Fatal("Error getting list of TDs:", err.Error())
+		}
+		err = controller.delete("urn:example:test/thing_1")
+		if err != nil {
+			t.Fatal("Error deleting TD:", err.Error())
+		}
+		page, err = controller.listPaginate(Pagination{Limit: 2, After: page.Next}, nil, nil)
+		if err != nil {
+			t.Fatal("Error getting list of TDs:", err.Error())
+		}
+		if len(page.Items) != 2 || page.Items[0]["id"] != "urn:example:test/thing_2" {
+			t.Fatalf("Expected to continue from thing_2 but got: %v", page.Items)
+		}
+	})
+
+	t.Run("different sorting", func(t *testing.T) {
+		page, err := controller.listPaginate(Pagination{Limit: 2}, nil, nil)
+		if err != nil {
+			t.Fatal("Error getting list of TDs:", err.Error())
+		}
+		_, err = controller.listPaginate(Pagination{Limit: 2, After: page.Next}, nil, &Sorting{Field: SortByTitle})
+		if _, ok := err.(*BadRequestError); !ok {
+			t.Fatalf("Expected BadRequestError but got: %v", err)
+		}
+	})
+
+	t.Run("max limit", func(t *testing.T) {
+		_, err := controller.listPaginate(Pagination{Limit: MaxLimit}, nil, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error with limit=%d: %s", MaxLimit, err)
+		}
+	})
+}
+
+func TestControllerSearchGeo(t *testing.T) {
+	controller := setup(t)
+
+	locations := map[string]map[string]any{
+		// W3C Basic Geo
+		"boiler": {"geo:lat": 52.52, "geo:long": 13.405},
+		// schema.org GeoCoordinates, about 30 m north of the boiler
+		"pump": {"geo": map[string]any{"latitude": "52.52027", "longitude": "13.405"}},
+		// about 1 km east of the boiler
+		"lamp": {"geo:lat": 52.52, "geo:long": 13.42},
+		// no location
+		"switch": {},
+	}
+	for name, location := range locations {
+		var td = map[string]any{
+			"@context": "https://www.w3.org/2019/wot/td/v1",
+			"id":       "urn:example:test/" + name,
+			"title":    name,
+			"security": []string{"basic_sc"},
+			"securityDefinitions": map[string]any{
+				"basic_sc": map[string]string{
+					"in":     "header",
+					"scheme": "basic",
+				},
+			},
+		}
+		for k, v := range location {
+			td[k] = v
+		}
+		_, err := controller.add(td)
+		if err != nil {
+			t.Fatal("Error adding a TD:", err.Error())
+		}
+	}
+
+	ids := func(result *GeoSearchResult) []string {
+		var ids []string
+		for _, hit := range result.Hits {
+			ids = append(ids, strings.TrimPrefix(hit.ID, "urn:example:test/"))
+		}
+		return ids
+	}
+
+	t.Run("radius", func(t *testing.T) {
+		result, err := controller.searchGeo(GeoQuery{
+			Center: &GeoPoint{Latitude: 52.52001, Longitude: 13.405},
+			Radius: "50m",
+		}, 0, 10)
+		if err != nil {
+			t.Fatal("Error searching:", err.Error())
+		}
+		if !reflect.DeepEqual(ids(result), []string{"boiler", "pump"}) {
+			t.Fatalf("Expected boiler and pump ordered by distance but got: %v", ids(result))
+		}
+		if d := *result.Hits[1].Distance; d < 25 || d > 35 {
+			t.Fatalf("Expected the pump at about 30 m but got %f", d)
+		}
+		if result.Hits[0].TD["title"] != "boiler" {
+			t.Fatalf("Expected the TD in the hit but got: %v", result.Hits[0].TD)
+		}
+	})
+
+	t.Run("radius paginated", func(t *testing.T) {
+		result, err := controller.searchGeo(GeoQuery{
+			Center: &GeoPoint{Latitude: 52.52, Longitude: 13.405},
+			Radius: "2km",
+		}, 1, 1)
+		if err != nil {
+			t.Fatal("Error searching:", err.Error())
+		}
+		if result.Total != 3 || !reflect.DeepEqual(ids(result), []string{"pump"}) {
+			t.Fatalf("Expected the pump out of 3 hits but got: %v of %d", ids(result), result.Total)
+		}
+	})
+
+	t.Run("bounding box", func(t *testing.T) {
+		result, err := controller.searchGeo(GeoQuery{
+			TopLeft:     &GeoPoint{Latitude: 52.53, Longitude: 13.41},
+			BottomRight: &GeoPoint{Latitude: 52.51, Longitude: 13.43},
+		}, 0, 10)
+		if err != nil {
+			t.Fatal("Error searching:", err.Error())
+		}
+		if !reflect.DeepEqual(ids(result), []string{"lamp"}) {
+			t.Fatalf("Expected only the lamp but got: %v", ids(result))
+		}
+	})
+
+	t.Run("polygon", func(t *testing.T) {
+		result, err := controller.searchGeo(GeoQuery{
+			Polygon: []GeoPoint{
+				{Latitude: 52.5201, Longitude: 13.40},
+				{Latitude: 52.5201, Longitude: 13.43},
+				{Latitude: 52.51, Longitude: 13.43},
+				{Latitude: 52.51, Longitude: 13.40},
+			},
+		}, 0, 10)
+		if err != nil {
+			t.Fatal("Error searching:", err.Error())
+		}
+		if !reflect.DeepEqual(ids(result), []string{"boiler", "lamp"}) {
+			t.Fatalf("Expected boiler and lamp but got: %v", ids(result))
+		}
+	})
+
+	t.Run("moved", func(t *testing.T) {
+		td, err := controller.get("urn:example:test/pump")
+		if err != nil {
+			t.Fatal("Error retrieving TD:", err.Error())
+		}
+		delete(td, "geo")
+		err = controller.update("urn:example:test/pump", td)
+		if err != nil {
+			t.Fatal("Error updating TD:", err.Error())
+		}
+		result, err := controller.searchGeo(GeoQuery{
+			Center: &GeoPoint{Latitude: 52.52, Longitude: 13.405},
+			Radius: "50m",
+		}, 0, 10)
+		if err != nil {
+			t.Fatal("Error searching:", err.Error())
+		}
+		if !reflect.DeepEqual(ids(result), []string{"boiler"}) {
+			t.Fatalf("Expected only the boiler but got: %v", ids(result))
+		}
+	})
+
+	t.Run("no area", func(t *testing.T) {
+		_, err := controller.searchGeo(GeoQuery{}, 0, 10)
+		if _, ok := err.(*BadRequestError); !ok {
+			t.Fatalf("Expected BadRequestError but got: %v", err)
+		}
+	})
+}
+
+func TestControllerFacets(t *testing.T) {
+	controller := setup(t)
+
+	for i := 0; i < 5; i++ {
+		var td = map[string]any{
+			"@context": "https://www.w3.org/2019/wot/td/v1",
+			"id":       "urn:example:test/thing_" + strconv.Itoa(i),
+			"title":    "example thing",
+			"security": []string{"basic_sc"},
+			"securityDefinitions": map[string]any{
+				"basic_sc": map[string]string{
+					"in":     "header",
+					"scheme": "basic",
+				},
+			},
+			"forms": []any{
+				map[string]any{"href": "http://example.com/all", "op": "readallproperties"},
+			},
+		}
+		if i < 2 {
+			td["@type"] = []string{"saref:Sensor", "saref:Device"}
+			td["title"] = "sensor"
+			td["properties"] = map[string]any{
+				"temperature": map[string]any{
+					"forms": []any{
+						map[string]any{"href": "coap://example.com/temp", "contentType": "application/cbor"},
+						map[string]any{"href": "coap://example.com/temp2", "contentType": "application/cbor"},
+					},
+				},
+			}
+		}
+
+		_, err := controller.add(td)
+		if err != nil {
+			t.Fatal("Error adding a TD:", err.Error())
+		}
+	}
+
+	t.Run("all", func(t *testing.T) {
+		result, err := controller.facets([]string{"@type", FacetProtocol, FacetSecurity, FacetContentType}, "", nil)
+		if err != nil {
+			t.Fatal("Error computing facets:", err.Error())
+		}
+		expected := &FacetResult{
+			Total: 5,
+			Facets: map[string]map[string]int{
+				"@type":          {"saref:Sensor": 2, "saref:Device": 2},
+				FacetProtocol:    {"http": 5, "coap": 2},
+				FacetSecurity:    {"basic": 5},
+				FacetContentType: {"application/json": 5, "application/cbor": 2},
+			},
+		}
+		if !reflect.DeepEqual(result, expected) {
+			t.Fatalf("Expected:\n%v\nbut got:\n%v", expected, result)
+		}
+	})
+
+	t.Run("jsonpath pre-filter", func(t *testing.T) {
+		result, err := controller.facets([]string{"title"}, "$[?(@.title=='sensor')]", nil)
+		if err != nil {
+			t.Fatal("Error computing facets:", err.Error())
+		}
+		if result.Total != 2 || result.Facets["title"]["sensor"] != 2 {
+			t.Fatalf("Expected 2 sensors but got: %v", result)
+		}
+	})
+
+	t.Run("attribute pre-filter", func(t *testing.T) {
+		result, err := controller.facets([]string{FacetProtocol}, "", &Filter{Type: "saref:Sensor"})
+		if err != nil {
+			t.Fatal("Error computing facets:", err.Error())
+		}
+		if result.Total != 2 || result.Facets[FacetProtocol]["http"] != 2 {
+			t.Fatalf("Expected 2 sensors but got: %v", result)
+		}
+	})
+}
+
+func TestControllerSearchCapability(t *testing.T) {
+	controller := setup(t)
+
+	forms := []map[string]any{{"href": "https://example.com/affordance"}}
+	affordances := map[string]map[string]any{
+		"lamp": {
+			"actions": map[string]any{
+				"dim": map[string]any{
+					"input": map[string]any{
+						"type": "object",
+						"properties": map[string]any{
+							"brightness": map[string]any{"type": "integer", "minimum": 0, "maximum": 100},
+						},
+					},
+					"forms": forms,
+				},
+				"toggle": map[string]any{"forms": forms},
+			},
+		},
+		"sensor": {
+			"properties": map[string]any{
+				"temperature": map[string]any{
+					"type": "number", "unit": "Cel", "readOnly": true, "observable": true,
+					"minimum": -40, "maximum": 125, "forms": forms,
+				},
+				"interval": map[string]any{"type": "integer", "unit": "s", "forms": forms},
+			},
+			"events": map[string]any{
+				"overheating": map[string]any{
+					"data":  map[string]any{"type": "number", "unit": "Cel"},
+					"forms": forms,
+				},
+			},
+		},
+		"dimmer": {
+			"actions": map[string]any{
+				"dim": map[string]any{
+					"input": map[string]any{
+						"type": "object",
+						"properties": map[string]any{
+							"brightness": map[string]any{"type": "integer", "minimum": 0, "maximum": 10},
+						},
+					},
+					"forms": forms,
+				},
+			},
+		},
+	}
+	for name, a := range affordances {
+		var td = map[string]any{
+			"@context": "https://www.w3.org/2019/wot/td/v1",
+			"id":       "urn:example:test/" + name,
+			"title":    name,
+			"security": []string{"nosec_sc"},
+			"securityDefinitions": map[string]any{
+				"nosec_sc": map[string]string{
+					"scheme": "nosec",
+				},
+			},
+		}
+		for k, v := range a {
+			td[k] = v
+		}
+		_, err := controller.add(td)
+		if err != nil {
+			t.Fatal("Error adding a TD:", err.Error())
+		}
+	}
+
+	number := func(f float64) *float64 { return &f }
+	boolean := func(b bool) *bool { return &b }
+
+	t.Run("action input", func(t *testing.T) {
+		result, err := controller.searchCapability(CapabilityQuery{
+			Affordance: AffordanceAction,
+			Input: &SchemaQuery{
+				Type: "object",
+				Properties: map[string]*SchemaQuery{
+					"brightness": {Type: "integer", Minimum: number(0), Maximum: number(100)},
+				},
+			},
+		}, 0, 10)
+		if err != nil {
+			t.Fatal("Error searching:", err.Error())
+		}
+		if result.Total != 1 || len(result.Hits) != 1 {
+			t.Fatalf("Expected 1 hit, got %d: %v", result.Total, result.Hits)
+		}
+		hit := result.Hits[0]
+		if hit.ID != "urn:example:test/lamp" || !reflect.DeepEqual(hit.Actions, []string{"dim"}) {
+			t.Fatalf("Expected the dim action of the lamp, got %s %v", hit.ID, hit.Actions)
+		}
+	})
+
+	t.Run("property unit and flags", func(t *testing.T) {
+		result, err := controller.searchCapability(CapabilityQuery{
+			Affordance: AffordanceProperty,
+			WriteOnly:  boolean(false),
+			Observable: boolean(true),
+			Output:     &SchemaQuery{Unit: "Cel"},
+		}, 0, 10)
+		if err != nil {
+			t.Fatal("Error searching:", err.Error())
+		}
+		if result.Total != 1 || !reflect.DeepEqual(result.Hits[0].Properties, []string{"temperature"}) {
+			t.Fatalf("Expected the temperature property, got %v", result.Hits)
+		}
+	})
+
+	t.Run("output range", func(t *testing.T) {
+		// the temperature range is within -50..150, the event data is unbounded
+		result, err := controller.searchCapability(CapabilityQuery{
+			Output: &SchemaQuery{Type: "number", Minimum: number(-50), Maximum: number(150)},
+		}, 0, 10)
+		if err != nil {
+			t.Fatal("Error searching:", err.Error())
+		}
+		if result.Total != 1 {
+			t.Fatalf("Expected 1 hit, got %d: %v", result.Total, result.Hits)
+		}
+		hit := result.Hits[0]
+		if !reflect.DeepEqual(hit.Properties, []string{"temperature"}) || len(hit.Events) != 0 {
+			t.Fatalf("Expected only the temperature property, got %v %v", hit.Properties, hit.Events)
+		}
+	})
+
+	t.Run("event data", func(t *testing.T) {
+		result, err := controller.searchCapability(CapabilityQuery{
+			Affordance: AffordanceEvent,
+			Output:     &SchemaQuery{Type: "number", Unit: "Cel"},
+		}, 0, 10)
+		if err != nil {
+			t.Fatal("Error searching:", err.Error())
+		}
+		if result.Total != 1 || !reflect.DeepEqual(result.Hits[0].Events, []string{"overheating"}) {
+			t.Fatalf("Expected the overheating event, got %v", result.Hits)
+		}
+	})
+
+	t.Run("pagination", func(t *testing.T) {
+		result, err := controller.searchCapability(CapabilityQuery{Affordance: AffordanceAction}, 1, 1)
+		if err != nil {
+			t.Fatal("Error searching:", err.Error())
+		}
+		if result.Total != 2 || len(result.Hits) != 1 || result.Hits[0].ID != "urn:example:test/lamp" {
+			t.Fatalf("Expected the lamp as the second of 2 hits, got %d: %v", result.Total, result.Hits)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := controller.searchCapability(CapabilityQuery{Affordance: AffordanceAction, Observable: boolean(true)}, 0, 10)
+		if _, ok := err.(*BadRequestError); !ok {
+			t.Fatalf("Expected BadRequestError but got %v", err)
+		}
+		_, err = controller.searchCapability(CapabilityQuery{Input: &SchemaQuery{Type: "float"}}, 0, 10)
+		if _, ok := err.(*BadRequestError); !ok {
+			t.Fatalf("Expected BadRequestError but got %v", err)
+		}
+	})
+}
+
+// recorder is an event listener that records the events and fails the first deliveries
+type recorder struct {
+	sync.Mutex
+	events   []string
+	failures int
+}
+
+func (r *recorder) record(event string) error {
+	r.Lock()
+	defer r.Unlock()
+	if r.failures > 0 {
+		r.failures--
+		return fmt.Errorf("failure")
+	}
+	r.events = append(r.events, event)
+	return nil
+}
+
+func (r *recorder) CreateHandler(new ThingDescription) error {
+	return r.record(fmt.Sprintf("created %s", new["id"]))
+}
+
+func (r *recorder) UpdateHandler(old ThingDescription, new ThingDescription) error {
+	return r.record(fmt.Sprintf("updated %s: %s -> %s", new["id"], old["title"], new["title"]))
+}
+
+func (r *recorder) DeleteHandler(old ThingDescription) error {
+	return r.record(fmt.Sprintf("deleted %s", old["id"]))
+}
+
+func (r *recorder) ExpiringHandler(td ThingDescription) error {
+	return r.record(fmt.Sprintf("expiring %s", td["id"]))
+}
+
+// wait returns the recorded events once there are n of them
+func (r *recorder) wait(t *testing.T, n int) []string {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		r.Lock()
+		events := append([]string(nil), r.events...)
+		r.Unlock()
+		if len(events) >= n {
+			return events
+		}
+	}
+	t.Fatalf("Timeout waiting for %d events", n)
+	return nil
+}
+
+func TestControllerEvents(t *testing.T) {
+	if TestStorageType != BackendLevelDB {
+		t.Skip("the outbox is persisted in LevelDB")
+	}
+	err := loadSchema()
+	if err != nil {
+		t.Fatalf("error loading WoT Thing Description schema: %s", err)
+	}
+
+	dispatchInitialBackoff = 10 * time.Millisecond
+	tempDir := fmt.Sprintf("%s/thing-directory/test-%s-ldb",
+		strings.Replace(os.TempDir(), "\\", "/", -1), uuid.NewV4())
+	defer os.RemoveAll(tempDir)
+
+	start := func(t *testing.T) (Storage, CatalogController) {
+		storage, err := NewLevelDBStorage(tempDir, nil)
+		if err != nil {
+			t.Fatalf("error creating leveldb storage: %s", err)
+		}
+		controller, err := NewController(storage, DefaultGeoLocations, 0)
+		if err != nil {
+			t.Fatalf("error creating controller: %s", err)
+		}
+		return storage, controller
+	}
+	td := func(title string) ThingDescription {
+		return ThingDescription{
+			"@context": "https://www.w3.org/2019/wot/td/v1",
+			"id":       "urn:example:lamp",
+			"title":    title,
+			"security": []string{"nosec_sc"},
+			"securityDefinitions": map[string]any{
+				"nosec_sc": map[string]string{"scheme": "nosec"},
+			},
+		}
+	}
+
+	var latestID uint64
+	t.Run("kept without listeners", func(t *testing.T) {
+		storage, controller := start(t)
+		defer storage.Close()
+		defer controller.Stop()
+
+		_, err := controller.add(td("Lamp"))
+		if err != nil {
+			t.Fatalf("Error adding: %s", err)
+		}
+		err = controller.update("urn:example:lamp", td("Kitchen Lamp"))
+		if err != nil {
+			t.Fatalf("Error updating: %s", err)
+		}
+
+		events, err := storage.outbox(0, 10)
+		if err != nil {
+			t.Fatalf("Error reading the outbox: %s", err)
+		}
+		if len(events) != 2 || events[0].ID >= events[1].ID {
+			t.Fatalf("Expected 2 events in order, got %v", events)
+		}
+		latestID = events[1].ID
+
+		// the outbox is not listed as TDs
+		total, err := storage.count()
+		if err != nil || total != 1 {
+			t.Fatalf("Expected 1 TD, got %d: %v", total, err)
+		}
+	})
+
+	t.Run("dispatched in order after restart", func(t *testing.T) {
+		storage, controller := start(t)
+		defer storage.Close()
+		defer controller.Stop()
+
+		listener := &recorder{failures: 2}
+		controller.AddSubscriber(listener)
+
+		err := controller.patch("urn:example:lamp", ThingDescription{"title": "Bedroom Lamp"})
+		if err != nil {
+			t.Fatalf("Error patching: %s", err)
+		}
+		err = controller.delete("urn:example:lamp")
+		if err != nil {
+			t.Fatalf("Error deleting: %s", err)
+		}
+
+		expected := []string{
+			"created urn:example:lamp",
+			"updated urn:example:lamp: Lamp -> Kitchen Lamp",
+			"updated urn:example:lamp: Kitchen Lamp -> Bedroom Lamp",
+			"deleted urn:example:lamp",
+		}
+		events := listener.wait(t, len(expected))
+		if !reflect.DeepEqual(events, expected) {
+			t.Fatalf("Expected events %v, got %v", expected, events)
+		}
+
+		// ids continue after the restart and the outbox is emptied
+		_, err = controller.add(td("Lamp"))
+		if err != nil {
+			t.Fatalf("Error adding: %s", err)
+		}
+		listener.wait(t, len(expected)+1)
+		outbox, err := storage.outbox(0, 10)
+		if err != nil || len(outbox) != 0 {
+			t.Fatalf("Expected an empty outbox, got %v: %v", outbox, err)
+		}
+		if s := storage.(*LevelDBStorage); s.eventSeq != latestID+3 {
+			t.Fatalf("Expected the latest event id %d, got %d", latestID+3, s.eventSeq)
+		}
+	})
+
+	t.Run("blocked listener", func(t *testing.T) {
+		storage, controller := start(t)
+		defer storage.Close()
+		defer controller.Stop()
+
+		blocked := &blocker{release: make(chan struct{})}
+		listener := &recorder{}
+		controller.AddSubscriber(blocked, listener)
+
+		for _, title := range []string{"Kitchen Lamp", "Bedroom Lamp"} {
+			err := controller.update("urn:example:lamp", td(title))
+			if err != nil {
+				t.Fatalf("Error updating: %s", err)
+			}
+		}
+		// not delayed by the other listener
+		listener.wait(t, 2)
+
+		// kept for the blocked listener
+		outbox, err := storage.outbox(0, 10)
+		if err != nil || len(outbox) != 2 {
+			t.Fatalf("Expected 2 events in the outbox, got %v: %v", outbox, err)
+		}
+
+		close(blocked.release)
+		blocked.wait(t, 2)
+		for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+			outbox, err = storage.outbox(0, 10)
+			if err == nil && len(outbox) == 0 {
+				break
+			}
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("Expected an empty outbox, got %v: %v", outbox, err)
+			}
+		}
+	})
+}
+
+// blocker is an event listener that records the events once released
+type blocker struct {
+	recorder
+	release chan struct{}
+}
+
+func (b *blocker) UpdateHandler(old ThingDescription, new ThingDescription) error {
+	<-b.release
+	return b.recorder.UpdateHandler(old, new)
+}
@@ -1,41 +1,168 @@
 package catalog
 
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/tinyiot/thing-directory/wot"
+)
+
+const (
+	// outboxBatchSize is the number of events read from the outbox at once
+	outboxBatchSize = 100
+	// Delivery of each event to a listener is retried with exponential backoff before it is skipped
+	dispatchMaxRetries = 5
+	dispatchMaxBackoff = time.Minute
+)
+
+var dispatchInitialBackoff = time.Second // to be modified in unit tests
+
 // EventListener interface that listens to TDD events.
 type EventListener interface {
 	CreateHandler(new ThingDescription) error
 	UpdateHandler(old ThingDescription, new ThingDescription) error
 	DeleteHandler(old ThingDescription) error
+	// ExpiringHandler is called ahead of the expiry of the registration, if configured
+	ExpiringHandler(td ThingDescription) error
 }
 
-// eventHandler implements sequential fav-out/fan-in of events from registry
-type eventHandler []EventListener
+// outboxEvent is a change of a TD, committed to the storage together with the change
+// The ids are monotonic across restarts.
+type outboxEvent struct {
+	ID   uint64           `json:"id"`
+	Type wot.EventType    `json:"type"`
+	Old  ThingDescription `json:"old,omitempty"`
+	New  ThingDescription `json:"new,omitempty"`
+}
+
+// dispatcher delivers the events of the outbox to one listener, from its own position
+// A listener that fails or is slow does not delay the others.
+type dispatcher struct {
+	listener EventListener
+	wake     chan struct{}
+	// delivered is the id of the latest event sent to the listener, accessed with the controller lock held
+	delivered uint64
+}
+
+// send passes the event to the listener
+func send(listener EventListener, event outboxEvent) error {
+	switch event.Type {
+	case wot.EventTypeCreate:
+		return listener.CreateHandler(event.New)
+	case wot.EventTypeUpdate:
+		return listener.UpdateHandler(event.Old, event.New)
+	case wot.EventTypeDelete:
+		return listener.DeleteHandler(event.Old)
+	case wot.EventTypeExpiring:
+		return listener.ExpiringHandler(event.New)
+	default:
+		return fmt.Errorf("unknown event type: %s", event.Type)
+	}
+}
+
+// dispatch sends the events of the outbox in order to the listener of the dispatcher
+// The events are removed once all listeners got them. They are delivered at least once:
+// those not removed before a crash are sent again to all listeners after restart.
+func (c *Controller) dispatch(d *dispatcher) {
+	defer c.dispatchers.Done()
+
+	for {
+		select {
+		case <-d.wake:
+		case <-c.dispatcherQuit:
+			return
+		}
+
+		for {
+			c.Lock()
+			after := d.delivered
+			c.Unlock()
 
-func (h eventHandler) created(new ThingDescription) error {
-	for i := range h {
-		err := h[i].CreateHandler(new)
-		if err != nil {
-			return err
+			events, err := c.storage.outbox(after, outboxBatchSize)
+			if err != nil {
+				log.Printf("Error reading the event outbox: %s", err)
+				break
+			}
+			if len(events) == 0 {
+				break
+			}
+			for _, event := range events {
+				if !c.deliver(d.listener, event) {
+					// stopped
+					return
+				}
+				c.Lock()
+				d.delivered = event.ID
+				c.Unlock()
+			}
+			c.removeDelivered()
 		}
 	}
-	return nil
 }
 
-func (h eventHandler) updated(old ThingDescription, new ThingDescription) error {
-	for i := range h {
-		err := h[i].UpdateHandler(old, new)
-		if err != nil {
-			return err
+// removeDelivered removes the events that were sent to all listeners from the outbox
+func (c *Controller) removeDelivered() {
+	c.Lock()
+	if len(c.listeners) == 0 {
+		c.Unlock()
+		return
+	}
+	upTo := c.listeners[0].delivered
+	for _, d := range c.listeners[1:] {
+		if d.delivered < upTo {
+			upTo = d.delivered
+		}
+	}
+	if upTo <= c.removedUpTo {
+		c.Unlock()
+		return
+	}
+	c.removedUpTo = upTo
+	c.Unlock()
+
+	err := c.storage.removeEvents(upTo)
+	if err != nil {
+		log.Printf("Error removing the events up to %d from the outbox: %s", upTo, err)
+	}
+}
+
+// deliver sends the event to the listener, retrying with exponential backoff
+// It returns false if the dispatcher is stopped.
+func (c *Controller) deliver(listener EventListener, event outboxEvent) bool {
+	backoff := dispatchInitialBackoff
+	for attempt := 0; ; attempt++ {
+		err := send(listener, event)
+		if err == nil {
+			return true
+		}
+		if attempt == dispatchMaxRetries {
+			log.Printf("Error dispatching event %d (%s) to %T after %d retries. Skipping: %s", event.ID, event.Type, listener, attempt, err)
+			return true
+		}
+		log.Printf("Error dispatching event %d (%s) to %T. Retrying in %s: %s", event.ID, event.Type, listener, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-c.dispatcherQuit:
+			return false
+		}
+		backoff *= 2
+		if backoff > dispatchMaxBackoff {
+			backoff = dispatchMaxBackoff
 		}
 	}
-	return nil
 }
 
-func (h eventHandler) deleted(old ThingDescription) error {
-	for i := range h {
-		err := h[i].DeleteHandler(old)
-		if err != nil {
-			return err
+// wakeDispatchers signals the dispatchers about new events
+func (c *Controller) wakeDispatchers() {
+	c.Lock()
+	defer c.Unlock()
+	for _, d := range c.listeners {
+		select {
+		case d.wake <- struct{}{}:
+		default:
+			// already awake
 		}
 	}
-	return nil
 }
@@ -0,0 +1,116 @@
+package catalog
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Derived facet fields. Other fields are dot-separated paths to TD values.
+	FacetProtocol    = "protocol"
+	FacetSecurity    = "security"
+	FacetContentType = "contentType"
+
+	// contentType of forms when not set
+	defaultContentType = "application/json"
+)
+
+// FacetResult holds the number of TDs per value of each facet field
+type FacetResult struct {
+	// Total is the number of counted TDs
+	Total  int                       `json:"total"`
+	Facets map[string]map[string]int `json:"facets"`
+}
+
+func newFacetResult(fields []string) *FacetResult {
+	r := FacetResult{
+		Facets: make(map[string]map[string]int, len(fields)),
+	}
+	for _, field := range fields {
+		r.Facets[field] = make(map[string]int)
+	}
+	return &r
+}
+
+// count adds the values of the TD to the facets. Each TD is counted at most once per value.
+func (r *FacetResult) count(td ThingDescription) {
+	r.Total++
+	for field, counts := range r.Facets {
+		seen := make(map[string]bool)
+		for _, v := range facetValues(td, field) {
+			if !seen[v] {
+				seen[v] = true
+				counts[v]++
+			}
+		}
+	}
+}
+
+// facetValues returns the values of a facet field in a TD
+func facetValues(td ThingDescription, field string) []string {
+	switch field {
+	case FacetProtocol:
+		return formProtocols(td)
+	case FacetSecurity:
+		return securitySchemes(td)
+	case FacetContentType:
+		var contentTypes []string
+		for _, form := range forms(td) {
+			if ct, ok := form["contentType"].(string); ok {
+				contentTypes = append(contentTypes, ct)
+			} else {
+				contentTypes = append(contentTypes, defaultContentType)
+			}
+		}
+		return contentTypes
+	}
+
+	var v interface{} = map[string]interface{}(td)
+	for _, key := range strings.Split(field, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+
+	if array, ok := v.([]interface{}); ok {
+		var values []string
+		for i := range array {
+			if s, ok := facetValue(array[i]); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	if s, ok := facetValue(v); ok {
+		return []string{s}
+	}
+	return nil
+}
+
+// facetValue converts a scalar JSON value to string
+func facetValue(v interface{}) (string, bool) {
+	switch s := v.(type) {
+	case string:
+		return s, true
+	case float64:
+		return strconv.FormatFloat(s, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(s), true
+	}
+	return "", false
+}
+
+func validateFacetFields(fields []string) error {
+	if len(fields) == 0 {
+		return &BadRequestError{"at least one facet field must be given"}
+	}
+	for _, field := range fields {
+		if field == "" {
+			return &BadRequestError{fmt.Sprintf("empty facet field in %v", fields)}
+		}
+	}
+	return nil
+}
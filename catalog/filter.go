@@ -0,0 +1,188 @@
+package catalog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	jsonpath "github.com/bhmj/jsonslice"
+)
+
+// Filter is a set of simple attribute conditions. A TD matches when it satisfies all the set conditions.
+type Filter struct {
+	// Type is a semantic type that must be in @type
+	Type string
+	// Title is a case-insensitive substring of the title
+	Title string
+	// Property is the name of a property that must exist
+	Property string
+	// Protocol is a URI scheme (e.g. coap) of at least one form
+	Protocol string
+	// Security is a scheme (e.g. bearer) of at least one security definition
+	Security string
+	// ModifiedSince matches TDs that were modified after the given time
+	ModifiedSince *time.Time
+}
+
+// MatchJSONPath returns true if the JSONPath query selects anything in an array holding only the given TD
+// The query has the same form as in searches over the catalog e.g. $[?(@.title=='Kitchen Lamp')]
+func MatchJSONPath(query string, td ThingDescription) (bool, error) {
+	b, err := json.Marshal([]ThingDescription{td})
+	if err != nil {
+		return false, err
+	}
+	b, err = jsonpath.Get(b, query)
+	if err != nil {
+		return false, &BadRequestError{fmt.Sprintf("error evaluating jsonpath: %s", err)}
+	}
+	b = bytes.TrimSpace(b)
+	return len(b) > 0 && !bytes.Equal(b, []byte("[]")) && !bytes.Equal(b, []byte("null")), nil
+}
+
+// IsEmpty returns true if no condition is set
+func (f *Filter) IsEmpty() bool {
+	return f == nil || *f == Filter{}
+}
+
+// Match returns true if the TD satisfies all conditions of the filter
+func (f *Filter) Match(td ThingDescription) bool {
+	if f.IsEmpty() {
+		return true
+	}
+
+	if f.Type != "" && !matchType(td, f.Type) {
+		return false
+	}
+	if f.Title != "" {
+		title, _ := td["title"].(string)
+		if !strings.Contains(strings.ToLower(title), strings.ToLower(f.Title)) {
+			return false
+		}
+	}
+	if f.Property != "" {
+		properties, _ := td["properties"].(map[string]interface{})
+		if _, found := properties[f.Property]; !found {
+			return false
+		}
+	}
+	if f.Protocol != "" && !matchProtocol(td, f.Protocol) {
+		return false
+	}
+	if f.Security != "" && !matchSecurity(td, f.Security) {
+		return false
+	}
+	if f.ModifiedSince != nil {
+		tr := ThingRegistration(td)
+		if tr == nil || tr.Modified == nil || !tr.Modified.After(*f.ModifiedSince) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func matchType(td ThingDescription, semanticType string) bool {
+	for _, t := range semanticTypes(td) {
+		if t == semanticType {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSecurity(td ThingDescription, scheme string) bool {
+	for _, s := range securitySchemes(td) {
+		if strings.EqualFold(s, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchProtocol(td ThingDescription, protocol string) bool {
+	for _, p := range formProtocols(td) {
+		if strings.EqualFold(p, protocol) {
+			return true
+		}
+	}
+	return false
+}
+
+// semanticTypes returns the values of @type
+func semanticTypes(td ThingDescription) []string {
+	switch t := td["@type"].(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		var types []string
+		for i := range t {
+			if s, ok := t[i].(string); ok {
+				types = append(types, s)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+// securitySchemes returns the schemes of all security definitions
+func securitySchemes(td ThingDescription) []string {
+	var schemes []string
+	definitions, _ := td["securityDefinitions"].(map[string]interface{})
+	for _, d := range definitions {
+		definition, _ := d.(map[string]interface{})
+		if s, ok := definition["scheme"].(string); ok {
+			schemes = append(schemes, s)
+		}
+	}
+	return schemes
+}
+
+// formProtocols returns the URI schemes of the forms in the TD and its interaction affordances
+// Relative hrefs are resolved against the TD base
+func formProtocols(td ThingDescription) []string {
+	base, _ := td["base"].(string)
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		baseURL = &url.URL{}
+	}
+
+	var protocols []string
+	for _, form := range forms(td) {
+		href, _ := form["href"].(string)
+		u, err := url.Parse(href)
+		if err != nil {
+			continue
+		}
+		if scheme := baseURL.ResolveReference(u).Scheme; scheme != "" {
+			protocols = append(protocols, strings.ToLower(scheme))
+		}
+	}
+	return protocols
+}
+
+// forms returns the forms in the TD and its interaction affordances
+func forms(td ThingDescription) []map[string]interface{} {
+	var all []map[string]interface{}
+	appendForms := func(v interface{}) {
+		forms, _ := v.([]interface{})
+		for i := range forms {
+			if form, ok := forms[i].(map[string]interface{}); ok {
+				all = append(all, form)
+			}
+		}
+	}
+
+	appendForms(td["forms"])
+	for _, key := range []string{"properties", "actions", "events"} {
+		affordances, _ := td[key].(map[string]interface{})
+		for _, a := range affordances {
+			affordance, _ := a.(map[string]interface{})
+			appendForms(affordance["forms"])
+		}
+	}
+	return all
+}
@@ -0,0 +1,223 @@
+package catalog
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/geo"
+	"github.com/blevesearch/bleve/search"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+const geoFieldLocation = "location"
+
+// GeoLocation defines where the coordinates of a Thing are found in its TD.
+// Latitude and Longitude are dot-separated paths to the values in decimal degrees e.g. "geo.latitude"
+type GeoLocation struct {
+	Latitude  string `json:"latitude"`
+	Longitude string `json:"longitude"`
+}
+
+// DefaultGeoLocations are the W3C Basic Geo and schema.org GeoCoordinates properties
+var DefaultGeoLocations = []GeoLocation{
+	{Latitude: "geo:lat", Longitude: "geo:long"},
+	{Latitude: "geo.latitude", Longitude: "geo.longitude"},
+}
+
+// GeoPoint is a location in decimal degrees
+type GeoPoint struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// GeoQuery selects the Things within a radius around a point, inside a bounding box, or inside a polygon
+type GeoQuery struct {
+	// Center and Radius (e.g. "50m", "2km") of a circular area
+	Center *GeoPoint
+	Radius string
+	// TopLeft and BottomRight corners of a bounding box
+	TopLeft     *GeoPoint
+	BottomRight *GeoPoint
+	// Polygon vertices
+	Polygon []GeoPoint
+}
+
+// GeoSearchResult is the result of a geospatial search
+type GeoSearchResult struct {
+	Total uint64         `json:"total"`
+	Hits  []GeoSearchHit `json:"hits"`
+}
+
+// GeoSearchHit is a matching TD with its location
+type GeoSearchHit struct {
+	ID       string   `json:"id"`
+	Location GeoPoint `json:"location"`
+	// Distance from the center of a radius search in meters
+	Distance *float64         `json:"distance,omitempty"`
+	TD       ThingDescription `json:"td"`
+}
+
+// geoIndex is an embedded geospatial index of TD locations
+type geoIndex struct {
+	sync.RWMutex
+	idx       bleve.Index
+	locations []GeoLocation
+	points    map[string]GeoPoint
+}
+
+func newGeoIndex(locations []GeoLocation) (*geoIndex, error) {
+	for _, l := range locations {
+		if l.Latitude == "" || l.Longitude == "" {
+			return nil, fmt.Errorf("geo location must have both latitude and longitude paths")
+		}
+	}
+
+	doc := bleve.NewDocumentMapping()
+	doc.AddFieldMappingsAt(geoFieldLocation, bleve.NewGeoPointFieldMapping())
+	m := bleve.NewIndexMapping()
+	m.DefaultMapping = doc
+
+	index, err := bleve.NewMemOnly(m)
+	if err != nil {
+		return nil, fmt.Errorf("error creating geo index: %s", err)
+	}
+	return &geoIndex{
+		idx:       index,
+		locations: locations,
+		points:    make(map[string]GeoPoint),
+	}, nil
+}
+
+// index adds or replaces the location of the given TD. TDs without location are removed.
+func (i *geoIndex) index(id string, td ThingDescription) error {
+	point, found := i.extract(td)
+	if !found {
+		return i.remove(id)
+	}
+
+	err := i.idx.Index(id, map[string]interface{}{
+		geoFieldLocation: geo.Point{Lat: point.Latitude, Lon: point.Longitude},
+	})
+	if err != nil {
+		return err
+	}
+
+	i.Lock()
+	i.points[id] = point
+	i.Unlock()
+	return nil
+}
+
+// remove deletes the location of the given TD
+func (i *geoIndex) remove(id string) error {
+	i.Lock()
+	delete(i.points, id)
+	i.Unlock()
+	return i.idx.Delete(id)
+}
+
+// search returns the ids and locations of TDs in the area, with the distances for radius queries
+// Radius queries are ordered by distance, others by id.
+func (i *geoIndex) search(q GeoQuery, offset, limit int) (uint64, []GeoSearchHit, error) {
+	var gq query.Query
+	var order search.SortOrder
+	switch {
+	case q.Center != nil:
+		if q.Radius == "" {
+			return 0, nil, &BadRequestError{"radius must be set along with the center"}
+		}
+		if _, err := geo.ParseDistance(q.Radius); err != nil {
+			return 0, nil, &BadRequestError{fmt.Sprintf("invalid radius: %s", q.Radius)}
+		}
+		gq = bleve.NewGeoDistanceQuery(q.Center.Longitude, q.Center.Latitude, q.Radius)
+		byDistance, err := search.NewSortGeoDistance(geoFieldLocation, "m", q.Center.Longitude, q.Center.Latitude, false)
+		if err != nil {
+			return 0, nil, err
+		}
+		order = search.SortOrder{byDistance, &search.SortDocID{}}
+	case q.TopLeft != nil && q.BottomRight != nil:
+		gq = bleve.NewGeoBoundingBoxQuery(q.TopLeft.Longitude, q.TopLeft.Latitude, q.BottomRight.Longitude, q.BottomRight.Latitude)
+		order = search.SortOrder{&search.SortDocID{}}
+	case len(q.Polygon) > 0:
+		if len(q.Polygon) < 3 {
+			return 0, nil, &BadRequestError{"polygon must have at least 3 vertices"}
+		}
+		var points []geo.Point
+		for _, p := range q.Polygon {
+			points = append(points, geo.Point{Lat: p.Latitude, Lon: p.Longitude})
+		}
+		gq = query.NewGeoBoundingPolygonQuery(points)
+		order = search.SortOrder{&search.SortDocID{}}
+	default:
+		return 0, nil, &BadRequestError{"either a center point and radius, a bounding box, or a polygon must be given"}
+	}
+	gq.(query.FieldableQuery).SetField(geoFieldLocation)
+
+	req := bleve.NewSearchRequestOptions(gq, limit, offset, false)
+	req.SortByCustom(order)
+	res, err := i.idx.Search(req)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	i.RLock()
+	defer i.RUnlock()
+	hits := make([]GeoSearchHit, 0, len(res.Hits))
+	for _, h := range res.Hits {
+		point, found := i.points[h.ID]
+		if !found {
+			continue
+		}
+		hit := GeoSearchHit{ID: h.ID, Location: point}
+		if q.Center != nil {
+			distance := geo.Haversin(q.Center.Longitude, q.Center.Latitude, point.Longitude, point.Latitude) * 1000
+			hit.Distance = &distance
+		}
+		hits = append(hits, hit)
+	}
+	return res.Total, hits, nil
+}
+
+func (i *geoIndex) close() error {
+	return i.idx.Close()
+}
+
+// extract returns the location at the first configured paths that hold valid coordinates
+func (i *geoIndex) extract(td ThingDescription) (GeoPoint, bool) {
+	for _, l := range i.locations {
+		lat, ok := geoCoordinate(td, l.Latitude)
+		if !ok || lat < -90 || lat > 90 {
+			continue
+		}
+		lon, ok := geoCoordinate(td, l.Longitude)
+		if !ok || lon < -180 || lon > 180 {
+			continue
+		}
+		return GeoPoint{Latitude: lat, Longitude: lon}, true
+	}
+	return GeoPoint{}, false
+}
+
+// geoCoordinate returns the number or numeric string at the dot-separated path
+func geoCoordinate(td ThingDescription, path string) (float64, bool) {
+	var v interface{} = map[string]interface{}(td)
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return 0, false
+		}
+		v = m[key]
+	}
+
+	switch c := v.(type) {
+	case float64:
+		return c, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(c), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
@@ -7,6 +7,8 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/tinyiot/thing-directory/wot"
@@ -18,6 +20,35 @@ const (
 	QueryParamLimit       = "limit"
 	QueryParamJSONPath    = "jsonpath"
 	QueryParamSearchQuery = "query"
+	QueryParamTextQuery   = "q"
+	QueryParamLanguage    = "lang"
+	// filter query parameters
+	QueryParamType          = "type"
+	QueryParamTitle         = "title"
+	QueryParamProperty      = "property"
+	QueryParamProtocol      = "protocol"
+	QueryParamSecurity      = "security"
+	QueryParamModifiedSince = "modifiedSince"
+	// sorting query parameters
+	QueryParamSort  = "sort"
+	QueryParamOrder = "order"
+	// cursor-based pagination and response format
+	QueryParamAfter  = "after"
+	QueryParamFormat = "format"
+	FormatArray      = "array"
+	FormatCollection = "collection"
+
+	HeaderTotalCount = "X-Total-Count"
+	// geospatial search query parameters
+	QueryParamLatitude    = "lat"
+	QueryParamLongitude   = "lon"
+	QueryParamRadius      = "radius"
+	QueryParamBoundingBox = "bbox"
+	QueryParamPolygon     = "polygon"
+	// facets query parameters
+	QueryParamFields = "fields"
+
+	DefaultSearchLimit = 20
 )
 
 type ValidationResult struct {
@@ -196,6 +227,17 @@ func (a *HTTPAPI) Patch(w http.ResponseWriter, req *http.Request) {
 func (a *HTTPAPI) Get(w http.ResponseWriter, req *http.Request) {
 	params := mux.Vars(req)
 
+	err := req.ParseForm()
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Error parsing the query:", err.Error())
+		return
+	}
+	projection, err := parseProjection(req)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	td, err := a.controller.get(params["id"])
 	if err != nil {
 		switch err.(type) {
@@ -208,7 +250,7 @@ func (a *HTTPAPI) Get(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	b, err := json.Marshal(td)
+	b, err := json.Marshal(projection.apply(td))
 	if err != nil {
 		ErrorResponse(w, http.StatusInternalServerError, err.Error())
 		return
@@ -221,6 +263,80 @@ func (a *HTTPAPI) Get(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// BatchGetResult is the response of a batch retrieval. TDs and problems are keyed by the requested ids.
+type BatchGetResult struct {
+	Things map[string]ThingDescription   `json:"things"`
+	Errors map[string]wot.ProblemDetails `json:"errors,omitempty"`
+}
+
+// BatchGet handler gets many items by id
+func (a *HTTPAPI) BatchGet(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Error parsing the query:", err.Error())
+		return
+	}
+	projection, err := parseProjection(req)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var ids []string
+	err = json.Unmarshal(body, &ids)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Error processing the request: expected an array of ids: ", err.Error())
+		return
+	}
+
+	tds, err := a.controller.getMany(ids)
+	if err != nil {
+		switch err.(type) {
+		case *BadRequestError:
+			ErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		default:
+			ErrorResponse(w, http.StatusInternalServerError, "Error retrieving the registrations: ", err.Error())
+			return
+		}
+	}
+
+	res := BatchGetResult{Things: make(map[string]ThingDescription, len(tds))}
+	for _, id := range ids {
+		td, found := tds[id]
+		if !found {
+			if res.Errors == nil {
+				res.Errors = make(map[string]wot.ProblemDetails)
+			}
+			res.Errors[id] = wot.ProblemDetails{
+				Title:  http.StatusText(http.StatusNotFound),
+				Status: http.StatusNotFound,
+				Detail: id + " is not found",
+			}
+			continue
+		}
+		res.Things[id] = projection.apply(td)
+	}
+
+	b, err := json.Marshal(res)
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", wot.MediaTypeJSON)
+	_, err = w.Write(b)
+	if err != nil {
+		log.Printf("ERROR writing HTTP response: %s", err)
+	}
+}
+
 // Delete removes one item
 func (a *HTTPAPI) Delete(w http.ResponseWriter, req *http.Request) {
 	params := mux.Vars(req)
@@ -248,11 +364,15 @@ func (a *HTTPAPI) List(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// pagination is done only when limit is set
-	if req.Form.Get(QueryParamLimit) != "" {
+	// pagination is done only when limit or continuation token is set
+	if req.Form.Get(QueryParamLimit) != "" || req.Form.Get(QueryParamAfter) != "" {
 		a.listPaginated(w, req)
 		return
 	} else {
+		if req.Form.Get(QueryParamSort) != "" || req.Form.Get(QueryParamOrder) != "" {
+			ErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Sorting is only supported for paginated listing (with %s)", QueryParamLimit))
+			return
+		}
 		a.listStream(w, req)
 		return
 	}
@@ -260,7 +380,38 @@ func (a *HTTPAPI) List(w http.ResponseWriter, req *http.Request) {
 
 func (a *HTTPAPI) listPaginated(w http.ResponseWriter, req *http.Request) {
 	var err error
-	var limit, offset int
+	var limit, offset = MaxLimit, 0
+
+	format := req.Form.Get(QueryParamFormat)
+	if format != "" && format != FormatArray && format != FormatCollection {
+		ErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Unsupported format: %s", format))
+		return
+	}
+
+	projection, err := parseProjection(req)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	filter, err := ParseFilter(req)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var sorting *Sorting
+	sortBy, order := req.Form.Get(QueryParamSort), req.Form.Get(QueryParamOrder)
+	if sortBy != "" || order != "" {
+		if sortBy == "" {
+			sortBy = SortByID
+		}
+		sorting, err = NewSorting(sortBy, order)
+		if err != nil {
+			ErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
 
 	limitStr := req.Form.Get(QueryParamLimit)
 	if limitStr != "" {
@@ -280,7 +431,11 @@ func (a *HTTPAPI) listPaginated(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	items, err := a.controller.listPaginate(offset, limit)
+	page, err := a.controller.listPaginate(Pagination{
+		Offset: offset,
+		Limit:  limit,
+		After:  req.Form.Get(QueryParamAfter),
+	}, filter, sorting)
 	if err != nil {
 		switch err.(type) {
 		case *BadRequestError:
@@ -292,7 +447,34 @@ func (a *HTTPAPI) listPaginated(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	b, err := json.Marshal(items)
+	var next string
+	if page.Next != "" {
+		// same query with the continuation token instead of the offset
+		query := req.URL.Query()
+		query.Del(QueryParamOffset)
+		query.Set(QueryParamAfter, page.Next)
+		query.Set(QueryParamLimit, strconv.Itoa(limit))
+		next = req.URL.Path + "?" + query.Encode()
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next))
+	}
+	w.Header().Set(HeaderTotalCount, strconv.Itoa(page.Total))
+
+	for i := range page.Items {
+		page.Items[i] = projection.apply(page.Items[i])
+	}
+
+	var b []byte
+	if format == FormatCollection {
+		b, err = json.Marshal(wot.ThingCollection{
+			Context: wot.DiscoveryContextURI,
+			Type:    wot.TypeThingCollection,
+			Total:   page.Total,
+			Members: page.Items,
+			Next:    next,
+		})
+	} else {
+		b, err = json.Marshal(page.Items)
+	}
 	if err != nil {
 		ErrorResponse(w, http.StatusInternalServerError, err.Error())
 		return
@@ -311,16 +493,27 @@ func (a *HTTPAPI) listStream(w http.ResponseWriter, req *http.Request) {
 	//	panic("expected http.ResponseWriter to be an http.Flusher")
 	//}
 
+	filter, err := ParseFilter(req)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	projection, err := parseProjection(req)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	w.Header().Set("Content-Type", wot.MediaTypeJSONLD)
 	w.Header().Set("X-Content-Type-Options", "nosniff") // tell clients not to infer content type from partial body
 
-	_, err := fmt.Fprintf(w, "[")
+	_, err = fmt.Fprintf(w, "[")
 	if err != nil {
 		log.Printf("ERROR writing HTTP response: %s", err)
 	}
 
 	first := true
-	for item := range a.controller.iterateBytes(req.Context()) {
+	for item := range a.controller.iterateBytes(req.Context(), filter, projection) {
 		select {
 		case <-req.Context().Done():
 			log.Println("Cancelled by client.")
@@ -354,6 +547,61 @@ func (a *HTTPAPI) listStream(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// ParseFilter parses the attribute filters of a listing request
+func ParseFilter(req *http.Request) (*Filter, error) {
+	filter := Filter{
+		Type:     req.Form.Get(QueryParamType),
+		Title:    req.Form.Get(QueryParamTitle),
+		Property: req.Form.Get(QueryParamProperty),
+		Protocol: req.Form.Get(QueryParamProtocol),
+		Security: req.Form.Get(QueryParamSecurity),
+	}
+
+	if modifiedSince := req.Form.Get(QueryParamModifiedSince); modifiedSince != "" {
+		t, err := time.Parse(time.RFC3339, modifiedSince)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", QueryParamModifiedSince, err)
+		}
+		filter.ModifiedSince = &t
+	}
+
+	return &filter, nil
+}
+
+// parseFields parses the comma-separated or repeated fields parameter
+func parseFields(req *http.Request) []string {
+	var fields []string
+	for _, v := range req.Form[QueryParamFields] {
+		for _, field := range strings.Split(v, ",") {
+			fields = append(fields, strings.TrimSpace(field))
+		}
+	}
+	return fields
+}
+
+// parseProjection parses the fields of partial TDs
+func parseProjection(req *http.Request) (*Projection, error) {
+	return NewProjection(parseFields(req))
+}
+
+// parseSearchPagination parses the offset and limit of the search results, with DefaultSearchLimit by default
+func parseSearchPagination(req *http.Request) (offset, limit int, err error) {
+	limit = DefaultSearchLimit
+	if limitStr := req.Form.Get(QueryParamLimit); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 0 {
+			return 0, 0, fmt.Errorf("invalid %s: %s", QueryParamLimit, limitStr)
+		}
+	}
+	if offsetStr := req.Form.Get(QueryParamOffset); offsetStr != "" {
+		offset, err = strconv.Atoi(offsetStr)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("invalid %s: %s", QueryParamOffset, offsetStr)
+		}
+	}
+	return offset, limit, nil
+}
+
 // SearchJSONPath returns the JSONPath query result
 func (a *HTTPAPI) SearchJSONPath(w http.ResponseWriter, req *http.Request) {
 	err := req.ParseForm()
@@ -389,3 +637,270 @@ func (a *HTTPAPI) SearchJSONPath(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 }
+
+// SearchText returns the TDs matching a full-text query, ranked by relevance
+func (a *HTTPAPI) SearchText(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Error parsing the query: ", err.Error())
+		return
+	}
+
+	query := req.Form.Get(QueryParamTextQuery)
+	if query == "" {
+		ErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("No value for %s argument", QueryParamTextQuery))
+		return
+	}
+
+	offset, limit, err := parseSearchPagination(req)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	projection, err := parseProjection(req)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result, err := a.controller.searchText(query, req.Form.Get(QueryParamLanguage), offset, limit)
+	if err != nil {
+		switch err.(type) {
+		case *BadRequestError:
+			ErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		default:
+			ErrorResponse(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	for i := range result.Hits {
+		result.Hits[i].TD = projection.apply(result.Hits[i].TD)
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", wot.MediaTypeJSON)
+	_, err = w.Write(b)
+	if err != nil {
+		log.Printf("ERROR writing HTTP response: %s", err)
+	}
+}
+
+// SearchGeo returns the TDs located within a radius, bounding box, or polygon
+func (a *HTTPAPI) SearchGeo(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Error parsing the query: ", err.Error())
+		return
+	}
+
+	query, err := parseGeoQuery(req)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	offset, limit, err := parseSearchPagination(req)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	projection, err := parseProjection(req)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result, err := a.controller.searchGeo(*query, offset, limit)
+	if err != nil {
+		switch err.(type) {
+		case *BadRequestError:
+			ErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		default:
+			ErrorResponse(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	for i := range result.Hits {
+		result.Hits[i].TD = projection.apply(result.Hits[i].TD)
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", wot.MediaTypeJSON)
+	_, err = w.Write(b)
+	if err != nil {
+		log.Printf("ERROR writing HTTP response: %s", err)
+	}
+}
+
+// SearchCapability handler searches for Things by the capabilities of their affordances
+func (a *HTTPAPI) SearchCapability(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Error parsing the query: ", err.Error())
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var query CapabilityQuery
+	err = json.Unmarshal(body, &query)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Error processing the request: ", err.Error())
+		return
+	}
+
+	offset, limit, err := parseSearchPagination(req)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	projection, err := parseProjection(req)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result, err := a.controller.searchCapability(query, offset, limit)
+	if err != nil {
+		switch err.(type) {
+		case *BadRequestError:
+			ErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		default:
+			ErrorResponse(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	for i := range result.Hits {
+		result.Hits[i].TD = projection.apply(result.Hits[i].TD)
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", wot.MediaTypeJSON)
+	_, err = w.Write(b)
+	if err != nil {
+		log.Printf("ERROR writing HTTP response: %s", err)
+	}
+}
+
+// parseGeoQuery parses the area of a geospatial search
+// Coordinates of the bounding box and polygon are in GeoJSON order i.e. longitude before latitude
+func parseGeoQuery(req *http.Request) (*GeoQuery, error) {
+	var query GeoQuery
+
+	parseCoordinates := func(param string) ([]float64, error) {
+		var coordinates []float64
+		for _, s := range strings.Split(req.Form.Get(param), ",") {
+			f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid coordinate in %s: %s", param, s)
+			}
+			coordinates = append(coordinates, f)
+		}
+		return coordinates, nil
+	}
+
+	switch {
+	case req.Form.Get(QueryParamLatitude) != "" || req.Form.Get(QueryParamLongitude) != "":
+		lat, err := strconv.ParseFloat(req.Form.Get(QueryParamLatitude), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", QueryParamLatitude, err)
+		}
+		lon, err := strconv.ParseFloat(req.Form.Get(QueryParamLongitude), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", QueryParamLongitude, err)
+		}
+		query.Center = &GeoPoint{Latitude: lat, Longitude: lon}
+		query.Radius = req.Form.Get(QueryParamRadius)
+	case req.Form.Get(QueryParamBoundingBox) != "":
+		bbox, err := parseCoordinates(QueryParamBoundingBox)
+		if err != nil {
+			return nil, err
+		}
+		if len(bbox) != 4 {
+			return nil, fmt.Errorf("%s must be west,south,east,north", QueryParamBoundingBox)
+		}
+		query.TopLeft = &GeoPoint{Longitude: bbox[0], Latitude: bbox[3]}
+		query.BottomRight = &GeoPoint{Longitude: bbox[2], Latitude: bbox[1]}
+	case req.Form.Get(QueryParamPolygon) != "":
+		coordinates, err := parseCoordinates(QueryParamPolygon)
+		if err != nil {
+			return nil, err
+		}
+		if len(coordinates)%2 != 0 {
+			return nil, fmt.Errorf("%s must be a list of lon,lat pairs", QueryParamPolygon)
+		}
+		for i := 0; i < len(coordinates); i += 2 {
+			query.Polygon = append(query.Polygon, GeoPoint{Longitude: coordinates[i], Latitude: coordinates[i+1]})
+		}
+	default:
+		return nil, fmt.Errorf("one of %s and %s, %s, or %s must be set", QueryParamLatitude, QueryParamLongitude, QueryParamBoundingBox, QueryParamPolygon)
+	}
+
+	return &query, nil
+}
+
+// SearchFacets returns the number of TDs per value of the requested fields
+func (a *HTTPAPI) SearchFacets(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Error parsing the query: ", err.Error())
+		return
+	}
+
+	fields := parseFields(req)
+
+	filter, err := ParseFilter(req)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result, err := a.controller.facets(fields, req.Form.Get(QueryParamSearchQuery), filter)
+	if err != nil {
+		switch err.(type) {
+		case *BadRequestError:
+			ErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		default:
+			ErrorResponse(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", wot.MediaTypeJSON)
+	_, err = w.Write(b)
+	if err != nil {
+		log.Printf("ERROR writing HTTP response: %s", err)
+	}
+}
@@ -0,0 +1,32 @@
+package catalog
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseSearchPagination(t *testing.T) {
+	for query, expected := range map[string][2]int{
+		"":                  {0, DefaultSearchLimit},
+		"?offset=5&limit=0": {5, 0},
+		"?limit=50":         {0, 50},
+	} {
+		req := httptest.NewRequest("GET", "/search/text"+query, nil)
+		req.ParseForm()
+		offset, limit, err := parseSearchPagination(req)
+		if err != nil {
+			t.Fatalf("Unexpected error for %q: %s", query, err)
+		}
+		if offset != expected[0] || limit != expected[1] {
+			t.Fatalf("Expected offset %d and limit %d for %q, got: %d and %d", expected[0], expected[1], query, offset, limit)
+		}
+	}
+
+	for _, query := range []string{"?limit=-1", "?offset=-1", "?limit=x", "?offset=1.5"} {
+		req := httptest.NewRequest("GET", "/search/text"+query, nil)
+		req.ParseForm()
+		if _, _, err := parseSearchPagination(req); err == nil {
+			t.Fatalf("Expected an error for %q", query)
+		}
+	}
+}
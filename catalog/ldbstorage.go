@@ -3,21 +3,44 @@ package catalog
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"net/url"
 	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/tinyiot/thing-directory/wot"
+)
+
+var (
+	// tdRange is the key range of TDs. The ids are UTF-8 strings, which never contain the byte 0xff.
+	tdRange = &util.Range{Limit: []byte{0xff}}
+	// outboxPrefix is the key prefix of the events waiting for dispatch, keyed by id
+	outboxPrefix = []byte("\xffoutbox/")
+	// eventSeqKey holds the id of the latest event to keep the ids monotonic after the outbox is emptied
+	eventSeqKey = []byte("\xffseq")
+	// sortIndexPrefix is the key prefix of the secondary indexes of the sort fields, which map the sort keys to the ids
+	sortIndexPrefix = []byte("\xffsort/")
+	// sortIndexFields are the sort fields with a secondary index
+	sortIndexFields = []string{SortByCreated, SortByModified, SortByExpires}
 )
 
 // LevelDB storage
 type LevelDBStorage struct {
 	db *leveldb.DB
 	wg sync.WaitGroup
+	// writeLock serializes the writes to commit each change with its event in order
+	writeLock sync.Mutex
+	eventSeq  uint64
+	// total is the number of TDs, counted on open and updated with the writes under the write lock
+	total int
 }
 
 func NewLevelDBStorage(dsn string, opts *opt.Options) (Storage, error) {
@@ -32,7 +55,61 @@ func NewLevelDBStorage(dsn string, opts *opt.Options) (Storage, error) {
 		return nil, err
 	}
 
-	return &LevelDBStorage{db: db}, nil
+	s := &LevelDBStorage{db: db}
+	seq, err := db.Get(eventSeqKey, nil)
+	if err == nil {
+		s.eventSeq = binary.BigEndian.Uint64(seq)
+	} else if err != leveldb.ErrNotFound {
+		db.Close()
+		return nil, fmt.Errorf("error reading the event sequence: %w", err)
+	}
+	err = s.rebuildIndexes()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error building the indexes: %w", err)
+	}
+	return s, nil
+}
+
+// rebuildIndexes counts the stored TDs and replaces the sort index with the one of the TDs, e.g. after an upgrade
+func (s *LevelDBStorage) rebuildIndexes() error {
+	batch := new(leveldb.Batch)
+	write := func() error {
+		err := s.db.Write(batch, nil)
+		batch.Reset()
+		return err
+	}
+
+	iter := s.db.NewIterator(util.BytesPrefix(sortIndexPrefix), nil)
+	for iter.Next() {
+		batch.Delete(append([]byte{}, iter.Key()...))
+	}
+	iter.Release()
+	err := iter.Error()
+	if err != nil {
+		return err
+	}
+
+	iter = s.db.NewIterator(tdRange, nil)
+	defer iter.Release()
+	for iter.Next() {
+		s.total++
+		err := putSortIndex(batch, iter.Value())
+		if err != nil {
+			return err
+		}
+		if batch.Len() >= 1000 {
+			err = write()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = iter.Error()
+	if err != nil {
+		return err
+	}
+	return write()
 }
 
 // CRUD
@@ -41,11 +118,18 @@ func (s *LevelDBStorage) add(id string, td ThingDescription) error {
 		return fmt.Errorf("ID is not set")
 	}
 
+	if !utf8.ValidString(id) {
+		return &BadRequestError{"ID is not a valid UTF-8 string"}
+	}
+
 	bytes, err := json.Marshal(td)
 	if err != nil {
 		return err
 	}
 
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
 	found, err := s.db.Has([]byte(id), nil)
 	if err != nil {
 		return err
@@ -54,15 +138,28 @@ func (s *LevelDBStorage) add(id string, td ThingDescription) error {
 		return &ConflictError{id + " is not unique"}
 	}
 
-	err = s.db.Put([]byte(id), bytes, nil)
+	batch := new(leveldb.Batch)
+	batch.Put([]byte(id), bytes)
+	err = putSortIndex(batch, bytes)
 	if err != nil {
 		return err
 	}
-
+	err = s.addEvent(batch, outboxEvent{Type: wot.EventTypeCreate, New: td})
+	if err != nil {
+		return err
+	}
+	err = s.db.Write(batch, nil)
+	if err != nil {
+		return err
+	}
+	s.total++
 	return nil
 }
 
 func (s *LevelDBStorage) get(id string) (ThingDescription, error) {
+	if !utf8.ValidString(id) {
+		return nil, &NotFoundError{id + " is not found"}
+	}
 
 	bytes, err := s.db.Get([]byte(id), nil)
 	if err == leveldb.ErrNotFound {
@@ -80,6 +177,37 @@ func (s *LevelDBStorage) get(id string) (ThingDescription, error) {
 	return td, nil
 }
 
+func (s *LevelDBStorage) getMany(ids []string) (map[string]ThingDescription, error) {
+	// read from a consistent snapshot
+	snapshot, err := s.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snapshot.Release()
+
+	tds := make(map[string]ThingDescription, len(ids))
+	for _, id := range ids {
+		if !utf8.ValidString(id) {
+			continue
+		}
+		bytes, err := snapshot.Get([]byte(id), nil)
+		if err == leveldb.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		var td ThingDescription
+		err = json.Unmarshal(bytes, &td)
+		if err != nil {
+			return nil, err
+		}
+		tds[id] = td
+	}
+
+	return tds, nil
+}
+
 func (s *LevelDBStorage) update(id string, td ThingDescription) error {
 
 	bytes, err := json.Marshal(td)
@@ -87,45 +215,143 @@ func (s *LevelDBStorage) update(id string, td ThingDescription) error {
 		return err
 	}
 
-	found, err := s.db.Has([]byte(id), nil)
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	old, err := s.get(id)
+	if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	batch.Put([]byte(id), bytes)
+	deleteSortIndex(batch, old)
+	err = putSortIndex(batch, bytes)
 	if err != nil {
 		return err
 	}
-	if !found {
-		return &NotFoundError{id + " is not found"}
+	err = s.addEvent(batch, outboxEvent{Type: wot.EventTypeUpdate, Old: old, New: td})
+	if err != nil {
+		return err
 	}
+	return s.db.Write(batch, nil)
+}
+
+func (s *LevelDBStorage) delete(id string) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
 
-	err = s.db.Put([]byte(id), bytes, nil)
+	old, err := s.get(id)
 	if err != nil {
 		return err
 	}
 
+	batch := new(leveldb.Batch)
+	batch.Delete([]byte(id))
+	deleteSortIndex(batch, old)
+	err = s.addEvent(batch, outboxEvent{Type: wot.EventTypeDelete, Old: old})
+	if err != nil {
+		return err
+	}
+	err = s.db.Write(batch, nil)
+	if err != nil {
+		return err
+	}
+	s.total--
 	return nil
 }
 
-func (s *LevelDBStorage) delete(id string) error {
-	found, err := s.db.Has([]byte(id), nil)
+func (s *LevelDBStorage) expiring(id string, expires time.Time) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	td, err := s.get(id)
 	if err != nil {
 		return err
 	}
-	if !found {
-		return &NotFoundError{id + " is not found"}
+	// renewed or deleted since the expiry was checked
+	if current := ThingExpires(ThingRegistration(td)); current == nil || !current.Equal(expires) {
+		return nil
 	}
 
-	err = s.db.Delete([]byte(id), nil)
+	batch := new(leveldb.Batch)
+	err = s.addEvent(batch, outboxEvent{Type: wot.EventTypeExpiring, New: td})
 	if err != nil {
 		return err
 	}
+	return s.db.Write(batch, nil)
+}
+
+// addEvent adds the event to the outbox in the batch of the change. It must be called with the write lock held.
+func (s *LevelDBStorage) addEvent(batch *leveldb.Batch, event outboxEvent) error {
+	event.ID = s.eventSeq + 1
+	bytes, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("error marshalling event: %w", err)
+	}
+	// ids are not reused even if the batch fails
+	s.eventSeq = event.ID
 
+	batch.Put(outboxKey(event.ID), bytes)
+	seq := make([]byte, 8)
+	binary.BigEndian.PutUint64(seq, event.ID)
+	batch.Put(eventSeqKey, seq)
 	return nil
 }
 
+func (s *LevelDBStorage) outbox(after uint64, limit int) ([]outboxEvent, error) {
+	s.wg.Add(1)
+	defer s.wg.Done()
+	iter := s.db.NewIterator(&util.Range{Start: outboxKey(after + 1), Limit: util.BytesPrefix(outboxPrefix).Limit}, nil)
+	defer iter.Release()
+
+	var events []outboxEvent
+	for len(events) < limit && iter.Next() {
+		var event outboxEvent
+		err := json.Unmarshal(iter.Value(), &event)
+		if err != nil {
+			return nil, fmt.Errorf("error unmarshalling event: %w", err)
+		}
+		events = append(events, event)
+	}
+	err := iter.Error()
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (s *LevelDBStorage) removeEvents(upTo uint64) error {
+	s.wg.Add(1)
+	defer s.wg.Done()
+	iter := s.db.NewIterator(&util.Range{Start: outboxPrefix, Limit: outboxKey(upTo + 1)}, nil)
+	defer iter.Release()
+
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		batch.Delete(append([]byte(nil), iter.Key()...))
+	}
+	err := iter.Error()
+	if err != nil {
+		return err
+	}
+	return s.db.Write(batch, nil)
+}
+
+// outboxKey is sorted by the event id
+func outboxKey(id uint64) []byte {
+	key := make([]byte, len(outboxPrefix)+8)
+	copy(key, outboxPrefix)
+	binary.BigEndian.PutUint64(key[len(outboxPrefix):], id)
+	return key
+}
+
 func (s *LevelDBStorage) listPaginate(offset, limit int) ([]ThingDescription, error) {
 
 	// TODO: is there a better way to do this?
 	TDs := make([]ThingDescription, 0, limit)
 	s.wg.Add(1)
-	iter := s.db.NewIterator(nil, nil)
+	iter := s.db.NewIterator(tdRange, nil)
 
 	for i := 0; i < offset+limit && iter.Next(); i++ {
 		if i >= offset && i < offset+limit {
@@ -147,10 +373,171 @@ func (s *LevelDBStorage) listPaginate(offset, limit int) ([]ThingDescription, er
 	return TDs, nil
 }
 
+func (s *LevelDBStorage) listAfter(id string, limit int) ([]ThingDescription, error) {
+
+	TDs := make([]ThingDescription, 0, limit)
+	s.wg.Add(1)
+	defer s.wg.Done()
+	// start from the key right after the given id
+	iter := s.db.NewIterator(&util.Range{Start: append([]byte(id), 0), Limit: tdRange.Limit}, nil)
+	defer iter.Release()
+
+	for i := 0; i < limit && iter.Next(); i++ {
+		var td ThingDescription
+		err := json.Unmarshal(iter.Value(), &td)
+		if err != nil {
+			return nil, err
+		}
+		TDs = append(TDs, td)
+	}
+	err := iter.Error()
+	if err != nil {
+		return nil, err
+	}
+
+	return TDs, nil
+}
+
+// listSorted returns the TDs in the order of an indexed sort field or by descending ids, after the key or from the offset
+// The TDs are read in the order of the index from a snapshot, without reading the others.
+func (s *LevelDBStorage) listSorted(sorting *Sorting, after *sortKey, offset, limit int) ([]ThingDescription, error) {
+	if !sorting.isIndexed() {
+		return nil, fmt.Errorf("sort field %s is not indexed", sorting.Field)
+	}
+
+	s.wg.Add(1)
+	defer s.wg.Done()
+	snapshot, err := s.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snapshot.Release()
+
+	// the values of the id range are the TDs and those of the sort index are the ids
+	byID := sorting.Field == SortByID
+	var ranges []*util.Range
+	if byID {
+		ranges = []*util.Range{{Limit: tdRange.Limit}}
+		if after != nil {
+			ranges[0] = &util.Range{Limit: []byte(after.id)}
+			if !sorting.Descending {
+				ranges[0] = &util.Range{Start: append([]byte(after.id), 0), Limit: tdRange.Limit}
+			}
+		}
+	} else {
+		ranges = sortIndexRanges(sorting, after)
+	}
+
+	TDs := make([]ThingDescription, 0, limit)
+	for _, r := range ranges {
+		iter := snapshot.NewIterator(r, nil)
+		first, next := iter.First, iter.Next
+		if sorting.Descending {
+			first, next = iter.Last, iter.Prev
+		}
+		for ok := first(); ok && len(TDs) < limit; ok = next() {
+			if offset > 0 {
+				offset--
+				continue
+			}
+			value := iter.Value()
+			if !byID {
+				value, err = snapshot.Get(iter.Value(), nil)
+				if err != nil {
+					iter.Release()
+					return nil, fmt.Errorf("error reading %s of the sort index: %w", iter.Value(), err)
+				}
+			}
+			var td ThingDescription
+			err = json.Unmarshal(value, &td)
+			if err != nil {
+				iter.Release()
+				return nil, err
+			}
+			TDs = append(TDs, td)
+		}
+		iter.Release()
+		err = iter.Error()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return TDs, nil
+}
+
+// sortIndexKey is ordered by the value of the sort field and then by the id.
+// The keys of the TDs without the value are in a separate range, ordered by the id.
+func sortIndexKey(field string, k sortKey) []byte {
+	key := append(append([]byte{}, sortIndexPrefix...), field...)
+	if k.missing {
+		key = append(key, "/m"...)
+	} else {
+		key = append(key, "/t"...)
+		// nanoseconds with the sign bit flipped are ordered as unsigned integers
+		t := make([]byte, 8)
+		binary.BigEndian.PutUint64(t, uint64(k.time.UnixNano())^(1<<63))
+		key = append(key, t...)
+	}
+	return append(key, k.id...)
+}
+
+// sortIndexRanges returns the ranges of the index entries after the key, in the order of the sorting.
+// The entries without the value come last in both orders.
+func sortIndexRanges(sorting *Sorting, after *sortKey) []*util.Range {
+	prefix := append(append([]byte{}, sortIndexPrefix...), sorting.Field...)
+	ranges := []*util.Range{
+		util.BytesPrefix(append(append([]byte{}, prefix...), "/t"...)),
+		util.BytesPrefix(append(append([]byte{}, prefix...), "/m"...)),
+	}
+	if after == nil {
+		return ranges
+	}
+	if after.missing {
+		ranges = ranges[1:]
+	}
+	key := sortIndexKey(sorting.Field, *after)
+	if sorting.Descending {
+		ranges[0].Limit = key
+	} else {
+		ranges[0].Start = append(key, 0)
+	}
+	return ranges
+}
+
+// putSortIndex adds the index entries of the serialized TD to the batch
+func putSortIndex(batch *leveldb.Batch, b []byte) error {
+	// the sort keys are read from the TD as stored
+	var td ThingDescription
+	err := json.Unmarshal(b, &td)
+	if err != nil {
+		return err
+	}
+	for _, field := range sortIndexFields {
+		k := (&Sorting{Field: field}).key(td)
+		batch.Put(sortIndexKey(field, k), []byte(k.id))
+	}
+	return nil
+}
+
+// deleteSortIndex adds the deletion of the index entries of the stored TD to the batch
+func deleteSortIndex(batch *leveldb.Batch, td ThingDescription) {
+	for _, field := range sortIndexFields {
+		batch.Delete(sortIndexKey(field, (&Sorting{Field: field}).key(td)))
+	}
+}
+
+// count returns the number of TDs without reading them
+func (s *LevelDBStorage) count() (int, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	return s.total, nil
+}
+
 func (s *LevelDBStorage) listAllBytes() ([]byte, error) {
 
 	s.wg.Add(1)
-	iter := s.db.NewIterator(nil, nil)
+	iter := s.db.NewIterator(tdRange, nil)
 
 	var buffer bytes.Buffer
 	buffer.WriteString("[")
@@ -184,7 +571,7 @@ func (s *LevelDBStorage) iterate() <-chan ThingDescription {
 
 		s.wg.Add(1)
 		defer s.wg.Done()
-		iter := s.db.NewIterator(nil, nil)
+		iter := s.db.NewIterator(tdRange, nil)
 		defer iter.Release()
 
 		for iter.Next() {
@@ -214,7 +601,7 @@ func (s *LevelDBStorage) iterateBytes(ctx context.Context) <-chan []byte {
 
 		s.wg.Add(1)
 		defer s.wg.Done()
-		iter := s.db.NewIterator(nil, nil)
+		iter := s.db.NewIterator(tdRange, nil)
 		defer iter.Release()
 
 	Loop:
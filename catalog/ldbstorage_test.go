@@ -0,0 +1,126 @@
+package catalog
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// tempStorageDir returns a directory for the storage, which is removed after the test
+func tempStorageDir(t *testing.T) string {
+	tempDir := fmt.Sprintf("%s/thing-directory/test-%s-ldb",
+		strings.Replace(os.TempDir(), "\\", "/", -1), uuid.NewV4())
+	t.Cleanup(func() {
+		err := os.RemoveAll(tempDir)
+		if err != nil {
+			t.Fatalf("error removing test files: %s", err)
+		}
+	})
+	return tempDir
+}
+
+func TestLevelDBStorageCount(t *testing.T) {
+	tempDir := tempStorageDir(t)
+	storage, err := NewLevelDBStorage(tempDir, nil)
+	if err != nil {
+		t.Fatalf("error creating leveldb storage: %s", err)
+	}
+
+	expectCount := func(t *testing.T, storage Storage, expected int) {
+		total, err := storage.count()
+		if err != nil {
+			t.Fatalf("error counting TDs: %s", err)
+		}
+		if total != expected {
+			t.Fatalf("Expected %d TDs but got %d", expected, total)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		id := fmt.Sprintf("urn:example:test/thing_%d", i)
+		err = storage.add(id, ThingDescription{"id": id})
+		if err != nil {
+			t.Fatalf("error adding TD: %s", err)
+		}
+	}
+	// not counted twice
+	err = storage.update("urn:example:test/thing_0", ThingDescription{"id": "urn:example:test/thing_0"})
+	if err != nil {
+		t.Fatalf("error updating TD: %s", err)
+	}
+	err = storage.add("urn:example:test/thing_0", ThingDescription{"id": "urn:example:test/thing_0"})
+	if _, ok := err.(*ConflictError); !ok {
+		t.Fatalf("Expected ConflictError but got: %v", err)
+	}
+	err = storage.delete("urn:example:test/thing_1")
+	if err != nil {
+		t.Fatalf("error deleting TD: %s", err)
+	}
+	expectCount(t, storage, 2)
+
+	// counted on open
+	storage.Close()
+	storage, err = NewLevelDBStorage(tempDir, nil)
+	if err != nil {
+		t.Fatalf("error opening leveldb storage: %s", err)
+	}
+	defer storage.Close()
+	expectCount(t, storage, 2)
+}
+
+func TestLevelDBStorageSortIndex(t *testing.T) {
+	tempDir := tempStorageDir(t)
+	storage, err := NewLevelDBStorage(tempDir, nil)
+	if err != nil {
+		t.Fatalf("error creating leveldb storage: %s", err)
+	}
+	for i, created := range []string{"2021-01-03T00:00:00Z", "2021-01-01T00:00:00Z", "2021-01-02T00:00:00Z"} {
+		id := fmt.Sprintf("urn:example:test/thing_%d", i)
+		err = storage.add(id, ThingDescription{"id": id, "registration": map[string]interface{}{"created": created}})
+		if err != nil {
+			t.Fatalf("error adding TD: %s", err)
+		}
+	}
+
+	listIDs := func(t *testing.T, storage Storage) []string {
+		tds, err := storage.listSorted(&Sorting{Field: SortByCreated}, nil, 0, 10)
+		if err != nil {
+			t.Fatalf("error listing TDs: %s", err)
+		}
+		var ids []string
+		for _, td := range tds {
+			ids = append(ids, strings.TrimPrefix(td["id"].(string), "urn:example:test/thing_"))
+		}
+		return ids
+	}
+	expected := []string{"1", "2", "0"}
+	if ids := listIDs(t, storage); !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("Expected order %v but got %v", expected, ids)
+	}
+
+	// the index of a database without it is built on open
+	ldb := storage.(*LevelDBStorage)
+	iter := ldb.db.NewIterator(util.BytesPrefix(sortIndexPrefix), nil)
+	for iter.Next() {
+		err = ldb.db.Delete(iter.Key(), nil)
+		if err != nil {
+			t.Fatalf("error deleting the index: %s", err)
+		}
+	}
+	iter.Release()
+	storage.Close()
+
+	storage, err = NewLevelDBStorage(tempDir, nil)
+	if err != nil {
+		t.Fatalf("error opening leveldb storage: %s", err)
+	}
+	defer storage.Close()
+	if ids := listIDs(t, storage); !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("Expected order %v after rebuilding the index but got %v", expected, ids)
+	}
+}
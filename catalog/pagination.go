@@ -0,0 +1,80 @@
+package catalog
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Pagination selects a page of listed TDs, either by offset or after a continuation token
+type Pagination struct {
+	Offset int
+	Limit  int
+	// After is the continuation token returned as Page.Next
+	After string
+}
+
+// Page is a page of listed TDs
+type Page struct {
+	Items []ThingDescription
+	// Total is the number of all listed TDs
+	Total int
+	// Next is the continuation token for the next page. It is empty on the last page.
+	Next string
+}
+
+// cursor is the decoded continuation token. It holds the sort key of the last TD in a page.
+type cursor struct {
+	Sort       string     `json:"s"`
+	Descending bool       `json:"d,omitempty"`
+	ID         string     `json:"id"`
+	Value      string     `json:"v,omitempty"`
+	Time       *time.Time `json:"t,omitempty"`
+	Missing    bool       `json:"m,omitempty"`
+}
+
+func encodeCursor(sorting *Sorting, td ThingDescription) string {
+	k := sorting.key(td)
+	c := cursor{
+		Sort:       sorting.Field,
+		Descending: sorting.Descending,
+		ID:         k.id,
+		Value:      k.str,
+		Missing:    k.missing,
+	}
+	if !k.time.IsZero() {
+		c.Time = &k.time
+	}
+
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor returns the sort key of the token, which must have been created for the same sorting
+func decodeCursor(token string, sorting *Sorting) (sortKey, error) {
+	invalid := &BadRequestError{fmt.Sprintf("invalid continuation token: %s", token)}
+
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return sortKey{}, invalid
+	}
+	var c cursor
+	err = json.Unmarshal(b, &c)
+	if err != nil {
+		return sortKey{}, invalid
+	}
+	if c.Sort != sorting.Field || c.Descending != sorting.Descending {
+		return sortKey{}, &BadRequestError{"continuation token was created with a different sorting"}
+	}
+
+	k := sortKey{
+		id:      c.ID,
+		str:     c.Value,
+		missing: c.Missing,
+	}
+	if c.Time != nil {
+		k.time = *c.Time
+	}
+	return k, nil
+}
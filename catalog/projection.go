@@ -0,0 +1,102 @@
+package catalog
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tinyiot/thing-directory/wot"
+)
+
+// Projection selects parts of TDs to produce partial TDs
+// The TD id is always selected. The registration is only selected when requested.
+type Projection struct {
+	// all selects the whole value
+	all    bool
+	fields map[string]*Projection
+}
+
+// NewProjection creates a projection from JSON Pointers (e.g. "/properties/temperature") or dot-separated paths (e.g. "properties.temperature")
+// Paths into arrays apply to all array items e.g. "forms.href"
+func NewProjection(fields []string) (*Projection, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	p := &Projection{fields: make(map[string]*Projection)}
+	p.add([]string{wot.KeyThingID})
+	for _, field := range fields {
+		var path []string
+		if strings.HasPrefix(field, "/") {
+			// JSON Pointer (RFC 6901)
+			for _, token := range strings.Split(field[1:], "/") {
+				path = append(path, strings.NewReplacer("~1", "/", "~0", "~").Replace(token))
+			}
+		} else {
+			path = strings.Split(field, ".")
+		}
+		for _, key := range path {
+			if key == "" {
+				return nil, &BadRequestError{fmt.Sprintf("invalid field: %s", field)}
+			}
+		}
+		p.add(path)
+	}
+	return p, nil
+}
+
+func (p *Projection) add(path []string) {
+	if p.all {
+		return
+	}
+	if len(path) == 0 {
+		p.all, p.fields = true, nil
+		return
+	}
+	if p.fields == nil {
+		p.fields = make(map[string]*Projection)
+	}
+	child, found := p.fields[path[0]]
+	if !found {
+		child = &Projection{}
+		p.fields[path[0]] = child
+	}
+	child.add(path[1:])
+}
+
+// apply returns the partial TD. A nil projection returns the TD as is.
+func (p *Projection) apply(td ThingDescription) ThingDescription {
+	if p == nil {
+		return td
+	}
+	partial, _ := p.project(map[string]interface{}(td))
+	return partial.(map[string]interface{})
+}
+
+// project returns the selected parts of the value and false if nothing is selected
+func (p *Projection) project(v interface{}) (interface{}, bool) {
+	if p.all {
+		return v, true
+	}
+	switch value := v.(type) {
+	case map[string]interface{}:
+		partial := make(map[string]interface{}, len(p.fields))
+		for key, child := range p.fields {
+			if fieldValue, found := value[key]; found {
+				if projected, ok := child.project(fieldValue); ok {
+					partial[key] = projected
+				}
+			}
+		}
+		return partial, true
+	case []interface{}:
+		partial := make([]interface{}, 0, len(value))
+		for i := range value {
+			if projected, ok := p.project(value[i]); ok {
+				partial = append(partial, projected)
+			}
+		}
+		return partial, true
+	}
+	// scalars have no fields
+	return nil, false
+}
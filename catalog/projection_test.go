@@ -0,0 +1,86 @@
+package catalog
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestProjection(t *testing.T) {
+	var td ThingDescription
+	err := json.Unmarshal([]byte(`{
+		"@context": "https://www.w3.org/2019/wot/td/v1",
+		"@type": "saref:Sensor",
+		"id": "urn:example:test/thing1",
+		"title": "example thing",
+		"properties": {
+			"temperature": {
+				"type": "number",
+				"forms": [{"href": "coap://example.com/temp", "op": "readproperty"}, {"href": "http://example.com/temp"}]
+			},
+			"humidity": {"type": "number", "forms": [{"href": "http://example.com/hum"}]}
+		},
+		"registration": {"created": "2020-01-01T00:00:00Z"}
+	}`), &td)
+	if err != nil {
+		t.Fatal("Error unmarshalling TD:", err.Error())
+	}
+
+	tests := map[string]struct {
+		fields   []string
+		expected string
+	}{
+		"dotted paths": {
+			fields:   []string{"title", "@type"},
+			expected: `{"@type":"saref:Sensor","id":"urn:example:test/thing1","title":"example thing"}`,
+		},
+		"json pointers": {
+			fields:   []string{"/properties/temperature/type", "/registration"},
+			expected: `{"id":"urn:example:test/thing1","properties":{"temperature":{"type":"number"}},"registration":{"created":"2020-01-01T00:00:00Z"}}`,
+		},
+		"array items": {
+			fields:   []string{"properties.temperature.forms.href"},
+			expected: `{"id":"urn:example:test/thing1","properties":{"temperature":{"forms":[{"href":"coap://example.com/temp"},{"href":"http://example.com/temp"}]}}}`,
+		},
+		"overlapping paths": {
+			fields:   []string{"properties.humidity.type", "properties.humidity"},
+			expected: `{"id":"urn:example:test/thing1","properties":{"humidity":{"forms":[{"href":"http://example.com/hum"}],"type":"number"}}}`,
+		},
+		"missing": {
+			fields:   []string{"description", "title.x"},
+			expected: `{"id":"urn:example:test/thing1"}`,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			p, err := NewProjection(test.fields)
+			if err != nil {
+				t.Fatal("Error creating projection:", err.Error())
+			}
+			b, err := json.Marshal(p.apply(td))
+			if err != nil {
+				t.Fatal("Error marshalling partial TD:", err.Error())
+			}
+			if string(b) != test.expected {
+				t.Fatalf("Expected:\n%s\nbut got:\n%s", test.expected, b)
+			}
+		})
+	}
+
+	t.Run("no fields", func(t *testing.T) {
+		p, err := NewProjection(nil)
+		if err != nil {
+			t.Fatal("Error creating projection:", err.Error())
+		}
+		if !reflect.DeepEqual(p.apply(td), td) {
+			t.Fatal("TD is changed without any fields")
+		}
+	})
+
+	t.Run("invalid field", func(t *testing.T) {
+		_, err := NewProjection([]string{"properties..type"})
+		if _, ok := err.(*BadRequestError); !ok {
+			t.Fatalf("Expected BadRequestError but got: %v", err)
+		}
+	})
+}
@@ -0,0 +1,140 @@
+package catalog
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tinyiot/thing-directory/wot"
+)
+
+const (
+	// Sort fields
+	SortByID       = "id"
+	SortByTitle    = "title"
+	SortByCreated  = "registration.created"
+	SortByModified = "registration.modified"
+	SortByExpires  = "registration.expires"
+	// Sort orders
+	SortOrderAsc  = "asc"
+	SortOrderDesc = "desc"
+)
+
+// Sorting defines the order of listed TDs
+// TDs with equal values are ordered by id to keep the pages stable. TDs without the value come last.
+type Sorting struct {
+	Field      string
+	Descending bool
+}
+
+// NewSorting validates the sort field and order
+func NewSorting(field, order string) (*Sorting, error) {
+	switch field {
+	case SortByID, SortByTitle, SortByCreated, SortByModified, SortByExpires:
+	default:
+		return nil, &BadRequestError{fmt.Sprintf("unsupported sort field: %s", field)}
+	}
+
+	s := Sorting{Field: field}
+	switch strings.ToLower(order) {
+	case "", SortOrderAsc:
+	case SortOrderDesc:
+		s.Descending = true
+	default:
+		return nil, &BadRequestError{fmt.Sprintf("unsupported sort order: %s", order)}
+	}
+
+	return &s, nil
+}
+
+// isStorageOrder returns true if the sorting matches the storage order (ascending ids)
+func (s *Sorting) isStorageOrder() bool {
+	return s == nil || (s.Field == SortByID && !s.Descending)
+}
+
+// isIndexed returns true if the storage lists the TDs in the order of the sorting without reading all of them
+func (s *Sorting) isIndexed() bool {
+	return s == nil || s.Field != SortByTitle
+}
+
+// sortKey is the precomputed value of the sort field of a TD
+type sortKey struct {
+	id      string
+	str     string
+	time    time.Time
+	missing bool
+}
+
+func (s *Sorting) key(td ThingDescription) sortKey {
+	k := sortKey{}
+	k.id, _ = td[wot.KeyThingID].(string)
+
+	switch s.Field {
+	case SortByID:
+		k.str = k.id
+	case SortByTitle:
+		title, ok := td["title"].(string)
+		k.str, k.missing = strings.ToLower(title), !ok
+	default:
+		var t *time.Time
+		if tr := ThingRegistration(td); tr != nil {
+			switch s.Field {
+			case SortByCreated:
+				t = tr.Created
+			case SortByModified:
+				t = tr.Modified
+			case SortByExpires:
+				t = tr.Expires
+			}
+		}
+		if t != nil {
+			k.time = *t
+		} else {
+			k.missing = true
+		}
+	}
+	return k
+}
+
+// less orders by the sort field and then by id
+func (s *Sorting) less(a, b sortKey) bool {
+	if a.missing != b.missing {
+		return b.missing
+	}
+	if !a.missing {
+		if !a.time.Equal(b.time) {
+			return a.time.Before(b.time) != s.Descending
+		}
+		if a.str != b.str {
+			return (a.str < b.str) != s.Descending
+		}
+	}
+	if a.id == b.id {
+		return false
+	}
+	return (a.id < b.id) != s.Descending
+}
+
+// sort orders the TDs in place and returns their sort keys in the same order
+func (s *Sorting) sort(tds []ThingDescription) []sortKey {
+	keys := make([]sortKey, len(tds))
+	for i := range tds {
+		keys[i] = s.key(tds[i])
+	}
+	sort.Sort(sortableTDs{tds: tds, keys: keys, sorting: s})
+	return keys
+}
+
+type sortableTDs struct {
+	tds     []ThingDescription
+	keys    []sortKey
+	sorting *Sorting
+}
+
+func (s sortableTDs) Len() int           { return len(s.tds) }
+func (s sortableTDs) Less(i, j int) bool { return s.sorting.less(s.keys[i], s.keys[j]) }
+func (s sortableTDs) Swap(i, j int) {
+	s.tds[i], s.tds[j] = s.tds[j], s.tds[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
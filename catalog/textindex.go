@@ -0,0 +1,231 @@
+package catalog
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/analysis/analyzer/standard"
+	_ "github.com/blevesearch/bleve/analysis/lang/da"
+	_ "github.com/blevesearch/bleve/analysis/lang/de"
+	_ "github.com/blevesearch/bleve/analysis/lang/en"
+	_ "github.com/blevesearch/bleve/analysis/lang/es"
+	_ "github.com/blevesearch/bleve/analysis/lang/fi"
+	_ "github.com/blevesearch/bleve/analysis/lang/fr"
+	_ "github.com/blevesearch/bleve/analysis/lang/hu"
+	_ "github.com/blevesearch/bleve/analysis/lang/it"
+	_ "github.com/blevesearch/bleve/analysis/lang/nl"
+	_ "github.com/blevesearch/bleve/analysis/lang/no"
+	_ "github.com/blevesearch/bleve/analysis/lang/pt"
+	_ "github.com/blevesearch/bleve/analysis/lang/ro"
+	_ "github.com/blevesearch/bleve/analysis/lang/ru"
+	_ "github.com/blevesearch/bleve/analysis/lang/sv"
+	_ "github.com/blevesearch/bleve/analysis/lang/tr"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/blevesearch/bleve/search/highlight/highlighter/html"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+const (
+	// fields of the text index documents
+	textFieldTitle        = "title"
+	textFieldTitles       = "titles"
+	textFieldDescription  = "description"
+	textFieldDescriptions = "descriptions"
+	textFieldProperties   = "properties"
+	textFieldActions      = "actions"
+	textFieldEvents       = "events"
+	textFieldAll          = "_all"
+
+	// boost of matches in the default language title
+	textTitleBoost = 3.0
+)
+
+// textLanguages are the languages with language-specific analyzers (stemming, stop words)
+// The keys of the multi-language titles and descriptions are matched against these after dropping the region subtag
+var textLanguages = []string{"da", "de", "en", "es", "fi", "fr", "hu", "it", "nl", "no", "pt", "ro", "ru", "sv", "tr"}
+
+// TextSearchResult is the ranked result of a full-text search
+type TextSearchResult struct {
+	Total uint64          `json:"total"`
+	Hits  []TextSearchHit `json:"hits"`
+}
+
+// TextSearchHit is a matching TD with its score and highlighted fragments
+type TextSearchHit struct {
+	ID         string              `json:"id"`
+	Score      float64             `json:"score"`
+	Highlights map[string][]string `json:"highlights,omitempty"`
+	TD         ThingDescription    `json:"td"`
+}
+
+// textIndex is an embedded full-text index over human-readable TD fields
+type textIndex struct {
+	idx bleve.Index
+}
+
+func newTextIndex() (*textIndex, error) {
+	index, err := bleve.NewMemOnly(newTextIndexMapping())
+	if err != nil {
+		return nil, fmt.Errorf("error creating text index: %s", err)
+	}
+	return &textIndex{idx: index}, nil
+}
+
+func newTextIndexMapping() *mapping.IndexMappingImpl {
+	textField := func(analyzer string) *mapping.FieldMapping {
+		f := bleve.NewTextFieldMapping()
+		f.Analyzer = analyzer
+		return f
+	}
+
+	// language-specific analysis of multi-language fields
+	titles := bleve.NewDocumentMapping()
+	descriptions := bleve.NewDocumentMapping()
+	for _, lang := range textLanguages {
+		titles.AddFieldMappingsAt(lang, textField(lang))
+		descriptions.AddFieldMappingsAt(lang, textField(lang))
+	}
+
+	doc := bleve.NewDocumentMapping()
+	doc.AddFieldMappingsAt(textFieldTitle, textField(standard.Name))
+	doc.AddFieldMappingsAt(textFieldDescription, textField(standard.Name))
+	doc.AddFieldMappingsAt(textFieldProperties, textField(standard.Name))
+	doc.AddFieldMappingsAt(textFieldActions, textField(standard.Name))
+	doc.AddFieldMappingsAt(textFieldEvents, textField(standard.Name))
+	doc.AddSubDocumentMapping(textFieldTitles, titles)
+	doc.AddSubDocumentMapping(textFieldDescriptions, descriptions)
+
+	m := bleve.NewIndexMapping()
+	m.DefaultMapping = doc
+	m.DefaultAnalyzer = standard.Name
+	return m
+}
+
+// index adds or replaces the document of the given TD
+func (i *textIndex) index(id string, td ThingDescription) error {
+	return i.idx.Index(id, textDocument(td))
+}
+
+// remove deletes the document of the given TD
+func (i *textIndex) remove(id string) error {
+	return i.idx.Delete(id)
+}
+
+// search runs a ranked search and returns the hits in the given page
+// If lang is set, matches in titles and descriptions of that language are preferred
+func (i *textIndex) search(q, lang string, offset, limit int) (*bleve.SearchResult, error) {
+	var queries []query.Query
+
+	all := bleve.NewMatchQuery(q)
+	all.SetField(textFieldAll)
+	queries = append(queries, all)
+
+	title := bleve.NewMatchQuery(q)
+	title.SetField(textFieldTitle)
+	title.SetBoost(textTitleBoost)
+	queries = append(queries, title)
+
+	// match language-specific fields with their analyzers to find inflected forms
+	lang = textLanguage(lang)
+	for _, l := range textLanguages {
+		if lang != "" && l != lang {
+			continue
+		}
+		for _, field := range []string{textFieldTitles, textFieldDescriptions} {
+			mq := bleve.NewMatchQuery(q)
+			mq.SetField(field + "." + l)
+			if field == textFieldTitles {
+				mq.SetBoost(textTitleBoost)
+			}
+			queries = append(queries, mq)
+		}
+	}
+
+	req := bleve.NewSearchRequestOptions(bleve.NewDisjunctionQuery(queries...), limit, offset, false)
+	req.Highlight = bleve.NewHighlightWithStyle(html.Name)
+	return i.idx.Search(req)
+}
+
+func (i *textIndex) close() error {
+	return i.idx.Close()
+}
+
+// textDocument extracts the human-readable fields of a TD
+func textDocument(td ThingDescription) map[string]interface{} {
+	doc := make(map[string]interface{})
+
+	if title, ok := td[textFieldTitle].(string); ok {
+		doc[textFieldTitle] = title
+	}
+	if description, ok := td[textFieldDescription].(string); ok {
+		doc[textFieldDescription] = description
+	}
+	if titles := textLanguageMap(td[textFieldTitles]); len(titles) > 0 {
+		doc[textFieldTitles] = titles
+	}
+	if descriptions := textLanguageMap(td[textFieldDescriptions]); len(descriptions) > 0 {
+		doc[textFieldDescriptions] = descriptions
+	}
+
+	for _, field := range []string{textFieldProperties, textFieldActions, textFieldEvents} {
+		affordances, ok := td[field].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		var texts []string
+		for name, a := range affordances {
+			text := []string{name}
+			if affordance, ok := a.(map[string]interface{}); ok {
+				if title, ok := affordance[textFieldTitle].(string); ok {
+					text = append(text, title)
+				}
+				if description, ok := affordance[textFieldDescription].(string); ok {
+					text = append(text, description)
+				}
+			}
+			texts = append(texts, strings.Join(text, " "))
+		}
+		if len(texts) > 0 {
+			doc[field] = texts
+		}
+	}
+
+	return doc
+}
+
+// textLanguageMap groups the values of a multi-language map by language
+func textLanguageMap(v interface{}) map[string]interface{} {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	grouped := make(map[string]interface{})
+	for tag, text := range m {
+		s, ok := text.(string)
+		if !ok {
+			continue
+		}
+		lang := strings.ToLower(strings.SplitN(tag, "-", 2)[0])
+		switch existing := grouped[lang].(type) {
+		case nil:
+			grouped[lang] = s
+		case string:
+			grouped[lang] = []string{existing, s}
+		case []string:
+			grouped[lang] = append(existing, s)
+		}
+	}
+	return grouped
+}
+
+// textLanguage returns the supported language of a language tag, or an empty string
+func textLanguage(tag string) string {
+	lang := strings.ToLower(strings.SplitN(tag, "-", 2)[0])
+	for _, l := range textLanguages {
+		if l == lang {
+			return l
+		}
+	}
+	return ""
+}
@@ -10,15 +10,19 @@ import (
 	"github.com/linksmart/go-sec/auth/obtainer"
 	"github.com/linksmart/go-sec/auth/validator"
 	"github.com/tinyiot/thing-directory/catalog"
+	"github.com/tinyiot/thing-directory/notification"
 )
 
 type Config struct {
-	ServiceID   string        `json:"serviceID"`
-	Description string        `json:"description"`
-	Validation  Validation    `json:"validation"`
-	HTTP        HTTPConfig    `json:"http"`
-	DNSSD       DNSSDConfig   `json:"dnssd"`
-	Storage     StorageConfig `json:"storage"`
+	ServiceID   string                  `json:"serviceID"`
+	Description string                  `json:"description"`
+	Validation  Validation              `json:"validation"`
+	HTTP        HTTPConfig              `json:"http"`
+	DNSSD       DNSSDConfig             `json:"dnssd"`
+	Storage     StorageConfig           `json:"storage"`
+	Search      SearchConfig            `json:"search"`
+	Events      EventsConfig            `json:"events"`
+	MQTT        notification.MQTTConfig `json:"mqtt"`
 }
 
 type Validation struct {
@@ -61,6 +65,26 @@ type StorageConfig struct {
 	DSN  string `json:"dsn"`
 }
 
+type SearchConfig struct {
+	// GeoLocations are the paths to coordinates in TDs, tried in order
+	GeoLocations []catalog.GeoLocation `json:"geoLocations"`
+}
+
+type EventsConfig struct {
+	// SubscriberQueue bounds the events buffered for each subscriber that is slower than the events
+	SubscriberQueue notification.QueueConfig `json:"subscriberQueue"`
+	// Retention limits the events kept for replaying to the subscribers that reconnect
+	Retention notification.RetentionConfig `json:"retention"`
+	// ExpiryWarning is the time in seconds before the expiry of a registration to send the thing_expiring event. Disabled when 0.
+	ExpiryWarning int `json:"expiryWarning"`
+	// SSE configures the heartbeats, reconnection time, and the limit of the Server-Sent Events streams
+	SSE notification.SSEConfig `json:"sse"`
+	// WebSocket restricts the origins of the WebSocket connections from browsers
+	WebSocket notification.WebSocketConfig `json:"websocket"`
+	// Webhooks restricts the addresses of the callbacks. The private and other local networks are denied by default.
+	Webhooks notification.WebhookConfig `json:"webhooks"`
+}
+
 var supportedBackends = map[string]bool{
 	catalog.BackendMemory:  false,
 	catalog.BackendLevelDB: true,
@@ -90,6 +114,30 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("unsupported storage backend")
 	}
 
+	switch c.Events.SubscriberQueue.Overflow {
+	case "", notification.OverflowDropOldest, notification.OverflowDisconnect:
+	default:
+		return fmt.Errorf("unsupported subscriber queue overflow policy: %s", c.Events.SubscriberQueue.Overflow)
+	}
+	if c.Events.Retention.MaxAge < 0 {
+		return fmt.Errorf("negative event retention maxAge: %d", c.Events.Retention.MaxAge)
+	}
+	if c.Events.ExpiryWarning < 0 {
+		return fmt.Errorf("negative event expiryWarning: %d", c.Events.ExpiryWarning)
+	}
+	if c.Events.SSE.Heartbeat < 0 || c.Events.SSE.Retry < 0 || c.Events.SSE.MaxSubscribers < 0 {
+		return fmt.Errorf("negative event SSE heartbeat, retry, or maxSubscribers")
+	}
+
+	if c.MQTT.Enabled {
+		if c.MQTT.BrokerURL == "" {
+			return fmt.Errorf("MQTT brokerURL has to be defined")
+		}
+		if c.MQTT.QoS > 2 {
+			return fmt.Errorf("MQTT qos should be 0, 1, or 2")
+		}
+	}
+
 	return err
 }
 
@@ -5,17 +5,21 @@ go 1.14
 require (
 	github.com/antchfx/jsonquery v1.1.4
 	github.com/bhmj/jsonslice v0.0.0-20200507101114-bc37219df21b
+	github.com/blevesearch/bleve v1.0.14
 	github.com/codegangsta/negroni v1.0.0
 	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/eclipse/paho.mqtt.golang v1.3.5
 	github.com/evanphx/json-patch/v5 v5.1.0
 	github.com/gorilla/context v1.1.1
 	github.com/gorilla/mux v1.7.3
+	github.com/gorilla/websocket v1.4.2
 	github.com/grandcat/zeroconf v1.0.1-0.20200528163356-cfc8183341d9
 	github.com/justinas/alice v0.0.0-20160512134231-052b8b6c18ed
 	github.com/kelseyhightower/envconfig v1.4.0
 	github.com/linksmart/go-sec v1.4.2
 	github.com/linksmart/service-catalog/v3 v3.0.0-beta.1.0.20200302143206-92739dd2a511
 	github.com/miekg/dns v1.1.29 // indirect
+	github.com/mochi-co/mqtt v1.0.0
 	github.com/onsi/ginkgo v1.12.0 // indirect
 	github.com/onsi/gomega v1.9.0 // indirect
 	github.com/rs/cors v1.7.0
@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/codegangsta/negroni"
 	"github.com/gorilla/context"
@@ -92,11 +93,15 @@ func main() {
 		panic("Could not create catalog API storage. Unsupported type:" + config.Storage.Type)
 	}
 
-	controller, err := catalog.NewController(storage)
+	geoLocations := config.Search.GeoLocations
+	if len(geoLocations) == 0 {
+		geoLocations = catalog.DefaultGeoLocations
+	}
+	expiryWarning := time.Duration(config.Events.ExpiryWarning) * time.Second
+	controller, err := catalog.NewController(storage, geoLocations, expiryWarning)
 	if err != nil {
 		panic("Failed to start the controller:" + err.Error())
 	}
-	defer controller.Stop()
 
 	// Create catalog API object
 	api := catalog.NewHTTPAPI(controller, Version)
@@ -105,7 +110,7 @@ func main() {
 	var eventQueue notification.EventQueue
 	switch config.Storage.Type {
 	case catalog.BackendLevelDB:
-		eventQueue, err = notification.NewLevelDBEventQueue(config.Storage.DSN+"/sse", nil, 1000)
+		eventQueue, err = notification.NewLevelDBEventQueue(config.Storage.DSN+"/sse", nil, config.Events.Retention)
 		if err != nil {
 			panic("Failed to start LevelDB storage for SSE events:" + err.Error())
 		}
@@ -113,13 +118,55 @@ func main() {
 	default:
 		panic("Could not create SSE storage. Unsupported type:" + config.Storage.Type)
 	}
-	notificationController := notification.NewController(eventQueue)
-	notifAPI := notification.NewSSEAPI(notificationController, Version)
+	notificationController := notification.NewController(eventQueue, config.Events.SubscriberQueue)
+	// identifies the directory in the CloudEvents
+	eventSource := config.HTTP.PublicEndpoint
+	if eventSource == "" {
+		eventSource = config.ServiceID
+	}
+	notifAPI := notification.NewSSEAPI(notificationController, Version, eventSource, config.Events.SSE)
+	wsAPI := notification.NewWebSocketAPI(notificationController, config.Events.WebSocket)
 	defer notificationController.Stop()
 
-	controller.AddSubscriber(notificationController)
+	listeners := []catalog.EventListener{notificationController}
 
-	nRouter, err := setupHTTPRouter(&config.HTTP, api, notifAPI)
+	// Start webhook deliveries
+	var subscriptionStorage notification.SubscriptionStorage
+	switch config.Storage.Type {
+	case catalog.BackendLevelDB:
+		subscriptionStorage, err = notification.NewLevelDBSubscriptionStorage(config.Storage.DSN+"/subscriptions", nil)
+		if err != nil {
+			panic("Failed to start LevelDB storage for webhook subscriptions:" + err.Error())
+		}
+		defer subscriptionStorage.Close()
+	default:
+		panic("Could not create subscription storage. Unsupported type:" + config.Storage.Type)
+	}
+	webhookController, err := notification.NewWebhookController(eventQueue, subscriptionStorage, notificationController, eventSource, config.Events.Webhooks)
+	if err != nil {
+		panic("Failed to start the webhook controller:" + err.Error())
+	}
+	webhookAPI := notification.NewWebhookAPI(webhookController)
+	defer webhookController.Stop()
+
+	// Publish events to MQTT
+	if config.MQTT.Enabled {
+		if config.MQTT.ClientID == "" {
+			config.MQTT.ClientID = config.ServiceID
+		}
+		mqttPublisher, err := notification.NewMQTTPublisher(config.MQTT)
+		if err != nil {
+			panic("Failed to start the MQTT publisher:" + err.Error())
+		}
+		defer mqttPublisher.Stop()
+		listeners = append(listeners, mqttPublisher)
+	}
+
+	// Dispatch the catalog events, stopped before the listeners
+	controller.AddSubscriber(listeners...)
+	defer controller.Stop()
+
+	nRouter, err := setupHTTPRouter(&config.HTTP, api, notifAPI, wsAPI, webhookAPI)
 	if err != nil {
 		panic(err)
 	}
@@ -159,7 +206,7 @@ func main() {
 	log.Println("Shutting down...")
 }
 
-func setupHTTPRouter(config *HTTPConfig, api *catalog.HTTPAPI, notifAPI *notification.SSEAPI) (*negroni.Negroni, error) {
+func setupHTTPRouter(config *HTTPConfig, api *catalog.HTTPAPI, notifAPI *notification.SSEAPI, wsAPI *notification.WebSocketAPI, webhookAPI *notification.WebhookAPI) (*negroni.Negroni, error) {
 
 	corsHandler := cors.New(cors.Options{
 		AllowedOrigins: []string{"*"},
@@ -204,6 +251,10 @@ func setupHTTPRouter(config *HTTPConfig, api *catalog.HTTPAPI, notifAPI *notific
 	r.get("/openapi-spec-proxy", commonHandlers.ThenFunc(apiSpecProxy))
 	r.get("/openapi-spec-proxy/{basepath:.+}", commonHandlers.ThenFunc(apiSpecProxy))
 
+	// Events of one TD, registered before the TD retrieval which would also match the path
+	// Only requests accepting an event stream are routed here, so that TDs with ids ending in /events can be retrieved.
+	r.getStream("/things/{id:.+}/events", commonHandlers.ThenFunc(notifAPI.SubscribeThingEvent))
+
 	// Things API (CRUDL)
 	r.post("/things", commonHandlers.ThenFunc(api.Post))             // create anonymous
 	r.put("/things/{id:.+}", commonHandlers.ThenFunc(api.Put))       // create or update
@@ -211,13 +262,32 @@ func setupHTTPRouter(config *HTTPConfig, api *catalog.HTTPAPI, notifAPI *notific
 	r.patch("/things/{id:.+}", commonHandlers.ThenFunc(api.Patch))   // partially update
 	r.delete("/things/{id:.+}", commonHandlers.ThenFunc(api.Delete)) // delete
 	r.get("/things", commonHandlers.ThenFunc(api.List))              // listing
+	// batch retrieval, authorized as listing since any TD may be requested
+	r.post("/things/batch-get", authorizeAsGetPath("/things", commonHandlers, api.BatchGet))
 
 	// Search API
 	r.get("/search/jsonpath", commonHandlers.ThenFunc(api.SearchJSONPath))
+	r.get("/search/text", commonHandlers.ThenFunc(api.SearchText))
+	r.get("/search/geo", commonHandlers.ThenFunc(api.SearchGeo))
+	r.get("/search/facets", commonHandlers.ThenFunc(api.SearchFacets))
+	// capability query in the body, authorized as GET
+	r.post("/search/capability", authorizeAsGet(commonHandlers.ThenFunc(api.SearchCapability)))
 
 	// Events API
 	r.get("/events", commonHandlers.ThenFunc(notifAPI.SubscribeEvent))
+	// registered before matching the event type
+	// browsers cannot set the Authorization header of WebSockets, the token may be in the query instead
+	r.get("/events/websocket", authorizeQueryToken(commonHandlers.ThenFunc(wsAPI.Subscribe)))
+	r.get("/events/stats", commonHandlers.ThenFunc(notifAPI.Stats))
+	r.get("/events/history", commonHandlers.ThenFunc(notifAPI.History))
 	r.get("/events/{type}", commonHandlers.ThenFunc(notifAPI.SubscribeEvent))
+	// long-polling change feed
+	r.get("/changes", commonHandlers.ThenFunc(notifAPI.Changes))
+
+	// Webhook subscriptions API
+	r.post("/subscriptions", commonHandlers.ThenFunc(webhookAPI.Post))
+	r.get("/subscriptions/{id}", commonHandlers.ThenFunc(webhookAPI.Get))
+	r.delete("/subscriptions/{id}", commonHandlers.ThenFunc(webhookAPI.Delete))
 
 	logger := negroni.NewLogger()
 	logFlags := log.LstdFlags
@@ -0,0 +1,135 @@
+package notification
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/tinyiot/thing-directory/catalog"
+)
+
+// defaultDeniedNetworks are the addresses of the directory's own host and networks, denied for callbacks unless allowed:
+// unspecified, loopback, private, shared (carrier-grade NAT), link-local, and multicast ranges
+var defaultDeniedNetworks = []string{
+	"0.0.0.0/8",
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+	"169.254.0.0/16",
+	"224.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// WebhookConfig restricts the addresses of the webhook callbacks
+// The addresses in the private and other local ranges are denied by default, to prevent requests to internal services.
+type WebhookConfig struct {
+	// AllowedNetworks are CIDR ranges of callback addresses that are allowed, even if they are denied e.g. the LAN of the subscribers
+	AllowedNetworks []string `json:"allowedNetworks"`
+	// DeniedNetworks are CIDR ranges of callback addresses that are denied, in addition to the private and other local ranges
+	DeniedNetworks []string `json:"deniedNetworks"`
+}
+
+// callbackPolicy checks the addresses of the callbacks, on subscription and on every connection
+type callbackPolicy struct {
+	allowed []*net.IPNet
+	denied  []*net.IPNet
+}
+
+func newCallbackPolicy(config WebhookConfig) (*callbackPolicy, error) {
+	var p callbackPolicy
+	var err error
+	p.allowed, err = parseNetworks(config.AllowedNetworks)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowed network: %w", err)
+	}
+	p.denied, err = parseNetworks(append(defaultDeniedNetworks, config.DeniedNetworks...))
+	if err != nil {
+		return nil, fmt.Errorf("invalid denied network: %w", err)
+	}
+	return &p, nil
+}
+
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// allows returns true if the callbacks may connect to the address
+func (p *callbackPolicy) allows(ip net.IP) bool {
+	for _, network := range p.allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	for _, network := range p.denied {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkHost returns an error if any address of the host is denied
+// Hosts that do not resolve yet are accepted, as the connections are checked anyway.
+func (p *callbackPolicy) checkHost(host string) error {
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		ips, err = net.LookupIP(host)
+		if err != nil {
+			return nil
+		}
+	}
+	for _, ip := range ips {
+		if !p.allows(ip) {
+			return &catalog.BadRequestError{S: fmt.Sprintf("callback host %s is not allowed: address %s is in a denied network", host, ip)}
+		}
+	}
+	return nil
+}
+
+// control rejects the connections to denied addresses, e.g. after the callback host resolves to another address
+func (p *callbackPolicy) control(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !p.allows(ip) {
+		return fmt.Errorf("callback address %s is not allowed", host)
+	}
+	return nil
+}
+
+// client returns the HTTP client of the deliveries
+// It does not use proxies, as the policy applies to the dialed addresses.
+func (p *callbackPolicy) client(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+		Control:   p.control,
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
@@ -0,0 +1,155 @@
+package notification
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tinyiot/thing-directory/catalog"
+)
+
+const (
+	QueryParamSince = "since"
+	QueryParamWait  = "wait"
+	// QueryParamThingType is the semantic type filter of the change feed, where the type query parameter has the event types
+	QueryParamThingType = "thingType"
+
+	// MaxChangesWait is the longest wait for new events of the change feed
+	MaxChangesWait = 2 * time.Minute
+)
+
+// changesLinger is the time of waiting for more events after the first new one, to return them in a single batch
+var changesLinger = 50 * time.Millisecond
+
+// Changes is a batch of the change feed
+type Changes struct {
+	Events []Event `json:"events"`
+	// Next is the sequence number to get the following changes since
+	Next string `json:"next"`
+}
+
+// changesQuery is the request of a batch of the change feed
+type changesQuery struct {
+	subscriber
+	since string
+	wait  time.Duration
+	limit int
+}
+
+// Changes handler returns the events after the sequence number in the since query parameter, or from the oldest retained one without it,
+// or waits up to the wait query parameter for new events when there are none.
+// The sequence numbers are the event IDs. A reset event is returned when some of the events after since are no longer retained.
+func (a *SSEAPI) Changes(w http.ResponseWriter, req *http.Request) {
+	q, err := parseChangesQuery(req)
+	if err != nil {
+		catalog.ErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	events, err := a.controller.changes(q.since, q.limit)
+	if err != nil {
+		catalog.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	changes := Changes{Events: []Event{}, Next: q.since}
+	if changes.Next == "" {
+		// no events yet
+		changes.Next = "0"
+	}
+	for _, event := range events {
+		// the filtered events are skipped too
+		changes.Next = event.ID
+		toSend, ok := q.prepare(event)
+		if ok {
+			changes.Events = append(changes.Events, toSend)
+		}
+	}
+	if len(changes.Events) > 0 || len(events) == q.limit || q.wait == 0 {
+		writeJSON(w, http.StatusOK, changes)
+		return
+	}
+
+	// wait for the events after the stored ones
+	client := make(chan Event)
+	q.client = client
+	q.lastEventID = changes.Next
+	// the batch ends at the resume point instead of dropping events
+	q.overflow = OverflowDisconnect
+	err = a.controller.subscribe(q.subscriber)
+	if err != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(a.retry))
+		catalog.ErrorResponse(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	defer a.controller.unsubscribe(client)
+
+	timeout := time.NewTimer(q.wait)
+	defer timeout.Stop()
+	var linger <-chan time.Time
+collect:
+	for len(changes.Events) < q.limit {
+		select {
+		case event, ok := <-client:
+			if !ok {
+				// the controller is stopped
+				break collect
+			}
+			changes.Next = event.ID
+			if event.Type == EventTypeOverflow {
+				break collect
+			}
+			changes.Events = append(changes.Events, event)
+			if linger == nil {
+				linger = time.After(changesLinger)
+			}
+		case <-linger:
+			break collect
+		case <-timeout.C:
+			break collect
+		case <-req.Context().Done():
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, changes)
+}
+
+func parseChangesQuery(req *http.Request) (changesQuery, error) {
+	var q changesQuery
+	var err error
+	q.subscriber, err = parseQueryParameters(req, req.URL.Query().Get(QueryParamThingID), QueryParamThingType)
+	if err != nil {
+		return q, err
+	}
+	q.eventTypes, err = parseEventTypes(req)
+	if err != nil {
+		return q, err
+	}
+	if len(q.eventTypes) == 0 {
+		q.eventTypes = allEventTypes
+	}
+
+	// from the oldest retained event when not set
+	q.since = req.Form.Get(QueryParamSince)
+	if q.since != "" {
+		if _, err := strconv.ParseUint(q.since, 16, 64); err != nil {
+			return q, fmt.Errorf("invalid %s: %s", QueryParamSince, q.since)
+		}
+	}
+
+	if value := req.Form.Get(QueryParamWait); value != "" {
+		q.wait, err = time.ParseDuration(value)
+		if err != nil || q.wait < 0 || q.wait > MaxChangesWait {
+			return q, fmt.Errorf("invalid %s: must be a duration between 0s and %s", QueryParamWait, MaxChangesWait)
+		}
+	}
+
+	q.limit = catalog.MaxLimit
+	if value := req.Form.Get(catalog.QueryParamLimit); value != "" {
+		q.limit, err = strconv.Atoi(value)
+		if err != nil || q.limit <= 0 || q.limit > catalog.MaxLimit {
+			return q, fmt.Errorf("invalid %s: must be between 1 and %d", catalog.QueryParamLimit, catalog.MaxLimit)
+		}
+	}
+	return q, nil
+}
@@ -0,0 +1,173 @@
+package notification
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tinyiot/thing-directory/catalog"
+	"github.com/tinyiot/thing-directory/wot"
+)
+
+func TestChangesAPI(t *testing.T) {
+	controller := setup(t)
+	server := httptest.NewServer(http.HandlerFunc(NewSSEAPI(controller, "", "", SSEConfig{}).Changes))
+	t.Cleanup(server.Close)
+
+	lamp := catalog.ThingDescription{"id": "urn:example:lamp", "@type": "saref:Light", "title": "Lamp"}
+	for _, notify := range []func() error{
+		func() error { return controller.CreateHandler(lamp) },
+		func() error {
+			return controller.UpdateHandler(lamp, catalog.ThingDescription{"id": "urn:example:lamp", "title": "Kitchen Lamp"})
+		},
+	} {
+		if err := notify(); err != nil {
+			t.Fatalf("Error notifying: %s", err)
+		}
+	}
+
+	get := func(t *testing.T, query string) (Changes, time.Duration) {
+		start := time.Now()
+		res, err := http.Get(server.URL + "?" + query)
+		if err != nil {
+			t.Fatalf("Error getting changes: %s", err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", res.StatusCode)
+		}
+		var changes Changes
+		err = json.NewDecoder(res.Body).Decode(&changes)
+		if err != nil {
+			t.Fatalf("Error decoding changes: %s", err)
+		}
+		return changes, time.Since(start)
+	}
+
+	t.Run("retained events", func(t *testing.T) {
+		changes, elapsed := get(t, "wait=10s")
+		if len(changes.Events) != 2 || changes.Events[0].ID != "1" || changes.Events[1].Type != wot.EventTypeUpdate || changes.Next != "2" {
+			t.Fatalf("Expected the two events with next 2, got %+v", changes)
+		}
+		if elapsed > 5*time.Second {
+			t.Fatalf("Waited despite the retained events")
+		}
+
+		changes, _ = get(t, "since=1&limit=1")
+		if len(changes.Events) != 1 || changes.Events[0].ID != "2" || changes.Next != "2" {
+			t.Fatalf("Expected the second event, got %+v", changes)
+		}
+	})
+
+	t.Run("filtered events", func(t *testing.T) {
+		changes, _ := get(t, "type=thing_created")
+		if len(changes.Events) != 1 || changes.Events[0].ID != "1" || changes.Events[0].Type != wot.EventTypeCreate || changes.Next != "2" {
+			t.Fatalf("Expected the creation with next 2, got %+v", changes)
+		}
+		changes, _ = get(t, "type=thing_deleted")
+		if len(changes.Events) != 0 || changes.Next != "2" {
+			t.Fatalf("Expected no events with next 2, got %+v", changes)
+		}
+	})
+
+	t.Run("filtered events and TDs", func(t *testing.T) {
+		changes, _ := get(t, "type=thing_created&thingType=saref:Light")
+		if len(changes.Events) != 1 || changes.Events[0].Type != wot.EventTypeCreate || changes.Next != "2" {
+			t.Fatalf("Expected the creation with next 2, got %+v", changes)
+		}
+		changes, _ = get(t, "type=thing_created&thingType=saref:Sensor")
+		if len(changes.Events) != 0 || changes.Next != "2" {
+			t.Fatalf("Expected no events with next 2, got %+v", changes)
+		}
+	})
+
+	t.Run("wait for new events", func(t *testing.T) {
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			controller.DeleteHandler(catalog.ThingDescription{"id": "urn:example:lamp", "title": "Kitchen Lamp"})
+		}()
+		changes, elapsed := get(t, "since=2&wait=10s")
+		if len(changes.Events) != 1 || changes.Events[0].Type != wot.EventTypeDelete || changes.Next != "3" {
+			t.Fatalf("Expected the deletion with next 3, got %+v", changes)
+		}
+		if elapsed > 5*time.Second {
+			t.Fatalf("Response was not returned on the new event")
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		changes, elapsed := get(t, "since=3&wait=100ms")
+		if len(changes.Events) != 0 || changes.Next != "3" {
+			t.Fatalf("Expected no events with next 3, got %+v", changes)
+		}
+		if elapsed < 100*time.Millisecond {
+			t.Fatalf("Returned before the wait: %s", elapsed)
+		}
+	})
+
+	t.Run("filtered deletion", func(t *testing.T) {
+		changes, _ := get(t, "type=thing_deleted")
+		if len(changes.Events) != 1 || changes.Events[0].ID != "3" || changes.Events[0].Type != wot.EventTypeDelete || changes.Next != "3" {
+			t.Fatalf("Expected the deletion with next 3, got %+v", changes)
+		}
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		// from before the queue was reset
+		changes, _ := get(t, "since=ff")
+		if len(changes.Events) != 1 || changes.Events[0].Type != EventTypeReset || changes.Next != "3" {
+			t.Fatalf("Expected a reset with next 3, got %+v", changes)
+		}
+	})
+
+	t.Run("rotated events", func(t *testing.T) {
+		controller := NewController(setupEventQueue(t, RetentionConfig{MaxEvents: 2}), QueueConfig{})
+		t.Cleanup(controller.Stop)
+		server := httptest.NewServer(http.HandlerFunc(NewSSEAPI(controller, "", "", SSEConfig{}).Changes))
+		t.Cleanup(server.Close)
+		for _, title := range []string{"Lamp", "Kitchen Lamp", "Bedroom Lamp"} {
+			err := controller.UpdateHandler(lamp, catalog.ThingDescription{"id": "urn:example:lamp", "title": title})
+			if err != nil {
+				t.Fatalf("Error notifying: %s", err)
+			}
+		}
+
+		get := func(query string) Changes {
+			res, err := http.Get(server.URL + "?" + query)
+			if err != nil {
+				t.Fatalf("Error getting changes: %s", err)
+			}
+			defer res.Body.Close()
+			var changes Changes
+			err = json.NewDecoder(res.Body).Decode(&changes)
+			if err != nil {
+				t.Fatalf("Error decoding changes: %s", err)
+			}
+			return changes
+		}
+		// from the oldest retained event without since
+		changes := get("")
+		if len(changes.Events) != 2 || changes.Events[0].ID != "2" || changes.Next != "3" {
+			t.Fatalf("Expected the two retained events with next 3, got %+v", changes)
+		}
+		changes = get("since=0")
+		if len(changes.Events) != 1 || changes.Events[0].Type != EventTypeReset || changes.Next != "3" {
+			t.Fatalf("Expected a reset with next 3, got %+v", changes)
+		}
+	})
+
+	t.Run("invalid query", func(t *testing.T) {
+		for _, query := range []string{"since=x", "wait=1h", "wait=-1s", "wait=10", "limit=0"} {
+			res, err := http.Get(server.URL + "?" + query)
+			if err != nil {
+				t.Fatalf("Error getting changes: %s", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusBadRequest {
+				t.Fatalf("Expected status 400 for %s, got %d", query, res.StatusCode)
+			}
+		}
+	})
+}
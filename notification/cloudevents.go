@@ -0,0 +1,70 @@
+package notification
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tinyiot/thing-directory/catalog"
+	"github.com/tinyiot/thing-directory/wot"
+)
+
+const (
+	// FormatCloudEvents selects the CloudEvents envelope for the events
+	FormatCloudEvents    = "cloudevents"
+	MediaTypeCloudEvents = "application/cloudevents+json"
+	QueryParamFormat     = "format"
+
+	cloudEventsSpecVersion = "1.0"
+)
+
+// CloudEvent is an event in the structured JSON mode of CloudEvents 1.0
+type CloudEvent struct {
+	SpecVersion string `json:"specversion"`
+	ID          string `json:"id"`
+	// Source identifies the directory
+	Source string `json:"source"`
+	// Type is the event type e.g. thing_created
+	Type string `json:"type"`
+	// Subject is the id of the TD
+	Subject         string                   `json:"subject,omitempty"`
+	Time            *time.Time               `json:"time,omitempty"`
+	DataContentType string                   `json:"datacontenttype"`
+	Data            catalog.ThingDescription `json:"data"`
+}
+
+// newCloudEvent wraps the event in the CloudEvents envelope
+func newCloudEvent(event Event, source string) CloudEvent {
+	ce := CloudEvent{
+		SpecVersion:     cloudEventsSpecVersion,
+		ID:              event.ID,
+		Source:          source,
+		Type:            string(event.Type),
+		DataContentType: wot.MediaTypeJSON,
+		Data:            event.Data,
+	}
+	ce.Subject, _ = event.Data[wot.KeyThingID].(string)
+	if !event.Timestamp.IsZero() {
+		ce.Time = &event.Timestamp
+	}
+	return ce
+}
+
+// validateFormat checks the format of the events
+func validateFormat(format string) error {
+	switch format {
+	case "", FormatCloudEvents:
+		return nil
+	default:
+		return &catalog.BadRequestError{S: "unsupported format: " + format}
+	}
+}
+
+// parseFormat returns the format of the events selected by the query parameter or the Accept header
+func parseFormat(req *http.Request) (string, error) {
+	format := req.URL.Query().Get(QueryParamFormat)
+	if format == "" && strings.Contains(req.Header.Get("Accept"), MediaTypeCloudEvents) {
+		format = FormatCloudEvents
+	}
+	return format, validateFormat(format)
+}
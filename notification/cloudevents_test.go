@@ -0,0 +1,114 @@
+package notification
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tinyiot/thing-directory/catalog"
+	"github.com/tinyiot/thing-directory/wot"
+)
+
+const testEventSource = "https://directory.example.com"
+
+// checkCloudEvent checks the envelope of the event about the TD
+func checkCloudEvent(t *testing.T, b []byte, eventType wot.EventType, thingID string) CloudEvent {
+	var ce CloudEvent
+	err := json.Unmarshal(b, &ce)
+	if err != nil {
+		t.Fatalf("Error unmarshalling CloudEvent %s: %s", b, err)
+	}
+	if ce.SpecVersion != "1.0" || ce.ID == "" || ce.Source != testEventSource || ce.Type != string(eventType) ||
+		ce.Subject != thingID || ce.Time == nil || ce.DataContentType != wot.MediaTypeJSON || ce.Data["id"] != thingID {
+		t.Fatalf("Unexpected CloudEvent for %s of %s: %s", eventType, thingID, b)
+	}
+	return ce
+}
+
+func TestCloudEventsSSE(t *testing.T) {
+	controller := setup(t)
+	server := httptest.NewServer(http.HandlerFunc(NewSSEAPI(controller, "", testEventSource, SSEConfig{}).SubscribeEvent))
+	t.Cleanup(server.Close)
+
+	lamp := catalog.ThingDescription{"id": "urn:example:lamp", "title": "Lamp"}
+
+	for name, setFormat := range map[string]func(req *http.Request){
+		"query parameter": func(req *http.Request) {
+			req.URL.RawQuery = QueryParamFormat + "=" + FormatCloudEvents
+		},
+		"accept header": func(req *http.Request) {
+			req.Header.Set("Accept", "text/event-stream, "+MediaTypeCloudEvents)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+			setFormat(req)
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Error subscribing: %s", err)
+			}
+			defer res.Body.Close()
+
+			// the subscription is active once the headers are received
+			err = controller.CreateHandler(lamp)
+			if err != nil {
+				t.Fatalf("Error notifying: %s", err)
+			}
+
+			scanner := bufio.NewScanner(res.Body)
+			for scanner.Scan() {
+				if data := strings.TrimPrefix(scanner.Text(), "data: "); data != scanner.Text() {
+					checkCloudEvent(t, []byte(data), wot.EventTypeCreate, "urn:example:lamp")
+					return
+				}
+			}
+			t.Fatalf("Stream ended without events: %v", scanner.Err())
+		})
+	}
+
+	t.Run("unsupported format", func(t *testing.T) {
+		res, err := http.Get(server.URL + "?" + QueryParamFormat + "=xml")
+		if err != nil {
+			t.Fatalf("Error subscribing: %s", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected status 400, got %d", res.StatusCode)
+		}
+	})
+}
+
+func TestCloudEventsWebhook(t *testing.T) {
+	controller := setup(t)
+	webhooks, err := newWebhookController(controller.s, setupSubscriptionStorage(t), controller, testEventSource, testRetryPolicy, testCallbackPolicy(t))
+	if err != nil {
+		t.Fatalf("Error creating webhook controller: %s", err)
+	}
+	t.Cleanup(webhooks.Stop)
+
+	r := newReceiver(t)
+	_, err = webhooks.create(Subscription{CallbackURL: r.URL, Format: FormatCloudEvents})
+	if err != nil {
+		t.Fatalf("Error creating subscription: %s", err)
+	}
+	err = controller.DeleteHandler(catalog.ThingDescription{"id": "urn:example:lamp", "title": "Lamp"})
+	if err != nil {
+		t.Fatalf("Error notifying: %s", err)
+	}
+
+	r.received(t, 1)
+	r.Lock()
+	defer r.Unlock()
+	if contentType := r.requests[0].Header.Get("Content-Type"); contentType != MediaTypeCloudEvents {
+		t.Fatalf("Expected content type %s, got %s", MediaTypeCloudEvents, contentType)
+	}
+	checkCloudEvent(t, r.bodies[0], wot.EventTypeDelete, "urn:example:lamp")
+
+	_, err = webhooks.create(Subscription{CallbackURL: r.URL, Format: "xml"})
+	if _, ok := err.(*catalog.BadRequestError); !ok {
+		t.Fatalf("Expected BadRequestError for an unsupported format, got %v", err)
+	}
+}
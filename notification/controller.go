@@ -4,6 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"strconv"
+	"sync"
+	"time"
 
 	jsonpatch "github.com/evanphx/json-patch/v5"
 	"github.com/tinyiot/thing-directory/catalog"
@@ -14,6 +17,8 @@ type Controller struct {
 	s EventQueue
 	// Events are pushed to this channel by the main events-gathering routine
 	Notifier chan Event
+	// notifyLock serializes storing and notifying the events
+	notifyLock sync.Mutex
 
 	// New client connections
 	subscribingClients chan subscriber
@@ -22,74 +27,151 @@ type Controller struct {
 	unsubscribingClients chan chan Event
 
 	// Client connections registry
-	activeClients map[chan Event]subscriber
+	activeClients map[chan Event]*subscription
+
+	// latestID is the latest event sent to the subscribers, owned by the handler
+	latestID string
+
+	// bounds of the subscriber queues
+	queue QueueConfig
+	// metrics of the subscriptions, owned by the handler
+	counters      Stats
+	statsRequests chan chan Stats
 
 	// shutdown
 	shutdown chan bool
+	// done is closed when the handler has ended all subscriptions and stopped
+	done chan struct{}
 }
 
 type subscriber struct {
 	client      chan Event
 	eventTypes  []wot.EventType
 	diff        bool
+	diffFormat  DiffFormat
+	full        bool // complete TDs: the new TD for create and update, the last known TD for delete
+	filter      *eventFilter
 	lastEventID string
+	// overflow overrides the policy of the controller when set
+	overflow OverflowPolicy
 }
 
-func NewController(s EventQueue) *Controller {
+func NewController(s EventQueue, queue QueueConfig) *Controller {
+	latestID, err := s.getLatestID()
+	if err != nil {
+		log.Printf("error getting the latest event ID: %s", err)
+	}
+	if queue.Size <= 0 {
+		queue.Size = DefaultSubscriberQueueSize
+	}
+	if queue.Overflow == "" {
+		queue.Overflow = OverflowDropOldest
+	}
 	c := &Controller{
 		s:                    s,
 		Notifier:             make(chan Event, 1),
 		subscribingClients:   make(chan subscriber),
 		unsubscribingClients: make(chan chan Event),
-		activeClients:        make(map[chan Event]subscriber),
+		activeClients:        make(map[chan Event]*subscription),
+		latestID:             latestID,
+		queue:                queue,
+		statsRequests:        make(chan chan Stats),
 		shutdown:             make(chan bool),
+		done:                 make(chan struct{}),
 	}
 	go c.handler()
 	return c
 }
 
-func (c *Controller) subscribe(client chan Event, eventTypes []wot.EventType, diff bool, lastEventID string) error {
-	s := subscriber{client: client,
-		eventTypes:  eventTypes,
-		diff:        diff,
-		lastEventID: lastEventID,
+func (c *Controller) subscribe(s subscriber) error {
+	select {
+	case c.subscribingClients <- s:
+		return nil
+	case <-c.done:
+		return errControllerStopped
 	}
-	c.subscribingClients <- s
-	return nil
 }
 
-func (c *Controller) unsubscribe(client chan Event) error {
-	c.unsubscribingClients <- client
-	return nil
+func (c *Controller) stats() Stats {
+	response := make(chan Stats)
+	select {
+	case c.statsRequests <- response:
+		return <-response
+	case <-c.done:
+		return Stats{}
+	}
 }
 
-func (c *Controller) storeAndNotify(event Event) error {
-	var err error
-	event.ID, err = c.s.getNewID()
+func (c *Controller) history(q historyQuery) ([]Event, error) {
+	return c.s.history(q)
+}
+
+func (c *Controller) changes(since string, limit int) ([]Event, error) {
+	if since == "" {
+		// from the oldest retained event
+		return c.s.history(historyQuery{limit: limit})
+	}
+	events, err := c.s.getAllAfter(since)
+	if err == errEventsGone {
+		latestID, err := c.s.getLatestID()
+		if err != nil {
+			return nil, err
+		}
+		return []Event{{ID: latestID, Type: EventTypeReset, Data: catalog.ThingDescription{}, Timestamp: time.Now().UTC()}}, nil
+	}
 	if err != nil {
-		return fmt.Errorf("error generating ID : %v", err)
+		return nil, err
 	}
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events, nil
+}
 
-	// Notify
-	c.Notifier <- event
+func (c *Controller) unsubscribe(client chan Event) error {
+	select {
+	case c.unsubscribingClients <- client:
+	case <-c.done:
+		// the channels of all clients are closed on stop
+	}
+	return nil
+}
 
-	// Store
-	err = c.s.addRotate(event)
+func (c *Controller) storeAndNotify(event Event) error {
+	// keep the notifications in the order of the IDs
+	c.notifyLock.Lock()
+	defer c.notifyLock.Unlock()
+
+	// Store before notifying to let the subscribers read the event from the queue
+	event, err := c.s.addRotate(event)
 	if err != nil {
 		return fmt.Errorf("error storing the notification : %v", err)
 	}
 
+	// Notify
+	select {
+	case c.Notifier <- event:
+	case <-c.done:
+		// the event is stored for the subscribers that reconnect
+	}
 	return nil
 }
 
+// Stop ends all subscriptions, closing the channels of the clients, and stops the controller
 func (c *Controller) Stop() {
-	c.shutdown <- true
+	select {
+	case c.shutdown <- true:
+	case <-c.done:
+		// already stopped
+	}
+	<-c.done
 }
 
 func (c *Controller) CreateHandler(new catalog.ThingDescription) error {
 	event := Event{
-		Type: wot.EventTypeCreate,
-		Data: new,
+		Type:    wot.EventTypeCreate,
+		Data:    new,
+		Current: new,
 	}
 
 	err := c.storeAndNotify(event)
@@ -97,29 +179,48 @@ func (c *Controller) CreateHandler(new catalog.ThingDescription) error {
 }
 
 func (c *Controller) UpdateHandler(old catalog.ThingDescription, new catalog.ThingDescription) error {
+	td, err := diff(old, new)
+	if err != nil {
+		return err
+	}
+	event := Event{
+		Type:     wot.EventTypeUpdate,
+		Data:     td,
+		Current:  new,
+		Previous: old,
+	}
+	err = c.storeAndNotify(event)
+	return err
+}
+
+// diff returns the changed attributes of the TD as a JSON merge patch, including the id
+func diff(old catalog.ThingDescription, new catalog.ThingDescription) (catalog.ThingDescription, error) {
 	oldJson, err := json.Marshal(old)
 	if err != nil {
-		return fmt.Errorf("error marshalling old TD")
+		return nil, fmt.Errorf("error marshalling old TD")
 	}
 	newJson, err := json.Marshal(new)
 	if err != nil {
-		return fmt.Errorf("error marshalling new TD")
+		return nil, fmt.Errorf("error marshalling new TD")
 	}
 	patch, err := jsonpatch.CreateMergePatch(oldJson, newJson)
 	if err != nil {
-		return fmt.Errorf("error merging new TD")
+		return nil, fmt.Errorf("error merging new TD")
 	}
 	var td catalog.ThingDescription
 	if err := json.Unmarshal(patch, &td); err != nil {
-		return fmt.Errorf("error unmarshalling the patch TD")
+		return nil, fmt.Errorf("error unmarshalling the patch TD")
 	}
 	td[wot.KeyThingID] = old[wot.KeyThingID]
-	event := Event{
-		Type: wot.EventTypeUpdate,
-		Data: td,
+	return td, nil
+}
+
+// registration returns the id and the registration information of the TD
+func registration(td catalog.ThingDescription) catalog.ThingDescription {
+	return catalog.ThingDescription{
+		wot.KeyThingID:           td[wot.KeyThingID],
+		wot.KeyThingRegistration: td[wot.KeyThingRegistration],
 	}
-	err = c.storeAndNotify(event)
-	return err
 }
 
 func (c *Controller) DeleteHandler(old catalog.ThingDescription) error {
@@ -127,58 +228,160 @@ func (c *Controller) DeleteHandler(old catalog.ThingDescription) error {
 		wot.KeyThingID: old[wot.KeyThingID],
 	}
 	event := Event{
-		Type: wot.EventTypeDelete,
-		Data: deleted,
+		Type:     wot.EventTypeDelete,
+		Data:     deleted,
+		Previous: old,
+	}
+	err := c.storeAndNotify(event)
+	return err
+}
+
+func (c *Controller) ExpiringHandler(td catalog.ThingDescription) error {
+	// the TD is unchanged, so that the filters pass the event if the TD matches
+	event := Event{
+		Type:     wot.EventTypeExpiring,
+		Data:     registration(td),
+		Current:  td,
+		Previous: td,
 	}
 	err := c.storeAndNotify(event)
 	return err
 }
 
 func (c *Controller) handler() {
+	defer close(c.done)
 loop:
 	for {
 		select {
 		case s := <-c.subscribingClients:
-			c.activeClients[s.client] = s
+			sub := c.newSubscription(s)
+			c.activeClients[s.client] = sub
+			go sub.forward()
 			log.Printf("New subscription. %d active clients", len(c.activeClients))
 
 			// Send the missed events
 			if s.lastEventID != "" {
 				missedEvents, err := c.s.getAllAfter(s.lastEventID)
+				if err == errEventsGone {
+					log.Printf("Events after ID %s are no longer retained. Sending reset.", s.lastEventID)
+					sub.replay([]Event{{ID: c.latestID, Type: EventTypeReset, Data: catalog.ThingDescription{}, Timestamp: time.Now().UTC()}})
+					continue loop
+				}
 				if err != nil {
 					log.Printf("error getting the events after ID %s: %s", s.lastEventID, err)
 					continue loop
 				}
-				for _, event := range missedEvents {
-					sendToSubscriber(s, event)
-				}
+				sub.replay(c.notified(missedEvents))
 			}
 		case clientChan := <-c.unsubscribingClients:
+			if sub, found := c.activeClients[clientChan]; found {
+				sub.stop()
+			}
 			delete(c.activeClients, clientChan)
 			close(clientChan)
 			log.Printf("Unsubscribed. %d active clients", len(c.activeClients))
 		case event := <-c.Notifier:
-			for _, s := range c.activeClients {
-				sendToSubscriber(s, event)
+			c.latestID = event.ID
+			for _, sub := range c.activeClients {
+				dropped, disconnected := sub.push(event)
+				if dropped {
+					c.counters.DroppedEvents++
+				}
+				if disconnected {
+					c.counters.Disconnects++
+				}
 			}
+		case response := <-c.statsRequests:
+			stats := c.counters
+			stats.Subscribers = len(c.activeClients)
+			for _, sub := range c.activeClients {
+				stats.QueuedEvents += sub.len()
+			}
+			response <- stats
 		case <-c.shutdown:
 			log.Println("Shutting down notification controller")
 			break loop
 		}
 	}
 
+	// end the open streams
+	for clientChan, sub := range c.activeClients {
+		sub.stop()
+		delete(c.activeClients, clientChan)
+		close(clientChan)
+	}
 }
 
-func sendToSubscriber(s subscriber, event Event) {
+func (c *Controller) newSubscription(s subscriber) *subscription {
+	overflow := s.overflow
+	if overflow == "" {
+		overflow = c.queue.Overflow
+	}
+	// new subscribers get the events after the latest one
+	resumeID := s.lastEventID
+	if resumeID == "" {
+		resumeID = c.latestID
+	}
+	return &subscription{
+		subscriber: s,
+		size:       c.queue.Size,
+		overflow:   overflow,
+		resumeID:   resumeID,
+		wake:       make(chan struct{}, 1),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// notified returns the events up to the latest one sent to the subscribers. The others are pushed when notified.
+func (c *Controller) notified(events []Event) []Event {
+	latestID, _ := strconv.ParseUint(c.latestID, 16, 64)
+	for i, event := range events {
+		id, _ := strconv.ParseUint(event.ID, 16, 64)
+		if id > latestID {
+			return events[:i]
+		}
+	}
+	return events
+}
+
+// prepare returns the event as sent to the subscriber and false if the subscriber is not interested in it
+func (s subscriber) prepare(event Event) (Event, bool) {
+	if event.Type == EventTypeReset {
+		return event, true
+	}
+	event, ok := s.filter.apply(event)
+	if !ok {
+		return event, false
+	}
 	for _, eventType := range s.eventTypes {
 		// Send the notification if the type matches
 		if eventType == event.Type {
 			toSend := event
-			if !s.diff {
+			switch {
+			case s.full:
+				td := event.Current
+				if event.Type == wot.EventTypeDelete {
+					td = event.Previous
+				}
+				if td != nil {
+					toSend.Data = td
+				}
+			case s.diffFormat == DiffFormatJSONPatch && event.Type == wot.EventTypeUpdate && event.Current != nil && event.Previous != nil:
+				patch, err := createJSONPatch(event.Previous, event.Current)
+				if err != nil {
+					// the merge patch is sent instead
+					log.Printf("Error creating JSON patch of event %s: %s", event.ID, err)
+					break
+				}
+				toSend.Data = catalog.ThingDescription{wot.KeyThingID: toSend.Data[wot.KeyThingID], KeyPatch: patch}
+			case !s.diff:
 				toSend.Data = catalog.ThingDescription{wot.KeyThingID: toSend.Data[wot.KeyThingID]}
 			}
-			s.client <- toSend
-			break
+			// full TDs are only used for filtering
+			toSend.Current, toSend.Previous = nil, nil
+			return toSend, true
 		}
 	}
+	return event, false
 }
@@ -0,0 +1,393 @@
+package notification
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/tinyiot/thing-directory/catalog"
+	"github.com/tinyiot/thing-directory/wot"
+)
+
+func setup(t *testing.T) *Controller {
+	return setupWithQueue(t, QueueConfig{})
+}
+
+func setupWithQueue(t *testing.T, queue QueueConfig) *Controller {
+	tempDir := fmt.Sprintf("%s/thing-directory/test-%s-ldb",
+		strings.Replace(os.TempDir(), "\\", "/", -1), uuid.NewV4())
+
+	eventQueue, err := NewLevelDBEventQueue(tempDir, nil, RetentionConfig{})
+	if err != nil {
+		t.Fatalf("error creating leveldb event queue: %s", err)
+	}
+	controller := NewController(eventQueue, queue)
+
+	t.Cleanup(func() {
+		controller.Stop()
+		eventQueue.Close()
+		err = os.RemoveAll(tempDir) // Remove temp files
+		if err != nil {
+			t.Fatalf("error removing test files: %s", err)
+		}
+	})
+
+	return controller
+}
+
+// receive returns the events sent to the client until no event arrives within the timeout
+func receive(client chan Event, timeout time.Duration) []Event {
+	var events []Event
+	for {
+		select {
+		case event := <-client:
+			events = append(events, event)
+		case <-time.After(timeout):
+			return events
+		}
+	}
+}
+
+func TestSubscriberFilter(t *testing.T) {
+	kitchenLamp := catalog.ThingDescription{"id": "urn:example:lamp", "title": "Kitchen Lamp"}
+	bedroomLamp := catalog.ThingDescription{"id": "urn:example:lamp", "title": "Bedroom Lamp"}
+
+	send := func(t *testing.T, s subscriber, event Event) (Event, bool) {
+		e, ok := s.prepare(event)
+		if ok && (e.Current != nil || e.Previous != nil) {
+			t.Fatalf("Full TDs were sent to the subscriber: %v", e)
+		}
+		return e, ok
+	}
+
+	allTypes := []wot.EventType{wot.EventTypeCreate, wot.EventTypeUpdate, wot.EventTypeDelete}
+
+	t.Run("jsonpath", func(t *testing.T) {
+		filter, err := newEventFilter("", "$[?(@.title=='Kitchen Lamp')]", &catalog.Filter{})
+		if err != nil {
+			t.Fatalf("Error creating filter: %s", err)
+		}
+		s := subscriber{eventTypes: allTypes, diff: true, filter: filter}
+
+		_, sent := send(t, s, Event{Type: wot.EventTypeCreate, Data: bedroomLamp, Current: bedroomLamp})
+		if sent {
+			t.Fatalf("Event of a non-matching TD was sent")
+		}
+		e, sent := send(t, s, Event{Type: wot.EventTypeCreate, Data: kitchenLamp, Current: kitchenLamp})
+		if !sent || e.Type != wot.EventTypeCreate {
+			t.Fatalf("Expected %s event, got %v", wot.EventTypeCreate, e)
+		}
+	})
+
+	t.Run("start and stop matching", func(t *testing.T) {
+		filter, err := newEventFilter("", "", &catalog.Filter{Title: "kitchen"})
+		if err != nil {
+			t.Fatalf("Error creating filter: %s", err)
+		}
+		s := subscriber{eventTypes: allTypes, diff: true, filter: filter}
+
+		// starts matching
+		e, sent := send(t, s, Event{Type: wot.EventTypeUpdate, Data: catalog.ThingDescription{"id": "urn:example:lamp", "title": "Kitchen Lamp"},
+			Current: kitchenLamp, Previous: bedroomLamp})
+		if !sent || e.Type != wot.EventTypeCreate || e.Data["title"] != "Kitchen Lamp" {
+			t.Fatalf("Expected %s event with the full TD, got %v", wot.EventTypeCreate, e)
+		}
+
+		// keeps matching
+		updated := catalog.ThingDescription{"id": "urn:example:lamp", "title": "Kitchen Lamp", "version": map[string]interface{}{"instance": "2"}}
+		e, sent = send(t, s, Event{Type: wot.EventTypeUpdate, Data: catalog.ThingDescription{"id": "urn:example:lamp", "version": map[string]interface{}{"instance": "2"}},
+			Current: updated, Previous: kitchenLamp})
+		if !sent || e.Type != wot.EventTypeUpdate {
+			t.Fatalf("Expected %s event, got %v", wot.EventTypeUpdate, e)
+		}
+
+		// stops matching
+		e, sent = send(t, s, Event{Type: wot.EventTypeUpdate, Data: catalog.ThingDescription{"id": "urn:example:lamp", "title": "Bedroom Lamp"},
+			Current: bedroomLamp, Previous: kitchenLamp})
+		if !sent || e.Type != wot.EventTypeDelete || len(e.Data) != 1 {
+			t.Fatalf("Expected %s event with the id, got %v", wot.EventTypeDelete, e)
+		}
+
+		// never matched
+		_, sent = send(t, s, Event{Type: wot.EventTypeDelete, Data: catalog.ThingDescription{"id": "urn:example:lamp"}, Previous: bedroomLamp})
+		if sent {
+			t.Fatalf("Deletion of a non-matching TD was sent")
+		}
+	})
+
+	t.Run("event type after filtering", func(t *testing.T) {
+		filter, err := newEventFilter("", "", &catalog.Filter{Title: "kitchen"})
+		if err != nil {
+			t.Fatalf("Error creating filter: %s", err)
+		}
+		s := subscriber{eventTypes: []wot.EventType{wot.EventTypeDelete}, filter: filter}
+
+		e, sent := send(t, s, Event{Type: wot.EventTypeUpdate, Data: bedroomLamp, Current: bedroomLamp, Previous: kitchenLamp})
+		if !sent || e.Type != wot.EventTypeDelete {
+			t.Fatalf("Expected %s event, got %v", wot.EventTypeDelete, e)
+		}
+	})
+
+	t.Run("expiring", func(t *testing.T) {
+		filter, err := newEventFilter("", "", &catalog.Filter{Title: "kitchen"})
+		if err != nil {
+			t.Fatalf("Error creating filter: %s", err)
+		}
+		s := subscriber{eventTypes: allEventTypes, diff: true, filter: filter}
+
+		e, sent := send(t, s, Event{Type: wot.EventTypeExpiring, Data: registration(kitchenLamp), Current: kitchenLamp, Previous: kitchenLamp})
+		if !sent || e.Type != wot.EventTypeExpiring {
+			t.Fatalf("Expected %s event, got %v", wot.EventTypeExpiring, e)
+		}
+		_, sent = send(t, s, Event{Type: wot.EventTypeExpiring, Data: registration(bedroomLamp), Current: bedroomLamp, Previous: bedroomLamp})
+		if sent {
+			t.Fatalf("Expiry warning of a non-matching TD was sent")
+		}
+	})
+
+	t.Run("no filter", func(t *testing.T) {
+		filter, err := newEventFilter("", "", &catalog.Filter{})
+		if err != nil || filter != nil {
+			t.Fatalf("Expected no filter, got %v %v", filter, err)
+		}
+		s := subscriber{eventTypes: allTypes}
+
+		e, sent := send(t, s, Event{Type: wot.EventTypeUpdate, Data: bedroomLamp, Current: bedroomLamp, Previous: kitchenLamp})
+		if !sent || e.Type != wot.EventTypeUpdate || len(e.Data) != 1 {
+			t.Fatalf("Expected %s event with the id, got %v", wot.EventTypeUpdate, e)
+		}
+	})
+}
+
+func TestControllerThingEvents(t *testing.T) {
+	controller := setup(t)
+
+	lamp := catalog.ThingDescription{"id": "urn:example:lamp", "title": "Lamp"}
+	sensor := catalog.ThingDescription{"id": "urn:example:sensor", "title": "Sensor"}
+	renamed := func(td catalog.ThingDescription, title string) catalog.ThingDescription {
+		return catalog.ThingDescription{"id": td["id"], "title": title}
+	}
+
+	for _, err := range []error{
+		controller.CreateHandler(lamp),
+		controller.CreateHandler(sensor),
+		controller.UpdateHandler(lamp, renamed(lamp, "Kitchen Lamp")),
+		controller.UpdateHandler(sensor, renamed(sensor, "Kitchen Sensor")),
+		controller.DeleteHandler(renamed(lamp, "Kitchen Lamp")),
+	} {
+		if err != nil {
+			t.Fatalf("Error notifying: %s", err)
+		}
+	}
+
+	filter, err := newEventFilter("urn:example:lamp", "", &catalog.Filter{})
+	if err != nil {
+		t.Fatalf("Error creating filter: %s", err)
+	}
+	client := make(chan Event, 10)
+	err = controller.subscribe(subscriber{
+		client:      client,
+		eventTypes:  []wot.EventType{wot.EventTypeUpdate, wot.EventTypeDelete},
+		diff:        true,
+		filter:      filter,
+		lastEventID: "0",
+	})
+	if err != nil {
+		t.Fatalf("Error subscribing: %s", err)
+	}
+
+	t.Run("replay", func(t *testing.T) {
+		events := receive(client, 100*time.Millisecond)
+		if len(events) != 2 {
+			t.Fatalf("Expected 2 events, got %d: %v", len(events), events)
+		}
+		if events[0].Type != wot.EventTypeUpdate || events[0].Data["title"] != "Kitchen Lamp" {
+			t.Fatalf("Expected the update of the lamp, got %v", events[0])
+		}
+		if events[1].Type != wot.EventTypeDelete || events[1].Data["id"] != "urn:example:lamp" {
+			t.Fatalf("Expected the deletion of the lamp, got %v", events[1])
+		}
+	})
+
+	t.Run("live", func(t *testing.T) {
+		for _, err := range []error{
+			controller.UpdateHandler(sensor, renamed(sensor, "Bedroom Sensor")),
+			controller.CreateHandler(lamp),
+			controller.UpdateHandler(lamp, renamed(lamp, "Bedroom Lamp")),
+		} {
+			if err != nil {
+				t.Fatalf("Error notifying: %s", err)
+			}
+		}
+
+		events := receive(client, 100*time.Millisecond)
+		if len(events) != 1 || events[0].Type != wot.EventTypeUpdate || events[0].Data["title"] != "Bedroom Lamp" {
+			t.Fatalf("Expected only the update of the lamp, got %v", events)
+		}
+	})
+}
+
+func TestControllerReset(t *testing.T) {
+	controller := setup(t)
+	lamp := catalog.ThingDescription{"id": "urn:example:lamp", "title": "Lamp"}
+	err := controller.CreateHandler(lamp)
+	if err != nil {
+		t.Fatalf("Error notifying: %s", err)
+	}
+
+	// an id unknown to the queue e.g. from before the queue was reset
+	client := make(chan Event, 10)
+	err = controller.subscribe(subscriber{client: client, eventTypes: allEventTypes, lastEventID: "ff"})
+	if err != nil {
+		t.Fatalf("Error subscribing: %s", err)
+	}
+	events := receive(client, 100*time.Millisecond)
+	if len(events) == 0 || events[0].Type != EventTypeReset {
+		t.Fatalf("Expected a reset, got %v", events)
+	}
+	// the reset is followed by the events after the latest notified one
+	if events[0].ID != "1" && (len(events) != 2 || events[1].ID != "1") {
+		t.Fatalf("Expected the events after the reset from %s, got %v", events[0].ID, events)
+	}
+
+	err = controller.DeleteHandler(lamp)
+	if err != nil {
+		t.Fatalf("Error notifying: %s", err)
+	}
+	events = receive(client, 100*time.Millisecond)
+	if len(events) != 1 || events[0].Type != wot.EventTypeDelete {
+		t.Fatalf("Expected the live events after the reset, got %v", events)
+	}
+}
+
+func TestControllerFullTDs(t *testing.T) {
+	controller := setup(t)
+
+	lamp := catalog.ThingDescription{"id": "urn:example:lamp", "title": "Lamp", "description": "A lamp"}
+	renamed := catalog.ThingDescription{"id": "urn:example:lamp", "title": "Kitchen Lamp"}
+	for _, err := range []error{
+		controller.CreateHandler(lamp),
+		controller.UpdateHandler(lamp, renamed),
+		controller.DeleteHandler(renamed),
+	} {
+		if err != nil {
+			t.Fatalf("Error notifying: %s", err)
+		}
+	}
+
+	// replayed from the queue
+	client := make(chan Event, 10)
+	err := controller.subscribe(subscriber{
+		client:      client,
+		eventTypes:  allEventTypes,
+		full:        true,
+		lastEventID: "0",
+	})
+	if err != nil {
+		t.Fatalf("Error subscribing: %s", err)
+	}
+	events := receive(client, 100*time.Millisecond)
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events, got %d: %v", len(events), events)
+	}
+	for i, expected := range []catalog.ThingDescription{lamp, renamed, renamed} {
+		if !reflect.DeepEqual(events[i].Data, expected) {
+			t.Fatalf("Expected %s with %v, got %v", events[i].Type, expected, events[i].Data)
+		}
+		if events[i].Current != nil || events[i].Previous != nil {
+			t.Fatalf("Expected only the data in %v", events[i])
+		}
+	}
+
+	// live
+	err = controller.UpdateHandler(renamed, lamp)
+	if err != nil {
+		t.Fatalf("Error notifying: %s", err)
+	}
+	events = receive(client, 100*time.Millisecond)
+	if len(events) != 1 || !reflect.DeepEqual(events[0].Data, lamp) {
+		t.Fatalf("Expected the update with %v, got %v", lamp, events)
+	}
+}
+
+func TestControllerSlowSubscriber(t *testing.T) {
+	subscribe := func(t *testing.T, controller *Controller, client chan Event, lastEventID string) {
+		err := controller.subscribe(subscriber{client: client, eventTypes: allEventTypes, diff: true, lastEventID: lastEventID})
+		if err != nil {
+			t.Fatalf("Error subscribing: %s", err)
+		}
+	}
+	// notify creates the events and waits until they are queued for all subscribers
+	notify := func(t *testing.T, controller *Controller, n int) {
+		fast := make(chan Event)
+		subscribe(t, controller, fast, "")
+		for i := 0; i < n; i++ {
+			err := controller.CreateHandler(catalog.ThingDescription{"id": fmt.Sprintf("urn:example:%d", i)})
+			if err != nil {
+				t.Fatalf("Error notifying: %s", err)
+			}
+			// the slow subscriber does not block the others
+			select {
+			case <-fast:
+			case <-time.After(time.Second):
+				t.Fatalf("Timeout waiting for event %d of the fast subscriber", i)
+			}
+		}
+		controller.unsubscribe(fast)
+	}
+	ids := func(events []Event) (ids []string) {
+		for _, e := range events {
+			ids = append(ids, e.ID)
+		}
+		return ids
+	}
+
+	t.Run("drop oldest", func(t *testing.T) {
+		controller := setupWithQueue(t, QueueConfig{Size: 2, Overflow: OverflowDropOldest})
+		slow := make(chan Event)
+		subscribe(t, controller, slow, "")
+
+		notify(t, controller, 5)
+		stats := controller.stats()
+
+		// the forwarder may have taken the first event before the queue was full
+		events := receive(slow, 100*time.Millisecond)
+		received := ids(events)
+		if len(events) < 2 || received[len(received)-2] != "4" || received[len(received)-1] != "5" {
+			t.Fatalf("Expected the latest events to be kept, got %v", received)
+		}
+		if stats.DroppedEvents != uint64(5-len(events)) || stats.Disconnects != 0 || stats.Subscribers != 1 {
+			t.Fatalf("Unexpected stats for %d received events: %+v", len(events), stats)
+		}
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		controller := setupWithQueue(t, QueueConfig{Size: 2, Overflow: OverflowDisconnect})
+		slow := make(chan Event)
+		subscribe(t, controller, slow, "")
+
+		notify(t, controller, 5)
+		if stats := controller.stats(); stats.Disconnects != 1 || stats.DroppedEvents != 0 {
+			t.Fatalf("Unexpected stats: %+v", stats)
+		}
+
+		events := receive(slow, 100*time.Millisecond)
+		if len(events) == 0 || events[len(events)-1].Type != EventTypeOverflow {
+			t.Fatalf("Expected the overflow event, got %v", events)
+		}
+		overflow := events[len(events)-1]
+		controller.unsubscribe(slow)
+
+		// resume from the overflow event
+		resumed := make(chan Event, 10)
+		subscribe(t, controller, resumed, overflow.ID)
+		received := append(ids(events[:len(events)-1]), ids(receive(resumed, 100*time.Millisecond))...)
+		if strings.Join(received, ",") != "1,2,3,4,5" {
+			t.Fatalf("Expected all events after resuming from %s, got %v", overflow.ID, received)
+		}
+	})
+}
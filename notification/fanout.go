@@ -0,0 +1,145 @@
+package notification
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// subscription is an active subscriber with a bounded queue of events
+// The events are forwarded to the client by a goroutine per subscription, so a slow client does not block the others.
+type subscription struct {
+	subscriber
+	size     int
+	overflow OverflowPolicy
+
+	sync.Mutex
+	events []Event
+	// backlog is the number of replayed events at the head of the queue, which do not count towards the size
+	backlog    int
+	dropped    uint64
+	overflowed bool
+
+	// resumeID is the latest event sent to the client, only accessed by the forwarder
+	resumeID string
+
+	wake chan struct{}
+	quit chan struct{}
+	done chan struct{}
+}
+
+// replay queues the events that the subscriber missed
+func (s *subscription) replay(events []Event) {
+	s.Lock()
+	for _, event := range events {
+		toSend, ok := s.prepare(event)
+		if ok {
+			s.events = append(s.events, toSend)
+			s.backlog++
+		}
+	}
+	s.Unlock()
+	s.notify()
+}
+
+// push queues the event if the subscriber is interested in it
+// It reports whether an event was dropped or the subscription was disconnected because the queue was full.
+func (s *subscription) push(event Event) (dropped bool, disconnected bool) {
+	toSend, ok := s.prepare(event)
+	if !ok {
+		return false, false
+	}
+
+	s.Lock()
+	defer s.notify()
+	defer s.Unlock()
+
+	if s.overflowed {
+		return false, false
+	}
+	if len(s.events)-s.backlog >= s.size {
+		switch s.overflow {
+		case OverflowDisconnect:
+			log.Printf("Subscriber is not keeping up with the events. Disconnecting.")
+			s.overflowed = true
+			s.events, s.backlog = nil, 0
+			return false, true
+		default:
+			if s.dropped == 0 {
+				log.Printf("Subscriber is not keeping up with the events. Dropping the oldest events.")
+			}
+			s.events = append(s.events[:s.backlog], s.events[s.backlog+1:]...)
+			s.dropped++
+			dropped = true
+		}
+	}
+	s.events = append(s.events, toSend)
+	return dropped, false
+}
+
+// pop returns the next event for the client and false if there are none
+func (s *subscription) pop() (Event, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.overflowed {
+		return Event{ID: s.resumeID, Type: EventTypeOverflow, Timestamp: time.Now().UTC()}, true
+	}
+	if len(s.events) == 0 {
+		return Event{}, false
+	}
+	event := s.events[0]
+	s.events = s.events[1:]
+	if s.backlog > 0 {
+		s.backlog--
+	}
+	return event, true
+}
+
+func (s *subscription) len() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.events)
+}
+
+// notify wakes up the forwarder
+func (s *subscription) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+		// already awake
+	}
+}
+
+// forward sends the queued events to the client until the subscription is stopped or disconnected
+func (s *subscription) forward() {
+	defer close(s.done)
+	for {
+		select {
+		case <-s.wake:
+		case <-s.quit:
+			return
+		}
+		for {
+			event, ok := s.pop()
+			if !ok {
+				break
+			}
+			select {
+			case s.client <- event:
+				if event.Type == EventTypeOverflow {
+					return
+				}
+				s.resumeID = event.ID
+			case <-s.quit:
+				return
+			}
+		}
+	}
+}
+
+// stop ends the forwarder before the client channel is closed
+func (s *subscription) stop() {
+	close(s.quit)
+	<-s.done
+}
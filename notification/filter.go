@@ -0,0 +1,84 @@
+package notification
+
+import (
+	"log"
+
+	"github.com/tinyiot/thing-directory/catalog"
+	"github.com/tinyiot/thing-directory/wot"
+)
+
+// eventFilter selects the events of a subscriber by the TDs they are about
+type eventFilter struct {
+	// thingID limits the events to a single TD
+	thingID string
+	// jsonPath is a query over an array of TDs e.g. $[?(@.title=='Kitchen Lamp')]
+	jsonPath   string
+	attributes *catalog.Filter
+}
+
+// newEventFilter returns nil if there are no conditions
+func newEventFilter(thingID, jsonPath string, attributes *catalog.Filter) (*eventFilter, error) {
+	if thingID == "" && jsonPath == "" && attributes.IsEmpty() {
+		return nil, nil
+	}
+	if jsonPath != "" {
+		_, err := catalog.MatchJSONPath(jsonPath, catalog.ThingDescription{})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &eventFilter{
+		thingID:    thingID,
+		jsonPath:   jsonPath,
+		attributes: attributes,
+	}, nil
+}
+
+// match returns true if the full TD satisfies all conditions
+func (f *eventFilter) match(td catalog.ThingDescription) bool {
+	if td == nil {
+		return false
+	}
+	if !f.attributes.Match(td) {
+		return false
+	}
+	if f.jsonPath != "" {
+		matched, err := catalog.MatchJSONPath(f.jsonPath, td)
+		if err != nil {
+			log.Printf("Error evaluating jsonpath %s: %s", f.jsonPath, err)
+			return false
+		}
+		return matched
+	}
+	return true
+}
+
+// apply returns the event as seen through the filter and false if the subscriber is not interested in it
+// An update becomes a creation when the TD starts matching, and a deletion when it stops matching.
+func (f *eventFilter) apply(event Event) (Event, bool) {
+	if f == nil {
+		return event, true
+	}
+	// the data of all event types has the id
+	if f.thingID != "" && event.Data[wot.KeyThingID] != f.thingID {
+		return event, false
+	}
+	if f.jsonPath == "" && f.attributes.IsEmpty() {
+		return event, true
+	}
+
+	matched, matches := f.match(event.Previous), f.match(event.Current)
+	switch {
+	case matched && matches:
+		return event, true
+	case matches:
+		event.Type = wot.EventTypeCreate
+		event.Data = event.Current
+		return event, true
+	case matched:
+		event.Type = wot.EventTypeDelete
+		event.Data = catalog.ThingDescription{wot.KeyThingID: event.Previous[wot.KeyThingID]}
+		return event, true
+	}
+	return event, false
+}
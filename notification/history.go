@@ -0,0 +1,120 @@
+package notification
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinyiot/thing-directory/catalog"
+	"github.com/tinyiot/thing-directory/wot"
+)
+
+const (
+	QueryParamFrom    = "from"
+	QueryParamTo      = "to"
+	QueryParamThingID = "thingID"
+)
+
+// match reports whether the event is selected by the query
+func (q historyQuery) match(event Event) bool {
+	if !q.from.IsZero() && event.Timestamp.Before(q.from) {
+		return false
+	}
+	if !q.to.IsZero() && !event.Timestamp.Before(q.to) {
+		return false
+	}
+	if q.thingID != "" && event.Data[wot.KeyThingID] != q.thingID {
+		return false
+	}
+	if len(q.types) == 0 {
+		return true
+	}
+	for _, eventType := range q.types {
+		if eventType == event.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// History returns the stored events as a JSON array, in pages linked by the Link header
+func (a *SSEAPI) History(w http.ResponseWriter, req *http.Request) {
+	q, err := parseHistoryQuery(req)
+	if err != nil {
+		catalog.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// one more event tells whether there is a next page
+	limit := q.limit
+	q.limit++
+	events, err := a.controller.history(q)
+	if err != nil {
+		catalog.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(events) > limit {
+		events = events[:limit]
+		// same query continuing after the last event of the page
+		query := req.URL.Query()
+		query.Set(catalog.QueryParamAfter, events[limit-1].ID)
+		query.Set(catalog.QueryParamLimit, strconv.Itoa(limit))
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", req.URL.Path+"?"+query.Encode()))
+	}
+	if events == nil {
+		events = []Event{}
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+func parseHistoryQuery(req *http.Request) (historyQuery, error) {
+	q := historyQuery{limit: catalog.MaxLimit}
+	err := req.ParseForm()
+	if err != nil {
+		return q, fmt.Errorf("error parsing the query: %s", err)
+	}
+
+	for param, t := range map[string]*time.Time{QueryParamFrom: &q.from, QueryParamTo: &q.to} {
+		if value := req.Form.Get(param); value != "" {
+			*t, err = time.Parse(time.RFC3339, value)
+			if err != nil {
+				return q, fmt.Errorf("invalid %s: %s", param, err)
+			}
+		}
+	}
+
+	q.types, err = parseEventTypes(req)
+	if err != nil {
+		return q, err
+	}
+
+	q.thingID = req.Form.Get(QueryParamThingID)
+
+	q.after = req.Form.Get(catalog.QueryParamAfter)
+	if q.after != "" {
+		if _, err := strconv.ParseUint(q.after, 16, 64); err != nil {
+			return q, fmt.Errorf("invalid %s: %s", catalog.QueryParamAfter, q.after)
+		}
+	}
+
+	if value := req.Form.Get(catalog.QueryParamLimit); value != "" {
+		q.limit, err = strconv.Atoi(value)
+		if err != nil || q.limit <= 0 || q.limit > catalog.MaxLimit {
+			return q, fmt.Errorf("invalid %s: must be between 1 and %d", catalog.QueryParamLimit, catalog.MaxLimit)
+		}
+	}
+	return q, nil
+}
+
+// parseEventTypes returns the event types in the repeated or comma-separated type query parameter
+func parseEventTypes(req *http.Request) ([]wot.EventType, error) {
+	var eventTypes []wot.EventType
+	for _, value := range req.Form[QueryParamType] {
+		for _, eventType := range strings.Split(value, ",") {
+			eventTypes = append(eventTypes, wot.EventType(strings.TrimSpace(eventType)))
+		}
+	}
+	return eventTypes, validateEventTypes(eventTypes)
+}
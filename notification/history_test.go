@@ -0,0 +1,154 @@
+package notification
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tinyiot/thing-directory/catalog"
+)
+
+func TestHistoryAPI(t *testing.T) {
+	controller := setup(t)
+	api := NewSSEAPI(controller, "", "", SSEConfig{})
+
+	lamp := catalog.ThingDescription{"id": "urn:example:lamp", "title": "Lamp"}
+	sensor := catalog.ThingDescription{"id": "urn:example:sensor", "title": "Sensor"}
+	renamed := catalog.ThingDescription{"id": "urn:example:lamp", "title": "Kitchen Lamp"}
+	for _, err := range []error{
+		controller.CreateHandler(lamp),
+		controller.CreateHandler(sensor),
+	} {
+		if err != nil {
+			t.Fatalf("Error notifying: %s", err)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	between := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	for _, err := range []error{
+		controller.UpdateHandler(lamp, renamed),
+		controller.DeleteHandler(sensor),
+		controller.DeleteHandler(renamed),
+	} {
+		if err != nil {
+			t.Fatalf("Error notifying: %s", err)
+		}
+	}
+
+	get := func(t *testing.T, query url.Values) ([]Event, *http.Response) {
+		req := httptest.NewRequest(http.MethodGet, "/events/history?"+query.Encode(), nil)
+		rec := httptest.NewRecorder()
+		api.History(rec, req)
+		res := rec.Result()
+		if res.StatusCode != http.StatusOK {
+			return nil, res
+		}
+		var events []Event
+		err := json.NewDecoder(res.Body).Decode(&events)
+		if err != nil {
+			t.Fatalf("Error decoding response: %s", err)
+		}
+		return events, res
+	}
+	ids := func(events []Event) (ids []string) {
+		for _, event := range events {
+			ids = append(ids, event.ID)
+		}
+		return ids
+	}
+
+	cases := []struct {
+		name     string
+		query    url.Values
+		expected []string
+	}{
+		{"all", url.Values{}, []string{"1", "2", "3", "4", "5"}},
+		{"from", url.Values{"from": {between.Format(time.RFC3339Nano)}}, []string{"3", "4", "5"}},
+		{"to", url.Values{"to": {between.Format(time.RFC3339Nano)}}, []string{"1", "2"}},
+		{"type", url.Values{"type": {"thing_created,thing_updated"}}, []string{"1", "2", "3"}},
+		{"thing", url.Values{"thingID": {"urn:example:lamp"}, "type": {"thing_deleted"}}, []string{"5"}},
+		{"after", url.Values{"after": {"3"}}, []string{"4", "5"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			events, res := get(t, c.query)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d", res.StatusCode)
+			}
+			if got := ids(events); !reflect.DeepEqual(got, c.expected) {
+				t.Fatalf("Expected events %v, got %v", c.expected, got)
+			}
+		})
+	}
+
+	t.Run("paging", func(t *testing.T) {
+		var pages [][]string
+		query := url.Values{"limit": {"2"}}
+		for {
+			events, res := get(t, query)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d", res.StatusCode)
+			}
+			pages = append(pages, ids(events))
+			link := res.Header.Get("Link")
+			if link == "" {
+				break
+			}
+			next, err := url.Parse(link[1 : len(link)-len(`>; rel="next"`)])
+			if err != nil {
+				t.Fatalf("Error parsing link %s: %s", link, err)
+			}
+			query = next.Query()
+		}
+		if len(pages) != 3 || len(pages[2]) != 1 || pages[2][0] != "5" {
+			t.Fatalf("Expected 3 pages, got %v", pages)
+		}
+	})
+
+	t.Run("timestamps", func(t *testing.T) {
+		events, _ := get(t, url.Values{})
+		for _, event := range events {
+			if event.Timestamp.IsZero() {
+				t.Fatalf("Expected the timestamp of event %s", event.ID)
+			}
+		}
+	})
+
+	t.Run("payload", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		api.History(rec, httptest.NewRequest(http.MethodGet, "/events/history", nil))
+		var events []map[string]interface{}
+		err := json.NewDecoder(rec.Body).Decode(&events)
+		if err != nil {
+			t.Fatalf("Error decoding response: %s", err)
+		}
+		for _, event := range events {
+			// the full TDs are only sent as the data of creations
+			if _, found := event["current"]; found {
+				t.Fatalf("Unexpected current TD in event %v", event["id"])
+			}
+			if _, found := event["previous"]; found {
+				t.Fatalf("Unexpected previous TD in event %v", event["id"])
+			}
+		}
+	})
+
+	t.Run("bad request", func(t *testing.T) {
+		for _, query := range []url.Values{
+			{"from": {"yesterday"}},
+			{"type": {"thing_renamed"}},
+			{"limit": {"1000"}},
+			{"after": {"x"}},
+		} {
+			_, res := get(t, query)
+			if res.StatusCode != http.StatusBadRequest {
+				t.Fatalf("Expected status 400 for %v, got %d", query, res.StatusCode)
+			}
+		}
+	})
+}
@@ -7,27 +7,41 @@ import (
 	"fmt"
 	"log"
 	"net/url"
+	"reflect"
 	"strconv"
 	"sync"
+	"time"
 
+	jsonpatch "github.com/evanphx/json-patch/v5"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/tinyiot/thing-directory/catalog"
+	"github.com/tinyiot/thing-directory/wot"
 )
 
+// retentionCleanupInterval is the interval of deleting the events older than the retention age
+var retentionCleanupInterval = time.Minute // to be modified in unit tests
+
 // LevelDB storage
 type LevelDBEventQueue struct {
-	db       *leveldb.DB
-	wg       sync.WaitGroup
-	latestID uint64
-	capacity uint64
+	db *leveldb.DB
+	wg sync.WaitGroup
+	// mutex guards the latest ID, which is allocated and written together with the rotation
+	mutex     sync.RWMutex
+	latestID  uint64
+	retention RetentionConfig
+	quit      chan struct{}
 }
 
-func NewLevelDBEventQueue(dsn string, opts *opt.Options, capacity uint64) (EventQueue, error) {
+func NewLevelDBEventQueue(dsn string, opts *opt.Options, retention RetentionConfig) (EventQueue, error) {
 	url, err := url.Parse(dsn)
 	if err != nil {
 		return nil, err
 	}
+	if retention.MaxEvents == 0 {
+		retention.MaxEvents = DefaultRetentionMaxEvents
+	}
 
 	// Open the database file
 	db, err := leveldb.OpenFile(url.Path, opts)
@@ -35,50 +49,99 @@ func NewLevelDBEventQueue(dsn string, opts *opt.Options, capacity uint64) (Event
 		return nil, err
 	}
 
-	ldbEventQueue := &LevelDBEventQueue{db: db, capacity: capacity}
+	ldbEventQueue := &LevelDBEventQueue{db: db, retention: retention, quit: make(chan struct{})}
 	ldbEventQueue.latestID, err = ldbEventQueue.fetchLatestID()
 	if err != nil {
 		return nil, fmt.Errorf("error fetching the latest ID from storage: %w", err)
 	}
+	if retention.MaxAge > 0 {
+		ldbEventQueue.wg.Add(1)
+		go ldbEventQueue.cleanExpired()
+	}
 	return ldbEventQueue, nil
 }
 
-func (s *LevelDBEventQueue) addRotate(event Event) error {
+func (s *LevelDBEventQueue) addRotate(event Event) (Event, error) {
 	s.wg.Add(1)
 	defer s.wg.Done()
 
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	id := s.latestID + 1
+	event.ID = strconv.FormatUint(id, 16)
+
 	// add new data
-	bytes, err := json.Marshal(event)
+	event.Timestamp = time.Now().UTC()
+	bytes, err := encodeEvent(event)
 	if err != nil {
-		return fmt.Errorf("error marshalling event: %w", err)
-	}
-	uintID, err := strconv.ParseUint(event.ID, 16, 64)
-	if err != nil {
-		return fmt.Errorf("error parsing event ID: %w", err)
+		return event, fmt.Errorf("error marshalling event: %w", err)
 	}
 	batch := new(leveldb.Batch)
 
-	batch.Put(uint64ToByte(uintID), bytes)
+	batch.Put(uint64ToByte(id), bytes)
 
 	// cleanup the older data
-	if s.latestID > s.capacity {
-		cleanBefore := s.latestID - s.capacity + 1 // adding 1 as Range is  is not inclusive the limit.
-		iter := s.db.NewIterator(&util.Range{Limit: uint64ToByte(cleanBefore)}, nil)
-		for iter.Next() {
-			// log.Println("deleting older entry: ", byteToUint64(iter.Key()))
-			batch.Delete(iter.Key())
-		}
-		iter.Release()
-		err = iter.Error()
-		if err != nil {
-			return err
-		}
+	err = s.prune(batch, id, event.Timestamp)
+	if err != nil {
+		return event, err
 	}
 	err = s.db.Write(batch, nil)
 	if err != nil {
-		return fmt.Errorf("error cleaning up: %w", err)
+		return event, fmt.Errorf("error writing event: %w", err)
+	}
+	s.latestID = id
+	return event, nil
+}
+
+// prune adds the deletion of the events before the latest ID that are beyond the retention to the batch
+// The events are deleted from the oldest, until the first one within the retention.
+func (s *LevelDBEventQueue) prune(batch *leveldb.Batch, latestID uint64, now time.Time) error {
+	iter := s.db.NewIterator(&util.Range{Limit: uint64ToByte(latestID)}, nil)
+	defer iter.Release()
+	for iter.Next() {
+		if latestID-byteToUint64(iter.Key()) < s.retention.MaxEvents {
+			if s.retention.MaxAge <= 0 {
+				break
+			}
+			var stored storedEvent
+			err := json.Unmarshal(iter.Value(), &stored)
+			if err != nil {
+				return fmt.Errorf("error unmarshalling event: %w", err)
+			}
+			if now.Sub(stored.Timestamp) <= time.Duration(s.retention.MaxAge)*time.Second {
+				break
+			}
+		}
+		// log.Println("deleting older entry: ", byteToUint64(iter.Key()))
+		batch.Delete(iter.Key())
+	}
+	return iter.Error()
+}
+
+// cleanExpired periodically deletes the events older than the retention age
+func (s *LevelDBEventQueue) cleanExpired() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(retentionCleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.quit:
+			return
+		}
+
+		s.mutex.Lock()
+		batch := new(leveldb.Batch)
+		err := s.prune(batch, s.latestID, time.Now().UTC())
+		if err == nil && batch.Len() > 0 {
+			err = s.db.Write(batch, nil)
+		}
+		s.mutex.Unlock()
+		if err != nil {
+			log.Printf("Error deleting expired events: %s", err)
+		}
 	}
-	return nil
 }
 
 func (s *LevelDBEventQueue) getAllAfter(id string) ([]Event, error) {
@@ -87,21 +150,29 @@ func (s *LevelDBEventQueue) getAllAfter(id string) ([]Event, error) {
 		return nil, fmt.Errorf("error parsing latest ID: %w", err)
 	}
 
+	// a single iterator reads a consistent view of the queue
+	iter := s.db.NewIterator(nil, nil)
+	defer iter.Release()
+	var first, latest uint64
+	if iter.First() {
+		first = byteToUint64(iter.Key())
+		iter.Last()
+		latest = byteToUint64(iter.Key())
+	}
+	// the events after the ID have been rotated out, or the ID is from before the queue was reset
+	if first > intID+1 || intID > latest {
+		return nil, errEventsGone
+	}
+
 	// start from the last missing event.
-	// If the leveldb does not have the requested ID,
-	// then the iterator starts with oldest available entry
-	iter := s.db.NewIterator(&util.Range{Start: uint64ToByte(intID + 1)}, nil)
 	var events []Event
-	for iter.Next() {
-		var event Event
-		err = json.Unmarshal(iter.Value(), &event)
+	for ok := iter.Seek(uint64ToByte(intID + 1)); ok; ok = iter.Next() {
+		event, err := decodeEvent(iter.Value())
 		if err != nil {
-			iter.Release()
 			return nil, fmt.Errorf("error unmarshalling event: %w", err)
 		}
 		events = append(events, event)
 	}
-	iter.Release()
 	err = iter.Error()
 	if err != nil {
 		return nil, err
@@ -109,12 +180,47 @@ func (s *LevelDBEventQueue) getAllAfter(id string) ([]Event, error) {
 	return events, nil
 }
 
-func (s *LevelDBEventQueue) getNewID() (string, error) {
-	s.latestID += 1
+func (s *LevelDBEventQueue) history(q historyQuery) ([]Event, error) {
+	start := uint64(0)
+	if q.after != "" {
+		after, err := strconv.ParseUint(q.after, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing the ID: %w", err)
+		}
+		start = after + 1
+	}
+
+	iter := s.db.NewIterator(&util.Range{Start: uint64ToByte(start)}, nil)
+	defer iter.Release()
+	var events []Event
+	for iter.Next() {
+		event, err := decodeEvent(iter.Value())
+		if err != nil {
+			return nil, fmt.Errorf("error unmarshalling event: %w", err)
+		}
+		if !q.match(event) {
+			continue
+		}
+		events = append(events, event)
+		if q.limit > 0 && len(events) == q.limit {
+			break
+		}
+	}
+	err := iter.Error()
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (s *LevelDBEventQueue) getLatestID() (string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 	return strconv.FormatUint(s.latestID, 16), nil
 }
 
 func (s *LevelDBEventQueue) Close() {
+	close(s.quit)
 	s.wg.Wait()
 	err := s.db.Close()
 	if err != nil {
@@ -145,6 +251,122 @@ func (s *LevelDBEventQueue) fetchLatestID() (uint64, error) {
 	return latestID, nil
 }
 
+// storedEvent is the encoding of the events in the queue, storing each TD once:
+// the current TD of creations, updates and expiry warnings, and the last known TD of deletions.
+// The previous TD of updates is stored as the merge patch that reverts the update, or in full when the patch cannot
+// e.g. for members set to null.
+// Other events have the full TDs, if any, same as those stored before.
+type storedEvent struct {
+	Event
+	TD   json.RawMessage `json:"td,omitempty"`
+	Undo json.RawMessage `json:"undo,omitempty"`
+
+	Current  catalog.ThingDescription `json:"current,omitempty"`
+	Previous catalog.ThingDescription `json:"previous,omitempty"`
+}
+
+func encodeEvent(event Event) ([]byte, error) {
+	var (
+		encoded = storedEvent{Event: event}
+		err     error
+	)
+	switch {
+	case event.Type == wot.EventTypeCreate && event.Current != nil:
+		encoded.TD, err = json.Marshal(event.Current)
+		// the data is the TD
+		encoded.Data = nil
+	case event.Type == wot.EventTypeUpdate && event.Current != nil && event.Previous != nil:
+		encoded.TD, err = json.Marshal(event.Current)
+		if err != nil {
+			return nil, err
+		}
+		var previous []byte
+		previous, err = json.Marshal(event.Previous)
+		if err != nil {
+			return nil, err
+		}
+		encoded.Undo, err = jsonpatch.CreateMergePatch(encoded.TD, previous)
+		if err != nil {
+			return nil, err
+		}
+		// the merge patches cannot set members to null
+		if !reverts(encoded.TD, encoded.Undo, previous) {
+			encoded.Undo = nil
+			encoded.Previous = event.Previous
+		}
+	case event.Type == wot.EventTypeExpiring && event.Current != nil:
+		// the TD is unchanged
+		encoded.TD, err = json.Marshal(event.Current)
+	case event.Type == wot.EventTypeDelete && event.Previous != nil:
+		encoded.TD, err = json.Marshal(event.Previous)
+		// the data is the id of the TD
+		encoded.Data = nil
+	default:
+		encoded.Current, encoded.Previous = event.Current, event.Previous
+		return json.Marshal(encoded)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(encoded)
+}
+
+// reverts returns true if the merge patch reverts the TD to exactly the previous one
+func reverts(td, undo, previous []byte) bool {
+	reverted, err := jsonpatch.MergePatch(td, undo)
+	if err != nil {
+		return false
+	}
+	var got, expected interface{}
+	if json.Unmarshal(reverted, &got) != nil || json.Unmarshal(previous, &expected) != nil {
+		return false
+	}
+	return reflect.DeepEqual(got, expected)
+}
+
+func decodeEvent(b []byte) (Event, error) {
+	var stored storedEvent
+	err := json.Unmarshal(b, &stored)
+	if err != nil {
+		return Event{}, err
+	}
+	event := stored.Event
+	if stored.TD == nil {
+		event.Current, event.Previous = stored.Current, stored.Previous
+		return event, nil
+	}
+
+	var td catalog.ThingDescription
+	err = json.Unmarshal(stored.TD, &td)
+	if err != nil {
+		return event, err
+	}
+	switch event.Type {
+	case wot.EventTypeCreate:
+		event.Data, event.Current = td, td
+	case wot.EventTypeUpdate:
+		event.Current = td
+		if stored.Undo == nil {
+			event.Previous = stored.Previous
+			break
+		}
+		previous, err := jsonpatch.MergePatch(stored.TD, stored.Undo)
+		if err != nil {
+			return event, fmt.Errorf("error reverting the update: %w", err)
+		}
+		err = json.Unmarshal(previous, &event.Previous)
+		if err != nil {
+			return event, err
+		}
+	case wot.EventTypeDelete:
+		event.Data = catalog.ThingDescription{wot.KeyThingID: td[wot.KeyThingID]}
+		event.Previous = td
+	case wot.EventTypeExpiring:
+		event.Current, event.Previous = td, td
+	}
+	return event, nil
+}
+
 //byte to unint64 conversion functions and vice versa
 func byteToUint64(input []byte) uint64 {
 	return binary.BigEndian.Uint64(input)
@@ -0,0 +1,280 @@
+package notification
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/tinyiot/thing-directory/catalog"
+	"github.com/tinyiot/thing-directory/wot"
+)
+
+func setupEventQueue(t *testing.T, retention RetentionConfig) EventQueue {
+	tempDir := fmt.Sprintf("%s/thing-directory/test-%s-ldb",
+		strings.Replace(os.TempDir(), "\\", "/", -1), uuid.NewV4())
+
+	queue, err := NewLevelDBEventQueue(tempDir, nil, retention)
+	if err != nil {
+		t.Fatalf("error creating leveldb event queue: %s", err)
+	}
+	t.Cleanup(func() {
+		queue.Close()
+		err = os.RemoveAll(tempDir)
+		if err != nil {
+			t.Fatalf("error removing test files: %s", err)
+		}
+	})
+	return queue
+}
+
+func TestLevelDBEventQueueConcurrentAdd(t *testing.T) {
+	const (
+		writers = 20
+		events  = 50
+	)
+
+	add := func(t *testing.T, queue EventQueue) map[uint64]bool {
+		var (
+			wg  sync.WaitGroup
+			mu  sync.Mutex
+			ids = make(map[uint64]bool)
+		)
+		for w := 0; w < writers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < events; i++ {
+					event, err := queue.addRotate(Event{
+						Type: wot.EventTypeCreate,
+						Data: catalog.ThingDescription{"id": fmt.Sprintf("urn:example:%d:%d", w, i)},
+					})
+					if err != nil {
+						t.Errorf("Error adding event: %s", err)
+						return
+					}
+					id, _ := strconv.ParseUint(event.ID, 16, 64)
+					mu.Lock()
+					if ids[id] {
+						t.Errorf("Duplicate id: %s", event.ID)
+					}
+					ids[id] = true
+					mu.Unlock()
+				}
+			}(w)
+		}
+		wg.Wait()
+		return ids
+	}
+
+	t.Run("unique ids", func(t *testing.T) {
+		queue := setupEventQueue(t, RetentionConfig{MaxEvents: writers * events})
+		ids := add(t, queue)
+		for id := uint64(1); id <= writers*events; id++ {
+			if !ids[id] {
+				t.Fatalf("Missing id %x", id)
+			}
+		}
+
+		stored, err := queue.getAllAfter("0")
+		if err != nil {
+			t.Fatalf("Error getting events: %s", err)
+		}
+		if len(stored) != writers*events {
+			t.Fatalf("Expected %d stored events, got %d", writers*events, len(stored))
+		}
+		for i, event := range stored {
+			if event.ID != strconv.FormatUint(uint64(i+1), 16) {
+				t.Fatalf("Expected event %x at position %d, got %s", i+1, i, event.ID)
+			}
+		}
+		latestID, _ := queue.getLatestID()
+		if latestID != strconv.FormatUint(writers*events, 16) {
+			t.Fatalf("Expected the latest id %x, got %s", writers*events, latestID)
+		}
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		const capacity = 100
+		queue := setupEventQueue(t, RetentionConfig{MaxEvents: capacity})
+		add(t, queue)
+
+		_, err := queue.getAllAfter("0")
+		if err != errEventsGone {
+			t.Fatalf("Expected the rotated out events to be gone, got %v", err)
+		}
+		stored, err := queue.getAllAfter(strconv.FormatUint(writers*events-capacity, 16))
+		if err != nil {
+			t.Fatalf("Error getting events: %s", err)
+		}
+		if len(stored) != capacity || stored[0].ID != strconv.FormatUint(writers*events-capacity+1, 16) {
+			t.Fatalf("Expected the latest %d events, got %d starting from %s", capacity, len(stored), stored[0].ID)
+		}
+	})
+}
+
+func TestLevelDBEventQueueRetention(t *testing.T) {
+	add := func(t *testing.T, queue EventQueue, n int) {
+		for i := 0; i < n; i++ {
+			_, err := queue.addRotate(Event{Type: wot.EventTypeCreate, Data: catalog.ThingDescription{"id": "urn:example:lamp"}})
+			if err != nil {
+				t.Fatalf("Error adding event: %s", err)
+			}
+		}
+	}
+
+	t.Run("count", func(t *testing.T) {
+		queue := setupEventQueue(t, RetentionConfig{MaxEvents: 3})
+		add(t, queue, 5)
+
+		for id, gone := range map[string]bool{"0": true, "1": true, "2": false, "4": false, "5": false, "6": true} {
+			_, err := queue.getAllAfter(id)
+			if gone && err != errEventsGone || !gone && err != nil {
+				t.Fatalf("Expected gone=%t for the events after %s, got %v", gone, id, err)
+			}
+		}
+	})
+
+	t.Run("age", func(t *testing.T) {
+		defaultInterval := retentionCleanupInterval
+		retentionCleanupInterval = 100 * time.Millisecond
+		defer func() { retentionCleanupInterval = defaultInterval }()
+
+		queue := setupEventQueue(t, RetentionConfig{MaxAge: 1})
+		add(t, queue, 3)
+		stored, err := queue.getAllAfter("0")
+		if err != nil || len(stored) != 3 {
+			t.Fatalf("Expected 3 events, got %d: %v", len(stored), err)
+		}
+
+		time.Sleep(1500 * time.Millisecond)
+		// the latest event is kept to continue the ids
+		_, err = queue.getAllAfter("0")
+		if err != errEventsGone {
+			t.Fatalf("Expected the expired events to be gone, got %v", err)
+		}
+		stored, err = queue.getAllAfter("2")
+		if err != nil || len(stored) != 1 || stored[0].ID != "3" {
+			t.Fatalf("Expected the latest event, got %v: %v", stored, err)
+		}
+	})
+}
+
+func TestControllerConcurrentNotifications(t *testing.T) {
+	const n = 200
+	controller := setupWithQueue(t, QueueConfig{Size: n})
+	client := make(chan Event)
+	err := controller.subscribe(subscriber{client: client, eventTypes: allEventTypes})
+	if err != nil {
+		t.Fatalf("Error subscribing: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := controller.CreateHandler(catalog.ThingDescription{"id": fmt.Sprintf("urn:example:%d", i)})
+			if err != nil {
+				t.Errorf("Error notifying: %s", err)
+			}
+		}(i)
+	}
+
+	// the subscriber gets the events in the order of the ids
+	var previous uint64
+	for i := 0; i < n; i++ {
+		event := <-client
+		id, err := strconv.ParseUint(event.ID, 16, 64)
+		if err != nil || id != previous+1 {
+			t.Fatalf("Expected event %x after %x, got %s", previous+1, previous, event.ID)
+		}
+		previous = id
+	}
+	wg.Wait()
+}
+
+func TestLevelDBEventQueueEncoding(t *testing.T) {
+	lamp := catalog.ThingDescription{"id": "urn:example:lamp", "title": "Lamp", "description": "A lamp"}
+	renamed := catalog.ThingDescription{"id": "urn:example:lamp", "title": "Kitchen Lamp", "tags": []interface{}{"kitchen"}}
+	patch, err := diff(lamp, renamed)
+	if err != nil {
+		t.Fatalf("Error creating diff: %s", err)
+	}
+
+	events := []Event{
+		{Type: wot.EventTypeCreate, Data: lamp, Current: lamp},
+		{Type: wot.EventTypeUpdate, Data: patch, Current: renamed, Previous: lamp},
+		{Type: wot.EventTypeExpiring, Data: registration(renamed), Current: renamed, Previous: renamed},
+		{Type: wot.EventTypeDelete, Data: catalog.ThingDescription{"id": "urn:example:lamp"}, Previous: renamed},
+		// without the TDs
+		{Type: wot.EventTypeCreate, Data: lamp},
+	}
+	queue := setupEventQueue(t, RetentionConfig{MaxEvents: 10})
+	for i := range events {
+		events[i], err = queue.addRotate(events[i])
+		if err != nil {
+			t.Fatalf("Error adding event: %s", err)
+		}
+	}
+
+	stored, err := queue.getAllAfter("0")
+	if err != nil {
+		t.Fatalf("Error getting events: %s", err)
+	}
+	// compare as JSON, same as sent to the subscribers
+	expected, _ := json.Marshal(events)
+	got, _ := json.Marshal(stored)
+	if string(got) != string(expected) {
+		t.Fatalf("Expected stored events:\n%s\ngot:\n%s", expected, got)
+	}
+
+	t.Run("compact encoding", func(t *testing.T) {
+		b, err := encodeEvent(events[1])
+		if err != nil {
+			t.Fatalf("Error encoding event: %s", err)
+		}
+		var stored map[string]interface{}
+		json.Unmarshal(b, &stored)
+		if stored["current"] != nil || stored["previous"] != nil || stored["td"] == nil || stored["undo"] == nil {
+			t.Fatalf("Expected the updated TD and the patch reverting it, got %s", b)
+		}
+	})
+
+	t.Run("null members", func(t *testing.T) {
+		previous := catalog.ThingDescription{"id": "urn:example:lamp", "title": "Lamp", "description": nil}
+		event := Event{Type: wot.EventTypeUpdate, Data: patch, Current: renamed, Previous: previous}
+		b, err := encodeEvent(event)
+		if err != nil {
+			t.Fatalf("Error encoding event: %s", err)
+		}
+		decoded, err := decodeEvent(b)
+		if err != nil {
+			t.Fatalf("Error decoding event: %s", err)
+		}
+		if !reflect.DeepEqual(decoded.Previous, previous) {
+			t.Fatalf("Expected the previous TD %v, got %v", previous, decoded.Previous)
+		}
+		if !reflect.DeepEqual(decoded.Current, renamed) {
+			t.Fatalf("Expected the current TD %v, got %v", renamed, decoded.Current)
+		}
+	})
+
+	t.Run("decode full events", func(t *testing.T) {
+		b, _ := json.Marshal(events[1])
+		event, err := decodeEvent(b)
+		if err != nil {
+			t.Fatalf("Error decoding event: %s", err)
+		}
+		got, _ := json.Marshal(event)
+		if string(got) != string(b) {
+			t.Fatalf("Expected %s, got %s", b, got)
+		}
+	})
+}
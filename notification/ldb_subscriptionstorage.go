@@ -0,0 +1,113 @@
+package notification
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/tinyiot/thing-directory/catalog"
+)
+
+// LevelDB storage of webhook subscriptions
+type LevelDBSubscriptionStorage struct {
+	db *leveldb.DB
+	wg sync.WaitGroup
+}
+
+func NewLevelDBSubscriptionStorage(dsn string, opts *opt.Options) (SubscriptionStorage, error) {
+	url, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// Open the database file
+	db, err := leveldb.OpenFile(url.Path, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LevelDBSubscriptionStorage{db: db}, nil
+}
+
+func (s *LevelDBSubscriptionStorage) put(subscription Subscription) error {
+	s.wg.Add(1)
+	defer s.wg.Done()
+
+	bytes, err := json.Marshal(subscription)
+	if err != nil {
+		return fmt.Errorf("error marshalling subscription: %w", err)
+	}
+	return s.db.Put([]byte(subscription.ID), bytes, nil)
+}
+
+func (s *LevelDBSubscriptionStorage) get(id string) (*Subscription, error) {
+	s.wg.Add(1)
+	defer s.wg.Done()
+
+	bytes, err := s.db.Get([]byte(id), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, &catalog.NotFoundError{S: id + " is not found"}
+	} else if err != nil {
+		return nil, err
+	}
+
+	var subscription Subscription
+	err = json.Unmarshal(bytes, &subscription)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling subscription: %w", err)
+	}
+	return &subscription, nil
+}
+
+func (s *LevelDBSubscriptionStorage) delete(id string) error {
+	s.wg.Add(1)
+	defer s.wg.Done()
+
+	found, err := s.db.Has([]byte(id), nil)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return &catalog.NotFoundError{S: id + " is not found"}
+	}
+	return s.db.Delete([]byte(id), nil)
+}
+
+func (s *LevelDBSubscriptionStorage) list() ([]Subscription, error) {
+	s.wg.Add(1)
+	defer s.wg.Done()
+
+	var subscriptions []Subscription
+	iter := s.db.NewIterator(nil, nil)
+	for iter.Next() {
+		var subscription Subscription
+		err := json.Unmarshal(iter.Value(), &subscription)
+		if err != nil {
+			iter.Release()
+			return nil, fmt.Errorf("error unmarshalling subscription: %w", err)
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	iter.Release()
+	err := iter.Error()
+	if err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+func (s *LevelDBSubscriptionStorage) Close() {
+	s.wg.Wait()
+	err := s.db.Close()
+	if err != nil {
+		log.Printf("Error closing subscription storage: %s", err)
+	}
+	if flag.Lookup("test.v") == nil {
+		log.Println("Closed subscription leveldb.")
+	}
+}
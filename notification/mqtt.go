@@ -0,0 +1,174 @@
+package notification
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/tinyiot/thing-directory/catalog"
+	"github.com/tinyiot/thing-directory/wot"
+)
+
+const (
+	DefaultMQTTTopicPrefix = "tdd/"
+	// DefaultMQTTMaxReconnectInterval is the upper bound of the backoff between reconnection attempts
+	DefaultMQTTMaxReconnectInterval = time.Minute
+	// mqttTimeout is the timeout of connecting and publishing before the messages are left to the reconnection
+	mqttTimeout = 10 * time.Second
+	// mqttDisconnectQuiesce is the time in milliseconds to complete the pending work when disconnecting
+	mqttDisconnectQuiesce = 250
+)
+
+// MQTTConfig configures the publication of the events to an MQTT broker
+type MQTTConfig struct {
+	Enabled bool `json:"enabled"`
+	// BrokerURL is the address of the broker e.g. tcp://localhost:1883 or ssl://broker:8883
+	BrokerURL string `json:"brokerURL"`
+	// ClientID should be stable across restarts to resume the session with the broker
+	ClientID string `json:"clientID"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// QoS of the published messages. Messages with QoS 1 and 2 are queued while disconnected and sent after reconnecting.
+	QoS byte `json:"qos"`
+	// TopicPrefix is prepended to all topics. Default: tdd/
+	TopicPrefix string `json:"topicPrefix"`
+	// MaxReconnectInterval is the maximum backoff between reconnection attempts in seconds. Default: 60
+	MaxReconnectInterval int `json:"maxReconnectInterval"`
+}
+
+// MQTTPublisher is an event listener that publishes the events to an MQTT broker:
+//   - {prefix}things/{id}/{event} gets each event, e.g. tdd/things/urn:example:lamp/thing_updated
+//     with the created TD, the changed attributes, the id of the deleted TD, or the id and registration of the expiring TD
+//   - {prefix}things/{id} holds the current TD as a retained message, cleared when the TD is deleted
+type MQTTPublisher struct {
+	client paho.Client
+	qos    byte
+	prefix string
+}
+
+// NewMQTTPublisher connects to the broker. If the broker is unavailable, connection is retried in the background.
+func NewMQTTPublisher(conf MQTTConfig) (*MQTTPublisher, error) {
+	if conf.QoS > 2 {
+		return nil, fmt.Errorf("invalid QoS: %d", conf.QoS)
+	}
+	prefix := conf.TopicPrefix
+	if prefix == "" {
+		prefix = DefaultMQTTTopicPrefix
+	}
+	maxReconnectInterval := DefaultMQTTMaxReconnectInterval
+	if conf.MaxReconnectInterval > 0 {
+		maxReconnectInterval = time.Duration(conf.MaxReconnectInterval) * time.Second
+	}
+
+	opts := paho.NewClientOptions().
+		AddBroker(conf.BrokerURL).
+		SetClientID(conf.ClientID).
+		SetUsername(conf.Username).
+		SetPassword(conf.Password).
+		// keep the session to send the messages that were queued while disconnected
+		SetCleanSession(false).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetMaxReconnectInterval(maxReconnectInterval).
+		SetWriteTimeout(mqttTimeout).
+		SetOnConnectHandler(func(paho.Client) {
+			log.Printf("MQTT: Connected to %s", conf.BrokerURL)
+		}).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			log.Printf("MQTT: Connection to %s lost: %s. Reconnecting...", conf.BrokerURL, err)
+		})
+
+	client := paho.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(mqttTimeout) {
+		log.Printf("MQTT: Broker %s is not reachable. Retrying in the background.", conf.BrokerURL)
+	} else if token.Error() != nil {
+		return nil, fmt.Errorf("error connecting to the MQTT broker: %s", token.Error())
+	}
+
+	return &MQTTPublisher{
+		client: client,
+		qos:    conf.QoS,
+		prefix: prefix,
+	}, nil
+}
+
+// topicEscaper escapes the characters of TD ids that are topic level separators or wildcards
+var topicEscaper = strings.NewReplacer("%", "%25", "/", "%2F", "+", "%2B", "#", "%23")
+
+func (p *MQTTPublisher) thingTopic(td catalog.ThingDescription) string {
+	id, _ := td[wot.KeyThingID].(string)
+	return p.prefix + "things/" + topicEscaper.Replace(id)
+}
+
+func (p *MQTTPublisher) CreateHandler(new catalog.ThingDescription) error {
+	err := p.publishJSON(p.thingTopic(new), true, new)
+	if err != nil {
+		return err
+	}
+	return p.publishJSON(p.thingTopic(new)+"/"+string(wot.EventTypeCreate), false, new)
+}
+
+func (p *MQTTPublisher) UpdateHandler(old catalog.ThingDescription, new catalog.ThingDescription) error {
+	td, err := diff(old, new)
+	if err != nil {
+		return err
+	}
+	err = p.publishJSON(p.thingTopic(new), true, new)
+	if err != nil {
+		return err
+	}
+	return p.publishJSON(p.thingTopic(new)+"/"+string(wot.EventTypeUpdate), false, td)
+}
+
+func (p *MQTTPublisher) DeleteHandler(old catalog.ThingDescription) error {
+	// an empty retained message removes the retained TD
+	err := p.publish(p.thingTopic(old), true, []byte{})
+	if err != nil {
+		return err
+	}
+	deleted := catalog.ThingDescription{
+		wot.KeyThingID: old[wot.KeyThingID],
+	}
+	return p.publishJSON(p.thingTopic(old)+"/"+string(wot.EventTypeDelete), false, deleted)
+}
+
+func (p *MQTTPublisher) ExpiringHandler(td catalog.ThingDescription) error {
+	return p.publishJSON(p.thingTopic(td)+"/"+string(wot.EventTypeExpiring), false, registration(td))
+}
+
+func (p *MQTTPublisher) publishJSON(topic string, retained bool, td catalog.ThingDescription) error {
+	b, err := json.Marshal(td)
+	if err != nil {
+		return fmt.Errorf("error marshalling TD: %s", err)
+	}
+	return p.publish(topic, retained, b)
+}
+
+func (p *MQTTPublisher) publish(topic string, retained bool, payload []byte) error {
+	token := p.client.Publish(topic, p.qos, retained, payload)
+	if !p.client.IsConnectionOpen() {
+		// messages with QoS > 0 are stored and sent after reconnecting
+		if p.qos == 0 {
+			log.Printf("MQTT: Not connected. Dropped the message to %s", topic)
+		}
+		return nil
+	}
+	if !token.WaitTimeout(mqttTimeout) {
+		// the message is sent after reconnecting if QoS > 0
+		log.Printf("MQTT: Publishing to %s has not completed. Continuing in the background.", topic)
+		return nil
+	}
+	if token.Error() != nil {
+		return fmt.Errorf("error publishing to %s: %s", topic, token.Error())
+	}
+	return nil
+}
+
+// Stop disconnects from the broker
+func (p *MQTTPublisher) Stop() {
+	p.client.Disconnect(mqttDisconnectQuiesce)
+}
@@ -0,0 +1,196 @@
+package notification
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	mqtt "github.com/mochi-co/mqtt/server"
+	"github.com/mochi-co/mqtt/server/listeners"
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+	uuid "github.com/satori/go.uuid"
+	"github.com/tinyiot/thing-directory/catalog"
+)
+
+// freeAddr returns a local address that is available for listening
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error getting a free port: %s", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// startBroker starts an in-process broker
+func startBroker(t *testing.T, addr string) *mqtt.Server {
+	broker := mqtt.New()
+	err := broker.AddListener(listeners.NewTCP("tcp", addr), &listeners.Config{Auth: new(auth.Allow)})
+	if err != nil {
+		t.Fatalf("Error adding broker listener: %s", err)
+	}
+	err = broker.Serve()
+	if err != nil {
+		t.Fatalf("Error starting broker: %s", err)
+	}
+	return broker
+}
+
+// subscribeBroker returns the messages of the topic filter
+func subscribeBroker(t *testing.T, addr, topic string) chan paho.Message {
+	messages := make(chan paho.Message, 10)
+	client := paho.NewClient(paho.NewClientOptions().
+		AddBroker("tcp://" + addr).
+		SetClientID(uuid.NewV4().String()))
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("Error connecting subscriber: %s", token.Error())
+	}
+	t.Cleanup(func() { client.Disconnect(0) })
+
+	token := client.Subscribe(topic, 1, func(_ paho.Client, m paho.Message) {
+		messages <- m
+	})
+	if token.Wait() && token.Error() != nil {
+		t.Fatalf("Error subscribing: %s", token.Error())
+	}
+	return messages
+}
+
+func receiveMessage(t *testing.T, messages chan paho.Message) paho.Message {
+	select {
+	case m := <-messages:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timeout waiting for a message")
+		return nil
+	}
+}
+
+func expectMessage(t *testing.T, messages chan paho.Message, topic string, expected catalog.ThingDescription) {
+	m := receiveMessage(t, messages)
+	if m.Topic() != topic {
+		t.Fatalf("Expected message on %s, got %s", topic, m.Topic())
+	}
+	var td catalog.ThingDescription
+	err := json.Unmarshal(m.Payload(), &td)
+	if err != nil {
+		t.Fatalf("Error unmarshalling the payload on %s: %s", topic, err)
+	}
+	if !reflect.DeepEqual(td, expected) {
+		t.Fatalf("Expected %v on %s, got %v", expected, topic, td)
+	}
+}
+
+func TestMQTTPublisher(t *testing.T) {
+	addr := freeAddr(t)
+	broker := startBroker(t, addr)
+	defer broker.Close()
+
+	publisher, err := NewMQTTPublisher(MQTTConfig{
+		BrokerURL: "tcp://" + addr,
+		ClientID:  "tdd-test",
+		QoS:       1,
+	})
+	if err != nil {
+		t.Fatalf("Error creating publisher: %s", err)
+	}
+	defer publisher.Stop()
+
+	messages := subscribeBroker(t, addr, "tdd/things/#")
+
+	// the slash in the id is escaped to keep the topic levels
+	const thingTopic = "tdd/things/urn:example:lamp%2F1"
+	lamp := catalog.ThingDescription{"id": "urn:example:lamp/1", "title": "Lamp"}
+
+	t.Run("create", func(t *testing.T) {
+		err := publisher.CreateHandler(lamp)
+		if err != nil {
+			t.Fatalf("Error publishing: %s", err)
+		}
+		expectMessage(t, messages, thingTopic, lamp)
+		expectMessage(t, messages, thingTopic+"/thing_created", lamp)
+	})
+
+	updated := catalog.ThingDescription{"id": "urn:example:lamp/1", "title": "Kitchen Lamp"}
+	t.Run("update", func(t *testing.T) {
+		err := publisher.UpdateHandler(lamp, updated)
+		if err != nil {
+			t.Fatalf("Error publishing: %s", err)
+		}
+		expectMessage(t, messages, thingTopic, updated)
+		expectMessage(t, messages, thingTopic+"/thing_updated", updated)
+	})
+
+	t.Run("expiring", func(t *testing.T) {
+		expiring := catalog.ThingDescription{"id": "urn:example:lamp/1", "title": "Kitchen Lamp", "registration": map[string]interface{}{"expires": "2021-01-01T00:00:00Z"}}
+		err := publisher.ExpiringHandler(expiring)
+		if err != nil {
+			t.Fatalf("Error publishing: %s", err)
+		}
+		expectMessage(t, messages, thingTopic+"/thing_expiring", catalog.ThingDescription{"id": "urn:example:lamp/1", "registration": map[string]interface{}{"expires": "2021-01-01T00:00:00Z"}})
+	})
+
+	t.Run("retained", func(t *testing.T) {
+		m := receiveMessage(t, subscribeBroker(t, addr, "tdd/things/+"))
+		if !m.Retained() || m.Topic() != thingTopic {
+			t.Fatalf("Expected the retained TD on %s, got %s retained=%v", thingTopic, m.Topic(), m.Retained())
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		err := publisher.DeleteHandler(updated)
+		if err != nil {
+			t.Fatalf("Error publishing: %s", err)
+		}
+		m := receiveMessage(t, messages)
+		if m.Topic() != thingTopic || len(m.Payload()) != 0 {
+			t.Fatalf("Expected empty message on %s, got %s on %s", thingTopic, m.Payload(), m.Topic())
+		}
+		expectMessage(t, messages, thingTopic+"/thing_deleted", catalog.ThingDescription{"id": "urn:example:lamp/1"})
+
+		// the retained TD is removed
+		select {
+		case m := <-subscribeBroker(t, addr, "tdd/things/+"):
+			t.Fatalf("Unexpected message on %s after deletion: %s", m.Topic(), m.Payload())
+		case <-time.After(200 * time.Millisecond):
+		}
+	})
+}
+
+func TestMQTTPublisherReconnect(t *testing.T) {
+	addr := freeAddr(t)
+	broker := startBroker(t, addr)
+
+	publisher, err := NewMQTTPublisher(MQTTConfig{
+		BrokerURL:            "tcp://" + addr,
+		ClientID:             "tdd-test",
+		QoS:                  1,
+		MaxReconnectInterval: 1,
+	})
+	if err != nil {
+		t.Fatalf("Error creating publisher: %s", err)
+	}
+	defer publisher.Stop()
+
+	broker.Close()
+	for start := time.Now(); publisher.client.IsConnectionOpen(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Publisher did not detect the closed connection")
+		}
+	}
+
+	// queued while disconnected
+	lamp := catalog.ThingDescription{"id": "urn:example:lamp", "title": "Lamp"}
+	err = publisher.CreateHandler(lamp)
+	if err != nil {
+		t.Fatalf("Error publishing while disconnected: %s", err)
+	}
+
+	broker = startBroker(t, addr)
+	defer broker.Close()
+
+	expectMessage(t, subscribeBroker(t, addr, "tdd/things/+"), "tdd/things/urn:example:lamp", lamp)
+}
@@ -1,25 +1,148 @@
 package notification
 
 import (
+	"errors"
+	"time"
+
 	"github.com/tinyiot/thing-directory/catalog"
 	"github.com/tinyiot/thing-directory/wot"
 )
 
+// allEventTypes are the event types of subscriptions that do not select any
+var allEventTypes = []wot.EventType{wot.EventTypeCreate, wot.EventTypeUpdate, wot.EventTypeDelete, wot.EventTypeExpiring}
+
 type Event struct {
 	ID   string                   `json:"id"`
 	Type wot.EventType            `json:"event"`
 	Data catalog.ThingDescription `json:"data"`
+	// Current and Previous are the full TDs after and before the change. They are used to filter the events of subscribers.
+	// They are not part of the payloads, but sent as the data when requested.
+	Current  catalog.ThingDescription `json:"-"`
+	Previous catalog.ThingDescription `json:"-"`
+	// Timestamp is the time of adding the event to the queue
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// EventTypeOverflow is the last event sent to a subscriber that is disconnected for not keeping up with the events.
+// Its ID is the latest event sent before, to resume the subscription from.
+const EventTypeOverflow wot.EventType = "overflow"
+
+// EventTypeReset is sent instead of the missed events when they are no longer retained in the queue.
+// The subscriber should resync the TDs e.g. by listing them. Its ID is the latest event, to resume the subscription from.
+const EventTypeReset wot.EventType = "reset"
+
+// errControllerStopped is returned when subscribing after the controller is stopped
+var errControllerStopped = errors.New("notification controller is stopped")
+
+// errEventsGone is returned when the events after the requested ID are no longer retained
+var errEventsGone = errors.New("events after the requested ID are no longer retained")
+
+// OverflowPolicy defines what happens to new events when the queue of a slow subscriber is full
+type OverflowPolicy string
+
+const (
+	// OverflowDropOldest discards the oldest queued event
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+	// OverflowDisconnect ends the subscription with an EventTypeOverflow event
+	OverflowDisconnect OverflowPolicy = "disconnect"
+
+	DefaultSubscriberQueueSize = 100
+)
+
+// QueueConfig bounds the events queued for each subscriber
+type QueueConfig struct {
+	// Size is the maximum number of queued events. Default: 100
+	Size int `json:"size"`
+	// Overflow is the policy when the queue is full. Default: drop-oldest
+	Overflow OverflowPolicy `json:"overflow"`
+}
+
+// DiffFormat is the format of the changes in the payload of thing_updated events
+type DiffFormat string
+
+const (
+	// DiffFormatMergePatch is a JSON Merge Patch (RFC 7396) of the TD, including the id
+	DiffFormatMergePatch DiffFormat = "merge-patch"
+	// DiffFormatJSONPatch is a JSON Patch (RFC 6902) in the "patch" attribute, along with the id of the TD.
+	// Unlike merge patches, it changes the elements of arrays such as forms individually.
+	DiffFormatJSONPatch DiffFormat = "json-patch"
+)
+
+const (
+	DefaultSSEHeartbeat = 30
+	DefaultSSERetry     = 3
+)
+
+// SSEConfig configures the streams of the Server-Sent Events API
+type SSEConfig struct {
+	// Heartbeat is the interval in seconds of the comments that keep idle connections open. Default: 30
+	Heartbeat int `json:"heartbeat"`
+	// Retry is the reconnection time in seconds advised to the clients, also after rejecting them for the limit. Default: 3
+	Retry int `json:"retry"`
+	// MaxSubscribers limits the concurrent streams. Unlimited when 0.
+	MaxSubscribers int `json:"maxSubscribers"`
+}
+
+// WebSocketConfig configures the connections of the WebSocket API
+type WebSocketConfig struct {
+	// AllowedOrigins are the origins of web pages, other than the directory's, that may connect e.g. https://dashboard.example.com
+	// All origins are allowed with "*".
+	AllowedOrigins []string `json:"allowedOrigins"`
+}
+
+const DefaultRetentionMaxEvents = 1000
+
+// RetentionConfig limits the events kept in the queue for replay. The latest event is always kept.
+type RetentionConfig struct {
+	// MaxEvents is the maximum number of retained events. Default: 1000
+	MaxEvents uint64 `json:"maxEvents"`
+	// MaxAge is the maximum age of the retained events in seconds. Unlimited when 0.
+	MaxAge int `json:"maxAge"`
+}
+
+// historyQuery selects the stored events
+type historyQuery struct {
+	// from and to limit the timestamps of the events to [from, to) when not zero
+	from, to time.Time
+	// types are the event types. All types when empty.
+	types   []wot.EventType
+	thingID string
+	// after is the ID of the event to continue after, e.g. the last one of the previous page
+	after string
+	limit int
+}
+
+// Stats are the metrics of the delivery of events to the subscribers
+type Stats struct {
+	Subscribers int `json:"subscribers"`
+	// QueuedEvents are waiting to be sent to slow subscribers
+	QueuedEvents int `json:"queuedEvents"`
+	// DroppedEvents were discarded from full queues
+	DroppedEvents uint64 `json:"droppedEvents"`
+	// Disconnects are the subscriptions ended by full queues
+	Disconnects uint64 `json:"disconnects"`
 }
 
 // NotificationController interface
 type NotificationController interface {
-	// subscribe to the events. the caller will get events through the channel 'client' starting from 'lastEventID'
-	subscribe(client chan Event, eventTypes []wot.EventType, diff bool, lastEventID string) error
+	// subscribe to the events. the subscriber will get events through the channel 'client' starting from 'lastEventID'
+	// A non-nil filter limits the events to those about the matching TDs
+	subscribe(s subscriber) error
 
 	// unsubscribe and close the channel 'client'
 	unsubscribe(client chan Event) error
 
-	// Stop the controller
+	// stats returns the metrics of the subscriptions
+	stats() Stats
+
+	// history returns the stored events matching the query
+	history(q historyQuery) ([]Event, error)
+
+	// changes returns up to limit stored events after the ID, or a reset event if some of them are no longer retained
+	// Without the ID, the events are returned from the oldest retained one.
+	changes(since string, limit int) ([]Event, error)
+
+	// Stop the controller, ending all subscriptions
 	Stop()
 
 	catalog.EventListener
@@ -27,15 +150,35 @@ type NotificationController interface {
 
 // EventQueue interface
 type EventQueue interface {
-	//addRotate adds new and delete the old event if the event queue is full
-	addRotate(event Event) error
+	// addRotate assigns a new ID to the event and adds it, deleting the oldest events beyond the retention
+	// The ID allocation and the write are atomic, so the IDs are increasing in the order of the stored events.
+	addRotate(event Event) (Event, error)
 
 	// getAllAfter gets the events after the event ID
+	// It returns errEventsGone if some of them are no longer retained.
 	getAllAfter(id string) ([]Event, error)
 
-	// getNewID creates a new ID for the event
-	getNewID() (string, error)
+	// history gets the events matching the query, in the order of the IDs
+	history(q historyQuery) ([]Event, error)
+
+	// getLatestID returns the ID of the latest event
+	getLatestID() (string, error)
 
 	// Close all the resources acquired by the queue implementation
 	Close()
 }
+
+// SubscriptionStorage interface of webhook subscriptions
+type SubscriptionStorage interface {
+	// put adds or replaces the subscription
+	put(subscription Subscription) error
+
+	get(id string) (*Subscription, error)
+
+	delete(id string) error
+
+	list() ([]Subscription, error)
+
+	// Close all the resources acquired by the storage implementation
+	Close()
+}
@@ -0,0 +1,186 @@
+package notification
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tinyiot/thing-directory/catalog"
+)
+
+// KeyPatch is the attribute of the JSON Patch in the data of thing_updated events
+const KeyPatch = "patch"
+
+// patchOperation is an operation of a JSON Patch (RFC 6902)
+type patchOperation struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	// Value is set for add and replace, including null values
+	Value *interface{} `json:"value,omitempty"`
+}
+
+// createJSONPatch returns the operations that turn the old TD into the new one
+// Objects and arrays are compared member by member, so that only the changed values are replaced.
+// Array elements are matched by the longest common subsequence, so that elements inserted or removed
+// anywhere, e.g. the first form, are added or removed individually.
+func createJSONPatch(old, new catalog.ThingDescription) ([]patchOperation, error) {
+	// compare the values as decoded from JSON
+	var a, b interface{}
+	err := normalize(old, &a)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling old TD: %w", err)
+	}
+	err = normalize(new, &b)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling new TD: %w", err)
+	}
+	patch := []patchOperation{}
+	diffValues("", a, b, &patch)
+	return patch, nil
+}
+
+func normalize(td catalog.ThingDescription, v *interface{}) error {
+	b, err := json.Marshal(td)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func diffValues(path string, a, b interface{}, patch *[]patchOperation) {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		if b, ok := b.(map[string]interface{}); ok {
+			diffObjects(path, a, b, patch)
+			return
+		}
+	case []interface{}:
+		if b, ok := b.([]interface{}); ok {
+			diffArrays(path, a, b, patch)
+			return
+		}
+	}
+	if !reflect.DeepEqual(a, b) {
+		*patch = append(*patch, patchOperation{Op: "replace", Path: path, Value: &b})
+	}
+}
+
+func diffObjects(path string, a, b map[string]interface{}, patch *[]patchOperation) {
+	// sorted keys give the same patch for the same change
+	keys := make([]string, 0, len(a)+len(b))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, found := a[key]; !found {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		keyPath := path + "/" + escapePointer(key)
+		oldValue, inOld := a[key]
+		newValue, inNew := b[key]
+		switch {
+		case !inNew:
+			*patch = append(*patch, patchOperation{Op: "remove", Path: keyPath})
+		case !inOld:
+			*patch = append(*patch, patchOperation{Op: "add", Path: keyPath, Value: &newValue})
+		default:
+			diffValues(keyPath, oldValue, newValue, patch)
+		}
+	}
+}
+
+// maxArrayDiffSize limits the size of the table of the longest common subsequence. Larger arrays are compared by position.
+const maxArrayDiffSize = 1 << 20
+
+func diffArrays(path string, a, b []interface{}, patch *[]patchOperation) {
+	if (len(a)+1)*(len(b)+1) > maxArrayDiffSize {
+		diffArraysByPosition(path, a, b, patch)
+		return
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case reflect.DeepEqual(a[i], b[j]):
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	// index is the position in the array as patched so far
+	var index int
+	var removed, added []interface{}
+	// flush changes the elements between the common ones: pairs of removed and added elements are diffed
+	flush := func() {
+		for k := range removed {
+			if k < len(added) {
+				diffValues(path+"/"+strconv.Itoa(index), removed[k], added[k], patch)
+				index++
+			} else {
+				*patch = append(*patch, patchOperation{Op: "remove", Path: path + "/" + strconv.Itoa(index)})
+			}
+		}
+		for k := len(removed); k < len(added); k++ {
+			value := added[k]
+			*patch = append(*patch, patchOperation{Op: "add", Path: path + "/" + strconv.Itoa(index), Value: &value})
+			index++
+		}
+		removed, added = nil, nil
+	}
+	for i, j := 0, 0; i < len(a) || j < len(b); {
+		switch {
+		case i < len(a) && j < len(b) && reflect.DeepEqual(a[i], b[j]):
+			flush()
+			index++
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			added = append(added, b[j])
+			j++
+		default:
+			removed = append(removed, a[i])
+			i++
+		}
+	}
+	flush()
+}
+
+// diffArraysByPosition compares the elements at the same index, and adds or removes the elements at the end
+func diffArraysByPosition(path string, a, b []interface{}, patch *[]patchOperation) {
+	common := len(a)
+	if len(b) < common {
+		common = len(b)
+	}
+	for i := 0; i < common; i++ {
+		diffValues(path+"/"+strconv.Itoa(i), a[i], b[i], patch)
+	}
+	for i := common; i < len(b); i++ {
+		value := b[i]
+		*patch = append(*patch, patchOperation{Op: "add", Path: path + "/" + strconv.Itoa(i), Value: &value})
+	}
+	// remove from the end, to keep the indices of the remaining elements
+	for i := len(a) - 1; i >= common; i-- {
+		*patch = append(*patch, patchOperation{Op: "remove", Path: path + "/" + strconv.Itoa(i)})
+	}
+}
+
+// escapePointer escapes the reference token of a JSON Pointer (RFC 6901)
+func escapePointer(token string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(token)
+}
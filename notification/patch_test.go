@@ -0,0 +1,147 @@
+package notification
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/tinyiot/thing-directory/catalog"
+	"github.com/tinyiot/thing-directory/wot"
+)
+
+func TestCreateJSONPatch(t *testing.T) {
+	old := catalog.ThingDescription{
+		"id":    "urn:example:lamp",
+		"title": "Lamp",
+		"a/b~c": true,
+		"forms": []interface{}{
+			map[string]interface{}{"href": "http://lamp.local/status", "op": "readproperty"},
+			map[string]interface{}{"href": "http://lamp.local/toggle", "op": "invokeaction"},
+			map[string]interface{}{"href": "http://lamp.local/dim", "op": "invokeaction"},
+		},
+	}
+	new := catalog.ThingDescription{
+		"id":          "urn:example:lamp",
+		"title":       "Lamp",
+		"description": "",
+		"a/b~c":       false,
+		"forms": []interface{}{
+			map[string]interface{}{"href": "https://lamp.local/status", "op": "readproperty"},
+			map[string]interface{}{"href": "http://lamp.local/toggle", "op": "invokeaction"},
+		},
+	}
+
+	patch, err := createJSONPatch(old, new)
+	if err != nil {
+		t.Fatalf("Error creating patch: %s", err)
+	}
+	b, err := json.Marshal(patch)
+	if err != nil {
+		t.Fatalf("Error marshalling patch: %s", err)
+	}
+
+	expected := `[{"op":"replace","path":"/a~1b~0c","value":false},{"op":"add","path":"/description","value":""},` +
+		`{"op":"replace","path":"/forms/0/href","value":"https://lamp.local/status"},{"op":"remove","path":"/forms/2"}]`
+	if string(b) != expected {
+		t.Fatalf("Unexpected patch:\n%s\nexpected:\n%s", b, expected)
+	}
+
+	// the patch turns the old TD into the new one
+	decoded, err := jsonpatch.DecodePatch(b)
+	if err != nil {
+		t.Fatalf("Error decoding patch: %s", err)
+	}
+	oldJSON, _ := json.Marshal(old)
+	patched, err := decoded.Apply(oldJSON)
+	if err != nil {
+		t.Fatalf("Error applying patch: %s", err)
+	}
+	var result, newNormalized interface{}
+	_ = json.Unmarshal(patched, &result)
+	_ = normalize(new, &newNormalized)
+	if !reflect.DeepEqual(result, newNormalized) {
+		t.Fatalf("Patched TD %s does not match the new TD", patched)
+	}
+}
+
+func TestCreateJSONPatchArrays(t *testing.T) {
+	form := func(op string) interface{} {
+		return map[string]interface{}{"href": "http://lamp.local/" + op, "op": op}
+	}
+	cases := []struct {
+		name     string
+		old, new []interface{}
+		expected string
+	}{
+		{"remove first", []interface{}{form("a"), form("b"), form("c")}, []interface{}{form("b"), form("c")},
+			`[{"op":"remove","path":"/forms/0"}]`},
+		{"insert first", []interface{}{form("b"), form("c")}, []interface{}{form("a"), form("b"), form("c")},
+			`[{"op":"add","path":"/forms/0","value":{"href":"http://lamp.local/a","op":"a"}}]`},
+		{"remove middle and append", []interface{}{form("a"), form("b"), form("c")}, []interface{}{form("a"), form("c"), form("d")},
+			`[{"op":"remove","path":"/forms/1"},{"op":"add","path":"/forms/2","value":{"href":"http://lamp.local/d","op":"d"}}]`},
+		{"change middle", []interface{}{"a", "b", "c"}, []interface{}{"a", "x", "c"},
+			`[{"op":"replace","path":"/forms/1","value":"x"}]`},
+		{"replace all", []interface{}{"a", "b"}, []interface{}{"x", "y", "z"},
+			`[{"op":"replace","path":"/forms/0","value":"x"},{"op":"replace","path":"/forms/1","value":"y"},{"op":"add","path":"/forms/2","value":"z"}]`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			old := catalog.ThingDescription{"id": "urn:example:lamp", "forms": c.old}
+			new := catalog.ThingDescription{"id": "urn:example:lamp", "forms": c.new}
+			patch, err := createJSONPatch(old, new)
+			if err != nil {
+				t.Fatalf("Error creating patch: %s", err)
+			}
+			b, _ := json.Marshal(patch)
+			if string(b) != c.expected {
+				t.Fatalf("Unexpected patch:\n%s\nexpected:\n%s", b, c.expected)
+			}
+
+			decoded, err := jsonpatch.DecodePatch(b)
+			if err != nil {
+				t.Fatalf("Error decoding patch: %s", err)
+			}
+			oldJSON, _ := json.Marshal(old)
+			patched, err := decoded.Apply(oldJSON)
+			if err != nil {
+				t.Fatalf("Error applying patch: %s", err)
+			}
+			newJSON, _ := json.Marshal(new)
+			if !jsonpatch.Equal(patched, newJSON) {
+				t.Fatalf("Patched TD %s does not match the new TD %s", patched, newJSON)
+			}
+		})
+	}
+}
+
+func TestSubscriberJSONPatch(t *testing.T) {
+	old := catalog.ThingDescription{"id": "urn:example:lamp", "title": "Lamp"}
+	new := catalog.ThingDescription{"id": "urn:example:lamp", "title": "Kitchen Lamp"}
+	s := subscriber{eventTypes: allEventTypes, diff: true, diffFormat: DiffFormatJSONPatch}
+
+	e, sent := s.prepare(Event{Type: wot.EventTypeUpdate, Data: catalog.ThingDescription{"id": "urn:example:lamp", "title": "Kitchen Lamp"},
+		Current: new, Previous: old})
+	if !sent || e.Data[wot.KeyThingID] != "urn:example:lamp" || len(e.Data) != 2 {
+		t.Fatalf("Expected update with the id and the patch, got %v", e)
+	}
+	patch, ok := e.Data[KeyPatch].([]patchOperation)
+	if !ok || len(patch) != 1 || patch[0].Op != "replace" || patch[0].Path != "/title" || *patch[0].Value != "Kitchen Lamp" {
+		t.Fatalf("Unexpected patch: %v", e.Data[KeyPatch])
+	}
+
+	// other events are unchanged
+	e, sent = s.prepare(Event{Type: wot.EventTypeCreate, Data: new, Current: new})
+	if !sent || !reflect.DeepEqual(e.Data, new) {
+		t.Fatalf("Expected creation with the TD, got %v", e)
+	}
+
+	for _, invalid := range []struct {
+		diff       bool
+		diffFormat DiffFormat
+	}{{false, DiffFormatJSONPatch}, {true, "xml"}} {
+		if _, ok := validatePayload(invalid.diff, invalid.diffFormat, false).(*catalog.BadRequestError); !ok {
+			t.Fatalf("Expected BadRequestError for diff=%t diffFormat=%s", invalid.diff, invalid.diffFormat)
+		}
+	}
+}
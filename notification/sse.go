@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/tinyiot/thing-directory/catalog"
@@ -13,30 +16,51 @@ import (
 )
 
 const (
-	QueryParamType    = "type"
-	QueryParamFull    = "diff"
-	HeaderLastEventID = "Last-Event-ID"
+	QueryParamType       = "type"
+	PathParamThingID     = "id"
+	QueryParamFull       = "diff"
+	QueryParamDiffFormat = "diffFormat"
+	QueryParamFullTD     = "full"
+	HeaderLastEventID    = "Last-Event-ID"
 )
 
 type SSEAPI struct {
 	controller  NotificationController
 	contentType string
+	// source identifies the directory in the CloudEvents
+	source string
+
+	heartbeat      time.Duration
+	retry          int
+	maxSubscribers int32
+	// subscribers is the number of open streams
+	subscribers int32
 }
 
-func NewSSEAPI(controller NotificationController, version string) *SSEAPI {
+func NewSSEAPI(controller NotificationController, version, source string, config SSEConfig) *SSEAPI {
 	contentType := "text/event-stream"
 	if version != "" {
 		contentType += ";version=" + version
 	}
+	if config.Heartbeat <= 0 {
+		config.Heartbeat = DefaultSSEHeartbeat
+	}
+	if config.Retry <= 0 {
+		config.Retry = DefaultSSERetry
+	}
 	return &SSEAPI{
-		controller:  controller,
-		contentType: contentType,
+		controller:     controller,
+		contentType:    contentType,
+		source:         source,
+		heartbeat:      time.Duration(config.Heartbeat) * time.Second,
+		retry:          config.Retry,
+		maxSubscribers: int32(config.MaxSubscribers),
 	}
 
 }
 
 func (a *SSEAPI) SubscribeEvent(w http.ResponseWriter, req *http.Request) {
-	diff, err := parseQueryParameters(req)
+	s, err := parseQueryParameters(req, "", QueryParamType)
 	if err != nil {
 		catalog.ErrorResponse(w, http.StatusBadRequest, err)
 		return
@@ -46,17 +70,64 @@ func (a *SSEAPI) SubscribeEvent(w http.ResponseWriter, req *http.Request) {
 		catalog.ErrorResponse(w, http.StatusBadRequest, err)
 		return
 	}
+	s.eventTypes = eventTypes
+	a.stream(w, req, s)
+}
+
+// SubscribeThingEvent streams the events of a single TD
+// The creation is included, for streams opened before the TD is registered or re-registered,
+// and for TDs that start matching the filters.
+func (a *SSEAPI) SubscribeThingEvent(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)[PathParamThingID]
+	s, err := parseQueryParameters(req, id, QueryParamType)
+	if err != nil {
+		catalog.ErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	s.eventTypes = allEventTypes
+	a.stream(w, req, s)
+}
+
+// Stats handler returns the metrics of the subscriptions, including the events dropped for slow subscribers
+func (a *SSEAPI) Stats(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, a.controller.stats())
+}
+
+// stream subscribes to the events and writes them to the response until the request is cancelled or the controller is stopped
+// Events missed since the Last-Event-ID header are sent first. Idle streams get heartbeat comments.
+func (a *SSEAPI) stream(w http.ResponseWriter, req *http.Request, s subscriber) {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		catalog.ErrorResponse(w, http.StatusInternalServerError, "Streaming unsupported")
 		return
 	}
-	w.Header().Set("Content-Type", a.contentType)
+	format, err := parseFormat(req)
+	if err != nil {
+		catalog.ErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	if n := atomic.AddInt32(&a.subscribers, 1); a.maxSubscribers > 0 && n > a.maxSubscribers {
+		atomic.AddInt32(&a.subscribers, -1)
+		w.Header().Set("Retry-After", strconv.Itoa(a.retry))
+		catalog.ErrorResponse(w, http.StatusServiceUnavailable, "Too many subscribers")
+		return
+	}
+	defer atomic.AddInt32(&a.subscribers, -1)
 
 	messageChan := make(chan Event)
 
-	lastEventID := req.Header.Get(HeaderLastEventID)
-	a.controller.subscribe(messageChan, eventTypes, diff, lastEventID)
+	s.client = messageChan
+	s.lastEventID = req.Header.Get(HeaderLastEventID)
+	err = a.controller.subscribe(s)
+	if err != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(a.retry))
+		catalog.ErrorResponse(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", a.contentType)
+	// advise the reconnection time, and let the client know that the subscription is active
+	fmt.Fprintf(w, "retry: %d\n\n", a.retry*1000)
+	flusher.Flush()
 
 	go func() {
 		<-req.Context().Done()
@@ -64,9 +135,38 @@ func (a *SSEAPI) SubscribeEvent(w http.ResponseWriter, req *http.Request) {
 		a.controller.unsubscribe(messageChan)
 	}()
 
-	for event := range messageChan {
+	heartbeat := time.NewTicker(a.heartbeat)
+	defer heartbeat.Stop()
+	for {
+		var event Event
+		select {
+		case <-heartbeat.C:
+			// a comment, ignored by the clients
+			fmt.Fprintf(w, ": heartbeat\n\n")
+			flusher.Flush()
+			continue
+		case e, ok := <-messageChan:
+			if !ok {
+				// unsubscribed, or the controller is stopped
+				return
+			}
+			event = e
+		}
+		if event.Type == EventTypeOverflow {
+			// the client reconnects with the id as Last-Event-ID to resume
+			fmt.Fprintf(w, "event: %s\n", event.Type)
+			fmt.Fprintf(w, "id: %s\n", event.ID)
+			fmt.Fprintf(w, "data: {}\n\n")
+			flusher.Flush()
+			return
+		}
 		//data, err := json.MarshalIndent(event.Data, "data: ", "")
-		data, err := json.Marshal(event.Data)
+		var data []byte
+		if format == FormatCloudEvents {
+			data, err = json.Marshal(newCloudEvent(event, a.source))
+		} else {
+			data, err = json.Marshal(event.Data)
+		}
 		if err != nil {
 			log.Printf("error marshaling event %v: %s", event, err)
 		}
@@ -78,14 +178,38 @@ func (a *SSEAPI) SubscribeEvent(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func parseQueryParameters(req *http.Request) (bool, error) {
-	diff := false
-	req.ParseForm()
+// parseQueryParameters returns the subscriber with the payload options and filters of the query
+// The semantic type filter is read from the typeParam query parameter.
+func parseQueryParameters(req *http.Request, thingID, typeParam string) (subscriber, error) {
+	var s subscriber
+	err := req.ParseForm()
+	if err != nil {
+		return s, fmt.Errorf("error parsing the query: %s", err)
+	}
 	// Parse diff or just ID
 	if strings.EqualFold(req.Form.Get(QueryParamFull), "true") {
-		diff = true
+		s.diff = true
+	}
+	if strings.EqualFold(req.Form.Get(QueryParamFullTD), "true") {
+		s.full = true
+	}
+	s.diffFormat = DiffFormat(req.Form.Get(QueryParamDiffFormat))
+	err = validatePayload(s.diff, s.diffFormat, s.full)
+	if err != nil {
+		return s, err
+	}
+
+	// Parse the JSONPath and attribute filters of the TDs
+	attributes, err := catalog.ParseFilter(req)
+	if err != nil {
+		return s, err
+	}
+	attributes.Type = req.Form.Get(typeParam)
+	s.filter, err = newEventFilter(thingID, req.Form.Get(catalog.QueryParamJSONPath), attributes)
+	if err != nil {
+		return s, err
 	}
-	return diff, nil
+	return s, nil
 }
 
 func parsePath(req *http.Request) ([]wot.EventType, error) {
@@ -93,7 +217,7 @@ func parsePath(req *http.Request) ([]wot.EventType, error) {
 	params := mux.Vars(req)
 	event := params[QueryParamType]
 	if event == "" {
-		return []wot.EventType{wot.EventTypeCreate, wot.EventTypeUpdate, wot.EventTypeDelete}, nil
+		return allEventTypes, nil
 	}
 
 	eventType := wot.EventType(event)
@@ -0,0 +1,121 @@
+package notification
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/tinyiot/thing-directory/catalog"
+)
+
+// readLines returns the lines of the stream until it ends or the expected line is read
+func readLines(t *testing.T, scanner *bufio.Scanner, expected string) []string {
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		if scanner.Text() == expected {
+			return lines
+		}
+	}
+	t.Fatalf("Stream ended without %q. Received: %q", expected, lines)
+	return nil
+}
+
+func TestSSEStream(t *testing.T) {
+	controller := setup(t)
+	api := NewSSEAPI(controller, "", "", SSEConfig{Retry: 5, MaxSubscribers: 1})
+	api.heartbeat = 20 * time.Millisecond
+	server := httptest.NewServer(http.HandlerFunc(api.SubscribeEvent))
+	t.Cleanup(server.Close)
+
+	res, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Error subscribing: %s", err)
+	}
+	defer res.Body.Close()
+	scanner := bufio.NewScanner(res.Body)
+
+	t.Run("retry", func(t *testing.T) {
+		if scanner.Scan(); scanner.Text() != "retry: 5000" {
+			t.Fatalf("Expected the retry field first, got %q", scanner.Text())
+		}
+	})
+
+	t.Run("heartbeat", func(t *testing.T) {
+		readLines(t, scanner, ": heartbeat")
+	})
+
+	t.Run("max subscribers", func(t *testing.T) {
+		res, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatalf("Error subscribing: %s", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("Expected status 503, got %d", res.StatusCode)
+		}
+		if retryAfter := res.Header.Get("Retry-After"); retryAfter != "5" {
+			t.Fatalf("Expected Retry-After 5, got %q", retryAfter)
+		}
+	})
+
+	t.Run("stop", func(t *testing.T) {
+		ended := make(chan struct{})
+		go func() {
+			defer close(ended)
+			for scanner.Scan() {
+			}
+		}()
+		controller.Stop()
+		select {
+		case <-ended:
+		case <-time.After(time.Second):
+			t.Fatalf("Stream was not ended on stop")
+		}
+
+		// new subscribers are rejected until the restart
+		res, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatalf("Error subscribing: %s", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("Expected status 503 after stop, got %d", res.StatusCode)
+		}
+	})
+}
+
+func TestSSEThingStream(t *testing.T) {
+	controller := setup(t)
+	api := NewSSEAPI(controller, "", "", SSEConfig{})
+	router := mux.NewRouter()
+	router.Handle("/things/{id:.+}/events", http.HandlerFunc(api.SubscribeThingEvent))
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	// subscribe before the registration
+	res, err := http.Get(server.URL + "/things/urn:example:lamp/events")
+	if err != nil {
+		t.Fatalf("Error subscribing: %s", err)
+	}
+	defer res.Body.Close()
+	scanner := bufio.NewScanner(res.Body)
+	readLines(t, scanner, "retry: 3000")
+	readLines(t, scanner, "")
+
+	err = controller.CreateHandler(catalog.ThingDescription{"id": "urn:example:other", "title": "Other"})
+	if err != nil {
+		t.Fatalf("Error notifying: %s", err)
+	}
+	err = controller.CreateHandler(catalog.ThingDescription{"id": "urn:example:lamp", "title": "Lamp"})
+	if err != nil {
+		t.Fatalf("Error notifying: %s", err)
+	}
+	lines := readLines(t, scanner, "")
+	if len(lines) != 4 || lines[0] != "event: thing_created" || lines[2] != `data: {"id":"urn:example:lamp"}` {
+		t.Fatalf("Expected the creation of the lamp only, got %q", lines)
+	}
+}
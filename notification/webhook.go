@@ -0,0 +1,497 @@
+package notification
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/tinyiot/thing-directory/catalog"
+	"github.com/tinyiot/thing-directory/wot"
+)
+
+const (
+	// HeaderSignature holds the HMAC-SHA256 of the webhook payload keyed with the subscription secret e.g. sha256=<hex>
+	HeaderSignature = "X-Hub-Signature-256"
+	signaturePrefix = "sha256="
+
+	// Delivery of each event is retried with exponential backoff before the event is dropped
+	DefaultWebhookMaxRetries     = 5
+	DefaultWebhookInitialBackoff = time.Second
+	DefaultWebhookMaxBackoff     = time.Minute
+	// webhookTimeout is the timeout of each delivery attempt
+	webhookTimeout = 10 * time.Second
+	// webhookPollInterval is the interval of checking the queue for events that were missed
+	webhookPollInterval = 30 * time.Second
+)
+
+// Subscription is a webhook subscription to the events
+type Subscription struct {
+	ID string `json:"id"`
+	// CallbackURL receives the events in POST requests
+	CallbackURL string `json:"callbackURL"`
+	// EventTypes are the subscribed event types. All types are subscribed when empty.
+	EventTypes []wot.EventType `json:"eventTypes,omitempty"`
+	// Diff includes the changed TD attributes in the events, instead of only the id
+	Diff bool `json:"diff,omitempty"`
+	// DiffFormat is the format of the changes in the updates with diff: merge-patch (default) or json-patch
+	DiffFormat DiffFormat `json:"diffFormat,omitempty"`
+	// Full includes the complete new TD in the events, or the last known TD for deletions
+	Full   bool               `json:"full,omitempty"`
+	Filter SubscriptionFilter `json:"filter"`
+	// Format is the format of the payloads: the event by default, or cloudevents for the CloudEvents envelope
+	Format string `json:"format,omitempty"`
+	// Secret is the key of the payload signatures. It is generated if not given and only returned on creation.
+	Secret  string             `json:"secret,omitempty"`
+	Created time.Time          `json:"created"`
+	Status  SubscriptionStatus `json:"status"`
+}
+
+// SubscriptionFilter selects the events by the TDs they are about, same as the SSE query parameters
+type SubscriptionFilter struct {
+	JSONPath string `json:"jsonpath,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Title    string `json:"title,omitempty"`
+	Property string `json:"property,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+	Security string `json:"security,omitempty"`
+}
+
+// SubscriptionStatus is the delivery state of a subscription
+type SubscriptionStatus struct {
+	// LastEventID is the position of the subscription in the event queue i.e. the latest delivered or skipped event
+	LastEventID  string     `json:"lastEventID"`
+	LastDelivery *time.Time `json:"lastDelivery,omitempty"`
+	// Failures is the number of consecutive failed delivery attempts
+	Failures int `json:"failures"`
+	// DroppedEvents is the number of events that were not delivered after all retries
+	DroppedEvents int        `json:"droppedEvents"`
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+// WebhookController delivers the events to webhook subscriptions
+// Each subscription reads the event queue from its own position, so events are delivered in order and after restarts.
+type WebhookController struct {
+	queue    EventQueue
+	storage  SubscriptionStorage
+	notifier NotificationController
+	client   *http.Client
+	// source identifies the directory in the CloudEvents
+	source string
+	// callbacks restricts the addresses of the callback URLs
+	callbacks *callbackPolicy
+
+	retry retryPolicy
+
+	sync.Mutex
+	workers map[string]*webhookWorker
+	// new events wake up the workers
+	events chan Event
+}
+
+// retryPolicy defines the retries of failed deliveries
+type retryPolicy struct {
+	maxRetries     int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+// webhookWorker delivers the events of one subscription
+type webhookWorker struct {
+	subscription Subscription
+	subscriber   subscriber
+	wake         chan struct{}
+	ctx          context.Context
+	cancel       context.CancelFunc
+	done         chan struct{}
+}
+
+// NewWebhookController resumes the delivery of the stored subscriptions
+// The source identifies the directory in the payloads of subscriptions with the CloudEvents format.
+// The config restricts the addresses of the callbacks.
+func NewWebhookController(queue EventQueue, storage SubscriptionStorage, notifier NotificationController, source string, config WebhookConfig) (*WebhookController, error) {
+	callbacks, err := newCallbackPolicy(config)
+	if err != nil {
+		return nil, err
+	}
+	return newWebhookController(queue, storage, notifier, source, retryPolicy{
+		maxRetries:     DefaultWebhookMaxRetries,
+		initialBackoff: DefaultWebhookInitialBackoff,
+		maxBackoff:     DefaultWebhookMaxBackoff,
+	}, callbacks)
+}
+
+func newWebhookController(queue EventQueue, storage SubscriptionStorage, notifier NotificationController, source string, retry retryPolicy, callbacks *callbackPolicy) (*WebhookController, error) {
+	c := &WebhookController{
+		queue:     queue,
+		storage:   storage,
+		notifier:  notifier,
+		client:    callbacks.client(webhookTimeout),
+		source:    source,
+		callbacks: callbacks,
+		retry:     retry,
+		workers:   make(map[string]*webhookWorker),
+		events:    make(chan Event),
+	}
+
+	subscriptions, err := storage.list()
+	if err != nil {
+		return nil, fmt.Errorf("error loading subscriptions: %w", err)
+	}
+	for _, s := range subscriptions {
+		err = c.start(s)
+		if err != nil {
+			log.Printf("Error resuming subscription %s: %s", s.ID, err)
+		}
+	}
+
+	// the events only wake up the workers, which read the queue
+	err = notifier.subscribe(subscriber{
+		client:     c.events,
+		eventTypes: allEventTypes,
+		overflow:   OverflowDropOldest,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error subscribing to events: %w", err)
+	}
+	go c.wakeWorkers()
+
+	return c, nil
+}
+
+func (c *WebhookController) create(s Subscription) (*Subscription, error) {
+	s.ID = uuid.NewV4().String()
+	s.Created = time.Now().UTC()
+	if len(s.EventTypes) == 0 {
+		s.EventTypes = allEventTypes
+	}
+	if s.Secret == "" {
+		secret := make([]byte, 32)
+		_, err := rand.Read(secret)
+		if err != nil {
+			return nil, fmt.Errorf("error generating secret: %w", err)
+		}
+		s.Secret = hex.EncodeToString(secret)
+	}
+
+	// deliver the events after the subscription
+	latestID, err := c.queue.getLatestID()
+	if err != nil {
+		return nil, fmt.Errorf("error getting the latest event ID: %w", err)
+	}
+	s.Status = SubscriptionStatus{LastEventID: latestID}
+
+	_, err = newSubscriber(s)
+	if err != nil {
+		return nil, err
+	}
+	// the addresses are checked again on every delivery
+	u, _ := url.Parse(s.CallbackURL)
+	err = c.callbacks.checkHost(u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.storage.put(s)
+	if err != nil {
+		return nil, err
+	}
+	err = c.start(s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// get returns the subscription without the secret
+func (c *WebhookController) get(id string) (*Subscription, error) {
+	s, err := c.storage.get(id)
+	if err != nil {
+		return nil, err
+	}
+	s.Secret = ""
+	return s, nil
+}
+
+func (c *WebhookController) delete(id string) error {
+	c.Lock()
+	w, found := c.workers[id]
+	delete(c.workers, id)
+	c.Unlock()
+
+	if found {
+		w.cancel()
+		<-w.done
+	}
+	return c.storage.delete(id)
+}
+
+// Stop the deliveries
+func (c *WebhookController) Stop() {
+	// closes the events channel
+	c.notifier.unsubscribe(c.events)
+
+	c.Lock()
+	workers := c.workers
+	c.workers = make(map[string]*webhookWorker)
+	c.Unlock()
+
+	for _, w := range workers {
+		w.cancel()
+		<-w.done
+	}
+}
+
+// newSubscriber validates the subscription and returns its event selection
+func newSubscriber(s Subscription) (subscriber, error) {
+	u, err := url.Parse(s.CallbackURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return subscriber{}, &catalog.BadRequestError{S: fmt.Sprintf("invalid callback URL: %s", s.CallbackURL)}
+	}
+	err = validateEventTypes(s.EventTypes)
+	if err != nil {
+		return subscriber{}, err
+	}
+	err = validatePayload(s.Diff, s.DiffFormat, s.Full)
+	if err != nil {
+		return subscriber{}, err
+	}
+	err = validateFormat(s.Format)
+	if err != nil {
+		return subscriber{}, err
+	}
+	filter, err := s.Filter.eventFilter("")
+	if err != nil {
+		return subscriber{}, err
+	}
+
+	return subscriber{
+		eventTypes: s.EventTypes,
+		diff:       s.Diff,
+		diffFormat: s.DiffFormat,
+		full:       s.Full,
+		filter:     filter,
+	}, nil
+}
+
+// eventFilter returns the filter of the events, optionally limited to a single TD
+func (f SubscriptionFilter) eventFilter(thingID string) (*eventFilter, error) {
+	return newEventFilter(thingID, f.JSONPath, &catalog.Filter{
+		Type:     f.Type,
+		Title:    f.Title,
+		Property: f.Property,
+		Protocol: f.Protocol,
+		Security: f.Security,
+	})
+}
+
+func validateEventTypes(eventTypes []wot.EventType) error {
+	for _, eventType := range eventTypes {
+		if !eventType.IsValid() {
+			return &catalog.BadRequestError{S: fmt.Sprintf("invalid event type: %s", eventType)}
+		}
+	}
+	return nil
+}
+
+// validatePayload checks that at most one of the payload modes is selected, and the format of the diff
+func validatePayload(diff bool, diffFormat DiffFormat, full bool) error {
+	if diff && full {
+		return &catalog.BadRequestError{S: "diff and full cannot be used together"}
+	}
+	switch diffFormat {
+	case "":
+		return nil
+	case DiffFormatMergePatch, DiffFormatJSONPatch:
+		if !diff {
+			return &catalog.BadRequestError{S: "diffFormat requires diff"}
+		}
+		return nil
+	default:
+		return &catalog.BadRequestError{S: fmt.Sprintf("invalid diffFormat: %s", diffFormat)}
+	}
+}
+
+func (c *WebhookController) start(s Subscription) error {
+	sub, err := newSubscriber(s)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &webhookWorker{
+		subscription: s,
+		subscriber:   sub,
+		wake:         make(chan struct{}, 1),
+		ctx:          ctx,
+		cancel:       cancel,
+		done:         make(chan struct{}),
+	}
+
+	c.Lock()
+	c.workers[s.ID] = w
+	c.Unlock()
+
+	go c.run(w)
+	return nil
+}
+
+func (c *WebhookController) wakeWorkers() {
+	for range c.events {
+		c.Lock()
+		for _, w := range c.workers {
+			select {
+			case w.wake <- struct{}{}:
+			default:
+				// already awake
+			}
+		}
+		c.Unlock()
+	}
+}
+
+// run delivers the queued events after the position of the subscription until the worker is cancelled
+func (c *WebhookController) run(w *webhookWorker) {
+	defer close(w.done)
+
+	for {
+		events, err := c.queue.getAllAfter(w.subscription.Status.LastEventID)
+		if err == errEventsGone {
+			// resume after the latest event once the subscriber is told to resync
+			latestID, _ := c.queue.getLatestID()
+			events = []Event{{ID: latestID, Type: EventTypeReset, Data: catalog.ThingDescription{}, Timestamp: time.Now().UTC()}}
+		} else if err != nil {
+			log.Printf("Error getting events for subscription %s: %s", w.subscription.ID, err)
+		}
+		for _, event := range events {
+			if !c.deliver(w, event) {
+				return
+			}
+			w.subscription.Status.LastEventID = event.ID
+			c.save(w)
+		}
+
+		select {
+		case <-w.wake:
+		case <-time.After(webhookPollInterval):
+		case <-w.ctx.Done():
+			return
+		}
+	}
+}
+
+// deliver posts the event to the callback if the subscriber is interested in it, retrying with exponential backoff
+// It returns false if the worker was cancelled before the delivery completed.
+func (c *WebhookController) deliver(w *webhookWorker, event Event) bool {
+	event, ok := w.subscriber.prepare(event)
+	if !ok {
+		return true
+	}
+	var (
+		body []byte
+		err  error
+	)
+	if w.subscription.Format == FormatCloudEvents {
+		body, err = json.Marshal(newCloudEvent(event, c.source))
+	} else {
+		body, err = json.Marshal(event)
+	}
+	if err != nil {
+		log.Printf("Error marshalling event %s: %s", event.ID, err)
+		return true
+	}
+
+	status := &w.subscription.Status
+	backoff := c.retry.initialBackoff
+	for attempt := 0; ; attempt++ {
+		err = c.post(w.ctx, w.subscription, body)
+		if w.ctx.Err() != nil {
+			return false
+		}
+		now := time.Now().UTC()
+		if err == nil {
+			status.LastDelivery = &now
+			status.Failures = 0
+			return true
+		}
+
+		status.Failures++
+		status.LastError = err.Error()
+		status.LastErrorTime = &now
+		if attempt >= c.retry.maxRetries {
+			log.Printf("Dropping event %s of subscription %s after %d attempts: %s", event.ID, w.subscription.ID, attempt+1, err)
+			status.DroppedEvents++
+			return true
+		}
+		c.save(w)
+
+		select {
+		case <-time.After(backoff):
+		case <-w.ctx.Done():
+			return false
+		}
+		backoff *= 2
+		if backoff > c.retry.maxBackoff {
+			backoff = c.retry.maxBackoff
+		}
+	}
+}
+
+func (c *WebhookController) post(ctx context.Context, s Subscription, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if s.Format == FormatCloudEvents {
+		req.Header.Set("Content-Type", MediaTypeCloudEvents)
+	} else {
+		req.Header.Set("Content-Type", wot.MediaTypeJSON)
+	}
+	req.Header.Set(HeaderSignature, sign(s.Secret, body))
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("callback responded with %s", res.Status)
+	}
+	return nil
+}
+
+// save stores the status of the subscription unless it was deleted
+func (c *WebhookController) save(w *webhookWorker) {
+	c.Lock()
+	defer c.Unlock()
+	if c.workers[w.subscription.ID] != w {
+		return
+	}
+	err := c.storage.put(w.subscription)
+	if err != nil {
+		log.Printf("Error storing subscription %s: %s", w.subscription.ID, err)
+	}
+}
+
+// sign returns the signature of the payload
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,105 @@
+package notification
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/tinyiot/thing-directory/catalog"
+	"github.com/tinyiot/thing-directory/wot"
+)
+
+const PathParamSubscriptionID = "id"
+
+type WebhookAPI struct {
+	controller *WebhookController
+}
+
+func NewWebhookAPI(controller *WebhookController) *WebhookAPI {
+	return &WebhookAPI{
+		controller: controller,
+	}
+}
+
+// Post handler creates a subscription. The response includes the secret of the payload signatures.
+func (a *WebhookAPI) Post(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		catalog.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var s Subscription
+	err = json.Unmarshal(body, &s)
+	if err != nil {
+		catalog.ErrorResponse(w, http.StatusBadRequest, "Error processing the request: ", err.Error())
+		return
+	}
+
+	created, err := a.controller.create(s)
+	if err != nil {
+		switch err.(type) {
+		case *catalog.BadRequestError:
+			catalog.ErrorResponse(w, http.StatusBadRequest, "Invalid subscription: ", err.Error())
+			return
+		default:
+			catalog.ErrorResponse(w, http.StatusInternalServerError, "Error creating the subscription: ", err.Error())
+			return
+		}
+	}
+
+	w.Header().Set("Location", "/subscriptions/"+created.ID)
+	writeJSON(w, http.StatusCreated, created)
+}
+
+// Get handler returns a subscription with its delivery status
+func (a *WebhookAPI) Get(w http.ResponseWriter, req *http.Request) {
+	s, err := a.controller.get(mux.Vars(req)[PathParamSubscriptionID])
+	if err != nil {
+		switch err.(type) {
+		case *catalog.NotFoundError:
+			catalog.ErrorResponse(w, http.StatusNotFound, err.Error())
+			return
+		default:
+			catalog.ErrorResponse(w, http.StatusInternalServerError, "Error retrieving the subscription: ", err.Error())
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, s)
+}
+
+// Delete handler removes a subscription
+func (a *WebhookAPI) Delete(w http.ResponseWriter, req *http.Request) {
+	err := a.controller.delete(mux.Vars(req)[PathParamSubscriptionID])
+	if err != nil {
+		switch err.(type) {
+		case *catalog.NotFoundError:
+			catalog.ErrorResponse(w, http.StatusNotFound, err.Error())
+			return
+		default:
+			catalog.ErrorResponse(w, http.StatusInternalServerError, "Error deleting the subscription: ", err.Error())
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		catalog.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", wot.MediaTypeJSON)
+	w.WriteHeader(code)
+	_, err = w.Write(b)
+	if err != nil {
+		log.Printf("ERROR writing HTTP response: %s", err)
+	}
+}
@@ -0,0 +1,414 @@
+package notification
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/tinyiot/thing-directory/catalog"
+	"github.com/tinyiot/thing-directory/wot"
+)
+
+var testRetryPolicy = retryPolicy{
+	maxRetries:     2,
+	initialBackoff: 10 * time.Millisecond,
+	maxBackoff:     20 * time.Millisecond,
+}
+
+// testCallbackPolicy allows the callbacks to the local receivers
+func testCallbackPolicy(t *testing.T) *callbackPolicy {
+	p, err := newCallbackPolicy(WebhookConfig{AllowedNetworks: []string{"127.0.0.0/8", "::1/128"}})
+	if err != nil {
+		t.Fatalf("Error creating callback policy: %s", err)
+	}
+	return p
+}
+
+func setupSubscriptionStorage(t *testing.T) SubscriptionStorage {
+	tempDir := fmt.Sprintf("%s/thing-directory/test-%s-ldb",
+		strings.Replace(os.TempDir(), "\\", "/", -1), uuid.NewV4())
+
+	storage, err := NewLevelDBSubscriptionStorage(tempDir, nil)
+	if err != nil {
+		t.Fatalf("error creating leveldb subscription storage: %s", err)
+	}
+
+	t.Cleanup(func() {
+		storage.Close()
+		err = os.RemoveAll(tempDir) // Remove temp files
+		if err != nil {
+			t.Fatalf("error removing test files: %s", err)
+		}
+	})
+
+	return storage
+}
+
+// receiver is a webhook callback that responds with the given status codes in order, and 200 OK afterwards
+type receiver struct {
+	sync.Mutex
+	*httptest.Server
+	codes    []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newReceiver(t *testing.T, codes ...int) *receiver {
+	r := &receiver{codes: codes}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		r.Lock()
+		defer r.Unlock()
+		r.requests = append(r.requests, req)
+		r.bodies = append(r.bodies, body)
+		code := http.StatusOK
+		if len(r.codes) > 0 {
+			code, r.codes = r.codes[0], r.codes[1:]
+		}
+		w.WriteHeader(code)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// received returns the successfully received events after waiting for the given number of requests
+func (r *receiver) received(t *testing.T, requests int) []Event {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.Lock()
+		if len(r.requests) >= requests {
+			break
+		}
+		r.Unlock()
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for %d requests", requests)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer r.Unlock()
+
+	var events []Event
+	for i := range r.bodies {
+		var event Event
+		err := json.Unmarshal(r.bodies[i], &event)
+		if err != nil {
+			t.Fatalf("Error unmarshalling event: %s", err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// waitForStatus returns the subscription when the condition is met
+func waitForStatus(t *testing.T, c *WebhookController, id string, condition func(SubscriptionStatus) bool) *Subscription {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s, err := c.get(id)
+		if err != nil {
+			t.Fatalf("Error getting subscription: %s", err)
+		}
+		if condition(s.Status) {
+			return s
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for subscription status. Last status: %+v", s.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	controller := setup(t)
+	storage := setupSubscriptionStorage(t)
+	webhooks, err := newWebhookController(controller.s, storage, controller, "", testRetryPolicy, testCallbackPolicy(t))
+	if err != nil {
+		t.Fatalf("Error creating webhook controller: %s", err)
+	}
+	t.Cleanup(webhooks.Stop)
+
+	// not delivered as it happened before the subscription
+	err = controller.CreateHandler(catalog.ThingDescription{"id": "urn:example:old", "title": "Kitchen Heater"})
+	if err != nil {
+		t.Fatalf("Error notifying: %s", err)
+	}
+
+	r := newReceiver(t)
+	s, err := webhooks.create(Subscription{
+		CallbackURL: r.URL,
+		Diff:        true,
+		Filter:      SubscriptionFilter{Title: "kitchen"},
+	})
+	if err != nil {
+		t.Fatalf("Error creating subscription: %s", err)
+	}
+	if s.Secret == "" {
+		t.Fatalf("No secret was generated")
+	}
+
+	lamp := catalog.ThingDescription{"id": "urn:example:lamp", "title": "Kitchen Lamp"}
+	for _, err := range []error{
+		controller.CreateHandler(catalog.ThingDescription{"id": "urn:example:sensor", "title": "Bedroom Sensor"}),
+		controller.CreateHandler(lamp),
+		controller.DeleteHandler(lamp),
+	} {
+		if err != nil {
+			t.Fatalf("Error notifying: %s", err)
+		}
+	}
+
+	events := r.received(t, 2)
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d: %v", len(events), events)
+	}
+	if events[0].Type != wot.EventTypeCreate || events[0].Data["title"] != "Kitchen Lamp" {
+		t.Fatalf("Expected the creation of the lamp, got %v", events[0])
+	}
+	if events[1].Type != wot.EventTypeDelete || events[1].Data["id"] != "urn:example:lamp" {
+		t.Fatalf("Expected the deletion of the lamp, got %v", events[1])
+	}
+
+	t.Run("signature", func(t *testing.T) {
+		r.Lock()
+		defer r.Unlock()
+		for i, req := range r.requests {
+			expected := sign(s.Secret, r.bodies[i])
+			if !hmac.Equal([]byte(req.Header.Get(HeaderSignature)), []byte(expected)) {
+				t.Fatalf("Expected signature %s, got %s", expected, req.Header.Get(HeaderSignature))
+			}
+		}
+	})
+
+	t.Run("status", func(t *testing.T) {
+		status := waitForStatus(t, webhooks, s.ID, func(status SubscriptionStatus) bool {
+			return status.LastEventID == events[1].ID
+		}).Status
+		if status.LastDelivery == nil || status.Failures != 0 || status.DroppedEvents != 0 {
+			t.Fatalf("Unexpected status: %+v", status)
+		}
+	})
+
+	t.Run("secret not returned", func(t *testing.T) {
+		stored, err := webhooks.get(s.ID)
+		if err != nil {
+			t.Fatalf("Error getting subscription: %s", err)
+		}
+		if stored.Secret != "" {
+			t.Fatalf("Secret was returned")
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		err := webhooks.delete(s.ID)
+		if err != nil {
+			t.Fatalf("Error deleting subscription: %s", err)
+		}
+		_, err = webhooks.get(s.ID)
+		if _, ok := err.(*catalog.NotFoundError); !ok {
+			t.Fatalf("Expected NotFoundError, got %v", err)
+		}
+	})
+}
+
+func TestWebhookRetries(t *testing.T) {
+	controller := setup(t)
+	storage := setupSubscriptionStorage(t)
+	webhooks, err := newWebhookController(controller.s, storage, controller, "", testRetryPolicy, testCallbackPolicy(t))
+	if err != nil {
+		t.Fatalf("Error creating webhook controller: %s", err)
+	}
+	t.Cleanup(webhooks.Stop)
+
+	t.Run("delivered after failures", func(t *testing.T) {
+		r := newReceiver(t, http.StatusInternalServerError, http.StatusServiceUnavailable)
+		s, err := webhooks.create(Subscription{CallbackURL: r.URL})
+		if err != nil {
+			t.Fatalf("Error creating subscription: %s", err)
+		}
+
+		err = controller.CreateHandler(catalog.ThingDescription{"id": "urn:example:lamp"})
+		if err != nil {
+			t.Fatalf("Error notifying: %s", err)
+		}
+
+		events := r.received(t, 3)
+		if len(events) != 3 || events[0].ID != events[2].ID {
+			t.Fatalf("Expected 3 attempts of the same event, got %v", events)
+		}
+		status := waitForStatus(t, webhooks, s.ID, func(status SubscriptionStatus) bool {
+			return status.LastEventID == events[0].ID
+		}).Status
+		if status.Failures != 0 || status.DroppedEvents != 0 || status.LastError == "" || status.LastDelivery == nil {
+			t.Fatalf("Unexpected status: %+v", status)
+		}
+		webhooks.delete(s.ID)
+	})
+
+	t.Run("dropped after retries", func(t *testing.T) {
+		r := newReceiver(t, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError)
+		s, err := webhooks.create(Subscription{CallbackURL: r.URL})
+		if err != nil {
+			t.Fatalf("Error creating subscription: %s", err)
+		}
+
+		for _, id := range []string{"urn:example:sensor", "urn:example:switch"} {
+			err = controller.CreateHandler(catalog.ThingDescription{"id": id})
+			if err != nil {
+				t.Fatalf("Error notifying: %s", err)
+			}
+		}
+
+		// 3 failed attempts of the first event and the second event
+		events := r.received(t, 4)
+		if events[0].Data["id"] != "urn:example:sensor" || events[3].Data["id"] != "urn:example:switch" {
+			t.Fatalf("Expected the first event to be dropped, got %v", events)
+		}
+		status := waitForStatus(t, webhooks, s.ID, func(status SubscriptionStatus) bool {
+			return status.LastEventID == events[3].ID
+		}).Status
+		if status.DroppedEvents != 1 || status.Failures != 0 || !strings.Contains(status.LastError, "500") {
+			t.Fatalf("Unexpected status: %+v", status)
+		}
+		webhooks.delete(s.ID)
+	})
+}
+
+func TestWebhookResume(t *testing.T) {
+	controller := setup(t)
+	storage := setupSubscriptionStorage(t)
+	webhooks, err := newWebhookController(controller.s, storage, controller, "", testRetryPolicy, testCallbackPolicy(t))
+	if err != nil {
+		t.Fatalf("Error creating webhook controller: %s", err)
+	}
+
+	r := newReceiver(t)
+	_, err = webhooks.create(Subscription{CallbackURL: r.URL, EventTypes: []wot.EventType{wot.EventTypeCreate}})
+	if err != nil {
+		t.Fatalf("Error creating subscription: %s", err)
+	}
+	webhooks.Stop()
+
+	// events while the deliveries are stopped
+	err = controller.CreateHandler(catalog.ThingDescription{"id": "urn:example:lamp"})
+	if err != nil {
+		t.Fatalf("Error notifying: %s", err)
+	}
+
+	webhooks, err = newWebhookController(controller.s, storage, controller, "", testRetryPolicy, testCallbackPolicy(t))
+	if err != nil {
+		t.Fatalf("Error creating webhook controller: %s", err)
+	}
+	t.Cleanup(webhooks.Stop)
+
+	events := r.received(t, 1)
+	if len(events) != 1 || events[0].Data["id"] != "urn:example:lamp" {
+		t.Fatalf("Expected the missed event after restart, got %v", events)
+	}
+}
+
+func TestWebhookCallbackPolicy(t *testing.T) {
+	controller := setup(t)
+	storage := setupSubscriptionStorage(t)
+	policy, err := newCallbackPolicy(WebhookConfig{
+		AllowedNetworks: []string{"10.1.0.0/16"},
+		DeniedNetworks:  []string{"203.0.113.0/24"},
+	})
+	if err != nil {
+		t.Fatalf("Error creating callback policy: %s", err)
+	}
+	webhooks, err := newWebhookController(controller.s, storage, controller, "", testRetryPolicy, policy)
+	if err != nil {
+		t.Fatalf("Error creating webhook controller: %s", err)
+	}
+	t.Cleanup(webhooks.Stop)
+
+	t.Run("denied", func(t *testing.T) {
+		for _, callbackURL := range []string{
+			"http://127.0.0.1:8080/events",
+			"http://[::1]/events",
+			"http://10.0.0.1/events",
+			"http://192.168.1.10/events",
+			"http://169.254.169.254/latest/meta-data",
+			"http://[::ffff:127.0.0.1]/events",
+			"http://203.0.113.7/events",
+		} {
+			_, err := webhooks.create(Subscription{CallbackURL: callbackURL})
+			if _, ok := err.(*catalog.BadRequestError); !ok {
+				t.Fatalf("Expected bad request error for %s, got: %v", callbackURL, err)
+			}
+		}
+	})
+
+	t.Run("allowed", func(t *testing.T) {
+		for _, callbackURL := range []string{
+			"http://10.1.2.3/events",
+			"https://198.51.100.1/events",
+		} {
+			s, err := webhooks.create(Subscription{CallbackURL: callbackURL})
+			if err != nil {
+				t.Fatalf("Error creating subscription to %s: %s", callbackURL, err)
+			}
+			webhooks.delete(s.ID)
+		}
+	})
+
+	t.Run("connection", func(t *testing.T) {
+		// e.g. a host that resolves to another address after the subscription
+		r := newReceiver(t)
+		res, err := webhooks.client.Post(r.URL, wot.MediaTypeJSON, strings.NewReader("{}"))
+		if err == nil {
+			res.Body.Close()
+			t.Fatalf("Expected the connection to %s to be denied", r.URL)
+		}
+	})
+}
+
+func TestWebhookAPI(t *testing.T) {
+	controller := setup(t)
+	storage := setupSubscriptionStorage(t)
+	webhooks, err := newWebhookController(controller.s, storage, controller, "", testRetryPolicy, testCallbackPolicy(t))
+	if err != nil {
+		t.Fatalf("Error creating webhook controller: %s", err)
+	}
+	t.Cleanup(webhooks.Stop)
+	api := NewWebhookAPI(webhooks)
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, body := range []string{
+			`{"callbackURL": "ftp://example.com"}`,
+			`{"callbackURL": "http://example.com", "eventTypes": ["thing_renamed"]}`,
+			`{"callbackURL": "http://example.com", "filter": {"jsonpath": "$[?(@.title=='a')]", "type": "saref:Sensor"}, "diff": "yes"}`,
+		} {
+			res := httptest.NewRecorder()
+			api.Post(res, httptest.NewRequest(http.MethodPost, "/subscriptions", strings.NewReader(body)))
+			if res.Code != http.StatusBadRequest {
+				t.Fatalf("Expected %d for %s, got %d", http.StatusBadRequest, body, res.Code)
+			}
+		}
+	})
+
+	t.Run("create", func(t *testing.T) {
+		res := httptest.NewRecorder()
+		api.Post(res, httptest.NewRequest(http.MethodPost, "/subscriptions",
+			strings.NewReader(`{"callbackURL": "http://example.com/hook", "secret": "s3cret"}`)))
+		if res.Code != http.StatusCreated {
+			t.Fatalf("Expected %d, got %d: %s", http.StatusCreated, res.Code, res.Body)
+		}
+		var s Subscription
+		err := json.Unmarshal(res.Body.Bytes(), &s)
+		if err != nil {
+			t.Fatalf("Error unmarshalling response: %s", err)
+		}
+		if res.Header().Get("Location") != "/subscriptions/"+s.ID || s.Secret != "s3cret" || len(s.EventTypes) != len(allEventTypes) {
+			t.Fatalf("Unexpected response: %s %s", res.Header().Get("Location"), res.Body)
+		}
+	})
+}
@@ -0,0 +1,299 @@
+package notification
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tinyiot/thing-directory/wot"
+)
+
+const (
+	// WebSocket message actions
+	WSActionSubscribe    = "subscribe"
+	WSActionUnsubscribe  = "unsubscribe"
+	WSActionSubscribed   = "subscribed"
+	WSActionUnsubscribed = "unsubscribed"
+	WSActionEvent        = "event"
+	WSActionError        = "error"
+	// WSActionOverflow ends a subscription that did not keep up with the events. The event ID is the resume point.
+	WSActionOverflow = "overflow"
+)
+
+const (
+	// wsMaxRequestSize is the largest request from the clients, with room for the filters
+	wsMaxRequestSize = 64 * 1024
+	// wsWriteWait is the time allowed to write a message
+	wsWriteWait = 10 * time.Second
+	// wsPongWait is the time allowed to read the next pong, or any message, from the clients
+	wsPongWait = 60 * time.Second
+)
+
+// WebSocketRequest is a message from the client to subscribe or unsubscribe
+type WebSocketRequest struct {
+	Action string `json:"action"`
+	// Subscription is the id of the subscription chosen by the client, unique within the connection
+	Subscription string `json:"subscription"`
+	// Types are the subscribed event types. All types are subscribed when empty.
+	Types []wot.EventType `json:"types,omitempty"`
+	// Diff includes the changed TD attributes in the events, instead of only the id
+	Diff bool `json:"diff,omitempty"`
+	// DiffFormat is the format of the changes in the updates with diff: merge-patch (default) or json-patch
+	DiffFormat DiffFormat `json:"diffFormat,omitempty"`
+	// Full includes the complete new TD in the events, or the last known TD for deletions
+	Full bool `json:"full,omitempty"`
+	// ThingID limits the events to a single TD
+	ThingID string             `json:"thingID,omitempty"`
+	Filter  SubscriptionFilter `json:"filter"`
+	// LastEventID resumes the subscription after the given event
+	LastEventID string `json:"lastEventID,omitempty"`
+}
+
+// WebSocketMessage is a message from the server with an event, or the result of a request
+type WebSocketMessage struct {
+	Action       string `json:"action"`
+	Subscription string `json:"subscription,omitempty"`
+	Event        *Event `json:"event,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// WebSocketAPI multiplexes subscriptions to the events over WebSocket connections
+type WebSocketAPI struct {
+	controller NotificationController
+	upgrader   websocket.Upgrader
+	// pongWait is the time without pongs after which the connection is closed, pinged at 9/10 of it
+	pongWait time.Duration
+}
+
+func NewWebSocketAPI(controller NotificationController, config WebSocketConfig) *WebSocketAPI {
+	return &WebSocketAPI{
+		controller: controller,
+		upgrader: websocket.Upgrader{
+			CheckOrigin: config.checkOrigin,
+		},
+		pongWait: wsPongWait,
+	}
+}
+
+// checkOrigin returns true for the connections from the same origin or an allowed one, and from non-browser clients
+// Unlike other requests, the browsers connect WebSockets from any web page, without CORS preflight.
+func (c WebSocketConfig) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// wsSession is the state of a WebSocket connection
+type wsSession struct {
+	controller NotificationController
+	// out is written to the connection by a single writer
+	out chan WebSocketMessage
+	// subscriptions by id, only accessed by the reader
+	subscriptions map[string]*wsSubscription
+}
+
+// wsSubscription forwards the events of a subscription to the connection
+type wsSubscription struct {
+	client chan Event
+	// done is closed after the last event is forwarded
+	done chan struct{}
+	// overflowed is closed when the subscription is ended for not keeping up with the events
+	overflowed chan struct{}
+}
+
+// Subscribe handler upgrades the connection and serves the subscription requests until the connection is closed
+func (a *WebSocketAPI) Subscribe(w http.ResponseWriter, req *http.Request) {
+	conn, err := a.upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// the upgrader has responded with an error
+		log.Printf("Error upgrading to WebSocket: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	s := &wsSession{
+		controller:    a.controller,
+		out:           make(chan WebSocketMessage),
+		subscriptions: make(map[string]*wsSubscription),
+	}
+
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		// the pings keep the connection alive and detect the half-open ones
+		ping := time.NewTicker(a.pongWait * 9 / 10)
+		defer ping.Stop()
+		var writeErr error
+		for {
+			select {
+			case message, ok := <-s.out:
+				if !ok {
+					return
+				}
+				if writeErr != nil {
+					// keep draining to not block the subscriptions
+					continue
+				}
+				conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+				writeErr = conn.WriteJSON(message)
+			case <-ping.C:
+				if writeErr != nil {
+					continue
+				}
+				writeErr = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait))
+			}
+			if writeErr != nil {
+				log.Printf("Error writing to WebSocket: %s", writeErr)
+				// unblock the reader
+				conn.Close()
+			}
+		}
+	}()
+
+	conn.SetReadLimit(wsMaxRequestSize)
+	conn.SetReadDeadline(time.Now().Add(a.pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(a.pongWait))
+	})
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			// closed by the client, after a write error, or when the request is too large or the pongs are missing
+			break
+		}
+		var request WebSocketRequest
+		err = json.Unmarshal(message, &request)
+		if err != nil {
+			s.out <- WebSocketMessage{Action: WSActionError, Error: fmt.Sprintf("invalid request: %s", err)}
+			continue
+		}
+		s.handle(request)
+	}
+
+	// unsubscribe and close the channels of all subscriptions
+	for id := range s.subscriptions {
+		s.unsubscribe(id)
+	}
+	close(s.out)
+	<-writerDone
+}
+
+func (s *wsSession) handle(request WebSocketRequest) {
+	var err error
+	switch request.Action {
+	case WSActionSubscribe:
+		err = s.subscribe(request)
+		if err == nil {
+			return
+		}
+	case WSActionUnsubscribe:
+		err = s.unsubscribe(request.Subscription)
+		if err == nil {
+			s.out <- WebSocketMessage{Action: WSActionUnsubscribed, Subscription: request.Subscription}
+			return
+		}
+	default:
+		err = fmt.Errorf("unsupported action: %s", request.Action)
+	}
+	s.out <- WebSocketMessage{Action: WSActionError, Subscription: request.Subscription, Error: err.Error()}
+}
+
+func (s *wsSession) subscribe(request WebSocketRequest) error {
+	if request.Subscription == "" {
+		return fmt.Errorf("subscription id is not set")
+	}
+	if existing, found := s.subscriptions[request.Subscription]; found {
+		select {
+		case <-existing.overflowed:
+			// replaced by the resumed subscription
+			s.unsubscribe(request.Subscription)
+		default:
+			return fmt.Errorf("subscription %s already exists", request.Subscription)
+		}
+	}
+	eventTypes := request.Types
+	if len(eventTypes) == 0 {
+		eventTypes = allEventTypes
+	}
+	err := validateEventTypes(eventTypes)
+	if err != nil {
+		return err
+	}
+	err = validatePayload(request.Diff, request.DiffFormat, request.Full)
+	if err != nil {
+		return err
+	}
+	filter, err := request.Filter.eventFilter(request.ThingID)
+	if err != nil {
+		return err
+	}
+
+	sub := &wsSubscription{
+		client:     make(chan Event),
+		done:       make(chan struct{}),
+		overflowed: make(chan struct{}),
+	}
+	// the events wait for the forwarder, which starts after the acknowledgement
+	err = s.controller.subscribe(subscriber{
+		client:      sub.client,
+		eventTypes:  eventTypes,
+		diff:        request.Diff,
+		diffFormat:  request.DiffFormat,
+		full:        request.Full,
+		filter:      filter,
+		lastEventID: request.LastEventID,
+	})
+	if err != nil {
+		return err
+	}
+	s.out <- WebSocketMessage{Action: WSActionSubscribed, Subscription: request.Subscription}
+
+	s.subscriptions[request.Subscription] = sub
+	go func() {
+		defer close(sub.done)
+		for event := range sub.client {
+			event := event
+			action := WSActionEvent
+			if event.Type == EventTypeOverflow {
+				action = WSActionOverflow
+				close(sub.overflowed)
+			}
+			s.out <- WebSocketMessage{Action: action, Subscription: request.Subscription, Event: &event}
+		}
+	}()
+	return nil
+}
+
+func (s *wsSession) unsubscribe(id string) error {
+	sub, found := s.subscriptions[id]
+	if !found {
+		return fmt.Errorf("subscription %s does not exist", id)
+	}
+	delete(s.subscriptions, id)
+	// closes the channel and ends the forwarder
+	err := s.controller.unsubscribe(sub.client)
+	if err != nil {
+		return err
+	}
+	<-sub.done
+	return nil
+}
@@ -0,0 +1,234 @@
+package notification
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tinyiot/thing-directory/catalog"
+	"github.com/tinyiot/thing-directory/wot"
+)
+
+func dialWebSocket(t *testing.T, controller NotificationController) *websocket.Conn {
+	server := httptest.NewServer(http.HandlerFunc(NewWebSocketAPI(controller, WebSocketConfig{}).Subscribe))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Error connecting: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// read returns the next message from the server
+func read(t *testing.T, conn *websocket.Conn) WebSocketMessage {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var message WebSocketMessage
+	err := conn.ReadJSON(&message)
+	if err != nil {
+		t.Fatalf("Error reading message: %s", err)
+	}
+	return message
+}
+
+func TestWebSocketAPI(t *testing.T) {
+	controller := setup(t)
+	conn := dialWebSocket(t, controller)
+
+	lamp := catalog.ThingDescription{"id": "urn:example:lamp", "title": "Kitchen Lamp"}
+	sensor := catalog.ThingDescription{"id": "urn:example:sensor", "title": "Bedroom Sensor"}
+	for _, err := range []error{
+		controller.CreateHandler(lamp),
+		controller.CreateHandler(sensor),
+	} {
+		if err != nil {
+			t.Fatalf("Error notifying: %s", err)
+		}
+	}
+
+	t.Run("subscribe with resume", func(t *testing.T) {
+		err := conn.WriteJSON(WebSocketRequest{
+			Action:       WSActionSubscribe,
+			Subscription: "kitchen",
+			Diff:         true,
+			Filter:       SubscriptionFilter{Title: "kitchen"},
+			LastEventID:  "0",
+		})
+		if err != nil {
+			t.Fatalf("Error writing: %s", err)
+		}
+
+		if m := read(t, conn); m.Action != WSActionSubscribed || m.Subscription != "kitchen" {
+			t.Fatalf("Expected subscription acknowledgement, got %+v", m)
+		}
+		m := read(t, conn)
+		if m.Action != WSActionEvent || m.Subscription != "kitchen" || m.Event.Type != wot.EventTypeCreate || m.Event.Data["title"] != "Kitchen Lamp" {
+			t.Fatalf("Expected the replayed creation of the lamp with diff, got %+v", m)
+		}
+	})
+
+	t.Run("second subscription", func(t *testing.T) {
+		err := conn.WriteJSON(WebSocketRequest{
+			Action:       WSActionSubscribe,
+			Subscription: "deletions",
+			Types:        []wot.EventType{wot.EventTypeDelete},
+		})
+		if err != nil {
+			t.Fatalf("Error writing: %s", err)
+		}
+		if m := read(t, conn); m.Action != WSActionSubscribed || m.Subscription != "deletions" {
+			t.Fatalf("Expected subscription acknowledgement, got %+v", m)
+		}
+
+		err = controller.DeleteHandler(sensor)
+		if err != nil {
+			t.Fatalf("Error notifying: %s", err)
+		}
+		m := read(t, conn)
+		if m.Action != WSActionEvent || m.Subscription != "deletions" || m.Event.Data["id"] != "urn:example:sensor" || len(m.Event.Data) != 1 {
+			t.Fatalf("Expected the deletion of the sensor without diff, got %+v", m)
+		}
+	})
+
+	t.Run("unsubscribe", func(t *testing.T) {
+		err := conn.WriteJSON(WebSocketRequest{Action: WSActionUnsubscribe, Subscription: "kitchen"})
+		if err != nil {
+			t.Fatalf("Error writing: %s", err)
+		}
+		if m := read(t, conn); m.Action != WSActionUnsubscribed || m.Subscription != "kitchen" {
+			t.Fatalf("Expected unsubscription acknowledgement, got %+v", m)
+		}
+
+		// only the remaining subscription gets the deletion of the lamp
+		err = controller.DeleteHandler(lamp)
+		if err != nil {
+			t.Fatalf("Error notifying: %s", err)
+		}
+		m := read(t, conn)
+		if m.Subscription != "deletions" || m.Event.Data["id"] != "urn:example:lamp" {
+			t.Fatalf("Expected the deletion of the lamp for the remaining subscription, got %+v", m)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for _, request := range []string{
+			`{"action": "subscribe", "subscription": "deletions"}`,
+			`{"action": "subscribe", "subscription": "renames", "types": ["thing_renamed"]}`,
+			`{"action": "unsubscribe", "subscription": "unknown"}`,
+			`{"action": "publish"}`,
+			`not json`,
+		} {
+			err := conn.WriteMessage(websocket.TextMessage, []byte(request))
+			if err != nil {
+				t.Fatalf("Error writing: %s", err)
+			}
+			if m := read(t, conn); m.Action != WSActionError || m.Error == "" {
+				t.Fatalf("Expected an error for %s, got %+v", request, m)
+			}
+		}
+	})
+
+	t.Run("stopped controller", func(t *testing.T) {
+		controller.Stop()
+		for _, request := range []WebSocketRequest{
+			// not acknowledged
+			{Action: WSActionSubscribe, Subscription: "late"},
+			// not registered
+			{Action: WSActionUnsubscribe, Subscription: "late"},
+		} {
+			err := conn.WriteJSON(request)
+			if err != nil {
+				t.Fatalf("Error writing: %s", err)
+			}
+			if m := read(t, conn); m.Action != WSActionError || m.Subscription != "late" {
+				t.Fatalf("Expected an error for %s, got %+v", request.Action, m)
+			}
+		}
+	})
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	controller := setup(t)
+	api := NewWebSocketAPI(controller, WebSocketConfig{AllowedOrigins: []string{"https://dashboard.example.com"}})
+	server := httptest.NewServer(http.HandlerFunc(api.Subscribe))
+	t.Cleanup(server.Close)
+	serverURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	for origin, allowed := range map[string]bool{
+		"":                               true,
+		server.URL:                       true,
+		"https://dashboard.example.com":  true,
+		"https://attacker.example.com":   false,
+		"https://dashboard.example.com.": false,
+	} {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, res, err := websocket.DefaultDialer.Dial(serverURL, header)
+		if allowed && err != nil {
+			t.Fatalf("Error connecting from origin %q: %s", origin, err)
+		}
+		if !allowed && (err == nil || res.StatusCode != http.StatusForbidden) {
+			t.Fatalf("Expected the connection from origin %q to be forbidden", origin)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+func TestWebSocketLimits(t *testing.T) {
+	controller := setup(t)
+	api := NewWebSocketAPI(controller, WebSocketConfig{})
+	api.pongWait = 200 * time.Millisecond
+	server := httptest.NewServer(http.HandlerFunc(api.Subscribe))
+	t.Cleanup(server.Close)
+
+	dial := func(t *testing.T) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			t.Fatalf("Error connecting: %s", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	t.Run("large request", func(t *testing.T) {
+		conn := dial(t)
+		err := conn.WriteJSON(WebSocketRequest{Action: WSActionSubscribe, Subscription: strings.Repeat("x", wsMaxRequestSize)})
+		if err != nil {
+			t.Fatalf("Error writing request: %s", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err = conn.ReadMessage()
+		if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+			t.Fatalf("Expected the connection to be closed for the large request, got: %v", err)
+		}
+	})
+
+	t.Run("pongs", func(t *testing.T) {
+		conn := dial(t)
+		// the pings are answered while reading
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err := conn.ReadMessage()
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			t.Fatalf("Expected the connection to be kept open, got: %v", err)
+		}
+	})
+
+	t.Run("missing pongs", func(t *testing.T) {
+		conn := dial(t)
+		conn.SetPingHandler(func(string) error { return nil })
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err := conn.ReadMessage()
+		if netErr, ok := err.(net.Error); err == nil || ok && netErr.Timeout() {
+			t.Fatalf("Expected the connection to be closed, got: %v", err)
+		}
+	})
+}
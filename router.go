@@ -10,6 +10,7 @@ import (
 	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/justinas/alice"
 )
 
 type router struct {
@@ -25,6 +26,12 @@ func (r *router) get(path string, handler http.Handler) {
 	r.Methods("GET").Path(fmt.Sprintf("%s/", path)).Handler(handler)
 }
 
+// getStream routes the GET requests that accept a Server-Sent Events stream, leaving the others to the next routes
+func (r *router) getStream(path string, handler http.Handler) {
+	r.Methods("GET").Path(path).HeadersRegexp("Accept", "text/event-stream").Handler(handler)
+	r.Methods("GET").Path(fmt.Sprintf("%s/", path)).HeadersRegexp("Accept", "text/event-stream").Handler(handler)
+}
+
 func (r *router) post(path string, handler http.Handler) {
 	r.Methods("POST").Path(path).Handler(handler)
 	r.Methods("POST").Path(fmt.Sprintf("%s/", path)).Handler(handler)
@@ -55,6 +62,50 @@ func (r *router) options(path string, handler http.Handler) {
 	r.Methods("OPTIONS").Path(fmt.Sprintf("%s/", path)).Handler(handler)
 }
 
+// QueryParamAccessToken is the bearer token of requests that cannot set the Authorization header (RFC 6750)
+const QueryParamAccessToken = "access_token"
+
+// authorizeQueryToken passes the bearer token of the query parameter as the Authorization header
+// The token is removed from the URL, so that it is not logged.
+func authorizeQueryToken(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		if token := query.Get(QueryParamAccessToken); token != "" {
+			if req.Header.Get("Authorization") == "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			query.Del(QueryParamAccessToken)
+			req.URL.RawQuery = query.Encode()
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// authorizeAsGet serves read-only requests that carry a body (e.g. batch retrieval) under the authorization rules of GET
+func authorizeAsGet(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.Method = http.MethodGet
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// authorizeAsGetPath serves read-only requests that carry a body under the authorization rules of GET on another path
+// The handlers in the chain (e.g. the auth validator) see the given path, the final handler sees the requested one.
+// This is used for requests that may return any resource under the path, such as the batch retrieval of TDs.
+func authorizeAsGetPath(path string, chain alice.Chain, handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requested := req.URL.Path
+		defer func() { req.URL.Path = requested }()
+
+		req.Method = http.MethodGet
+		req.URL.Path = path
+		chain.ThenFunc(func(w http.ResponseWriter, req *http.Request) {
+			req.URL.Path = requested
+			handler(w, req)
+		}).ServeHTTP(w, req)
+	})
+}
+
 func optionsHandler(w http.ResponseWriter, _ *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
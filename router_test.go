@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/linksmart/go-sec/auth/validator"
+	"github.com/linksmart/go-sec/authz"
+	uuid "github.com/satori/go.uuid"
+	"github.com/tinyiot/thing-directory/catalog"
+)
+
+const testAuthProvider = "test-tokens"
+
+// testTokenDriver accepts the tokens that are usernames
+type testTokenDriver struct{}
+
+func (testTokenDriver) Validate(_, _ string, token string) (bool, *authz.Claims, error) {
+	return true, &authz.Claims{Username: token}, nil
+}
+
+func init() {
+	validator.Register(testAuthProvider, testTokenDriver{})
+}
+
+func TestBatchGetAuthorization(t *testing.T) {
+	tempDir := fmt.Sprintf("%s/thing-directory/test-%s-ldb",
+		strings.Replace(os.TempDir(), "\\", "/", -1), uuid.NewV4())
+	storage, err := catalog.NewLevelDBStorage(tempDir, nil)
+	if err != nil {
+		t.Fatalf("error creating leveldb storage: %s", err)
+	}
+	controller, err := catalog.NewController(storage, catalog.DefaultGeoLocations, 0)
+	if err != nil {
+		storage.Close()
+		t.Fatalf("error creating controller: %s", err)
+	}
+	defer func() {
+		controller.Stop()
+		os.RemoveAll(tempDir)
+	}()
+
+	config := &HTTPConfig{}
+	config.Auth.Enabled = true
+	config.Auth.Provider = testAuthProvider
+	config.Auth.Authz.Enabled = true
+	config.Auth.Authz.Rules = authz.Rules{
+		// can read one TD, including one with the id of the batch endpoint
+		{Paths: []string{"/things/urn:example:1", "/things/batch-get"}, Methods: []string{"GET"}, Users: []string{"reader"}},
+		// can read all TDs
+		{Paths: []string{"/things"}, Methods: []string{"GET"}, Users: []string{"lister"}},
+	}
+	router, err := setupHTTPRouter(config, catalog.NewHTTPAPI(controller, "test"), nil, nil, nil)
+	if err != nil {
+		t.Fatalf("Error setting up the router: %s", err)
+	}
+
+	batchGet := func(token string) int {
+		req := httptest.NewRequest(http.MethodPost, "/things/batch-get", strings.NewReader(`["urn:example:1","urn:example:2"]`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	t.Run("reader of some TDs", func(t *testing.T) {
+		if code := batchGet("reader"); code != http.StatusForbidden {
+			t.Fatalf("Expected status %d, got: %d", http.StatusForbidden, code)
+		}
+	})
+
+	t.Run("reader of all TDs", func(t *testing.T) {
+		if code := batchGet("lister"); code != http.StatusOK {
+			t.Fatalf("Expected status %d, got: %d", http.StatusOK, code)
+		}
+	})
+}
+
+func TestRouterThingEvents(t *testing.T) {
+	r := newRouter()
+	r.getStream("/things/{id:.+}/events", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("stream"))
+	}))
+	r.get("/things/{id:.+}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(mux.Vars(req)["id"]))
+	}))
+
+	get := func(accept string) string {
+		req := httptest.NewRequest(http.MethodGet, "/things/urn:example:1/events", nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+
+	t.Run("event stream", func(t *testing.T) {
+		if body := get("text/event-stream"); body != "stream" {
+			t.Fatalf("Expected the event stream, got: %s", body)
+		}
+	})
+
+	t.Run("thing with id ending in events", func(t *testing.T) {
+		if body := get("application/json"); body != "urn:example:1/events" {
+			t.Fatalf("Expected the retrieval of urn:example:1/events, got: %s", body)
+		}
+	})
+}
+
+func TestAuthorizeQueryToken(t *testing.T) {
+	v, err := validator.Setup(testAuthProvider, "", "", false, &authz.Conf{
+		Enabled: true,
+		Rules:   authz.Rules{{Paths: []string{"/events"}, Methods: []string{"GET"}, Users: []string{"reader"}}},
+	})
+	if err != nil {
+		t.Fatalf("Error setting up the validator: %s", err)
+	}
+	handler := authorizeQueryToken(v.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.URL.RawQuery))
+	})))
+
+	for query, code := range map[string]int{
+		"":                             http.StatusUnauthorized,
+		"?access_token=other":          http.StatusForbidden,
+		"?access_token=reader&lang=en": http.StatusOK,
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/events/websocket"+query, nil))
+		if rec.Code != code {
+			t.Fatalf("Expected status %d for %q, got: %d", code, query, rec.Code)
+		}
+		if code == http.StatusOK && rec.Body.String() != "lang=en" {
+			t.Fatalf("Expected the token to be removed from the query, got: %s", rec.Body.String())
+		}
+	}
+}
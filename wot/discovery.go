@@ -12,6 +12,9 @@ const (
 	// Media Types
 	MediaTypeJSONLD = "application/ld+json"
 	MediaTypeJSON   = "application/json"
+	// JSON-LD context and types of directory responses
+	DiscoveryContextURI = "https://w3c.github.io/wot-discovery/context/discovery-context.jsonld"
+	TypeThingCollection = "ThingCollection"
 	// TD keys used by directory
 	KeyThingID                   = "id"
 	KeyThingRegistration         = "registration"
@@ -23,8 +26,19 @@ const (
 	EventTypeCreate = "thing_created"
 	EventTypeUpdate = "thing_updated"
 	EventTypeDelete = "thing_deleted"
+	// EventTypeExpiring warns before the registration of a TD expires
+	EventTypeExpiring = "thing_expiring"
 )
 
+// ThingCollection is a page of listed TDs in the discovery collection format
+type ThingCollection struct {
+	Context string                   `json:"@context"`
+	Type    string                   `json:"@type"`
+	Total   int                      `json:"total"`
+	Members []map[string]interface{} `json:"members"`
+	Next    string                   `json:"next,omitempty"`
+}
+
 type EnrichedTD struct {
 	*ThingDescription
 	Registration *ThingRegistration `json:"registration,omitempty"`
@@ -44,7 +58,7 @@ type EventType string
 
 func (e EventType) IsValid() bool {
 	switch e {
-	case EventTypeCreate, EventTypeUpdate, EventTypeDelete:
+	case EventTypeCreate, EventTypeUpdate, EventTypeDelete, EventTypeExpiring:
 		return true
 	default:
 		return false
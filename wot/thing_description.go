@@ -251,7 +251,7 @@ type DataSchema struct {
 	Description string `json:"description,omitempty"`
 
 	// Can be used to support (human-readable) information in different languages
-	Descriptions string `json:"descriptions,omitempty"`
+	Descriptions map[string]string `json:"descriptions,omitempty"`
 
 	// Restricted set of values provided as an array.
 	Enum []any `json:"enum,omitempty"`
@@ -269,7 +269,7 @@ type DataSchema struct {
 	Title string `json:"title,omitempty"`
 
 	// Provides multi-language human-readable titles (e.g., display a text for UI representation in different languages).
-	Titles []string `json:"titles,omitempty"`
+	Titles map[string]string `json:"titles,omitempty"`
 
 	// Assignment of JSON-based data types compatible with JSON Schema (one of boolean, integer, number, string, object, array, or null).
 	// DataType corresponds to the JSON schema field "type".